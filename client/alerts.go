@@ -0,0 +1,614 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/metrics"
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+	slog "github.com/sagikazarmark/slog-shim"
+	"gopkg.in/yaml.v3"
+)
+
+// Alert statuses.
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// Alert target kinds.
+const (
+	AlertTargetStation      = "station"
+	AlertTargetNeighborhood = "neighborhood"
+	AlertTargetArea         = "area"
+)
+
+// DefaultAlertCooldown is how long after firing a rule waits before it can fire again
+// for the same target, unless the config says otherwise.
+const DefaultAlertCooldown = time.Hour
+
+// DefaultAlertMaxGap is the longest gap between two polls across which a condition is
+// assumed to have held throughout; past it, the minimum duration starts over.
+const DefaultAlertMaxGap = 10 * time.Minute
+
+// alertMetrics are what a rule can test. Counts apply to every target (summed over the
+// installed stations of a neighborhood or area); the *_stations counts only to
+// neighborhoods and areas; flags only to stations.
+var alertMetrics = map[string]struct {
+	flag      bool
+	aggregate bool // neighborhoods and areas only
+	value     func(types.NormalizedStation) int
+}{
+	"bikes":          {value: func(s types.NormalizedStation) int { return s.BikesAvailable }},
+	"ebikes":         {value: func(s types.NormalizedStation) int { return s.EBikesAvailable }},
+	"classic":        {value: func(s types.NormalizedStation) int { return s.BikesAvailable - s.EBikesAvailable }},
+	"docks":          {value: func(s types.NormalizedStation) int { return s.DocksAvailable }},
+	"empty_stations": {aggregate: true, value: func(s types.NormalizedStation) int { return boolInt(s.IsRenting && s.BikesAvailable == 0) }},
+	"full_stations":  {aggregate: true, value: func(s types.NormalizedStation) int { return boolInt(s.IsReturning && s.DocksAvailable == 0) }},
+	"renting":        {flag: true, value: func(s types.NormalizedStation) int { return boolInt(s.IsRenting) }},
+	"returning":      {flag: true, value: func(s types.NormalizedStation) int { return boolInt(s.IsReturning) }},
+	"installed":      {flag: true, value: func(s types.NormalizedStation) int { return boolInt(s.IsInstalled) }},
+}
+
+// AlertConfig is the YAML file of alert rules and where to send what they raise.
+type AlertConfig struct {
+	Timezone     string                      `yaml:"timezone"` // for windows; empty = the local zone
+	Cooldown     time.Duration               `yaml:"cooldown"` // default for rules; zero = DefaultAlertCooldown
+	Destinations map[string]AlertDestination `yaml:"destinations"`
+	Rules        []AlertRule                 `yaml:"rules"`
+
+	location *time.Location
+}
+
+// AlertDestination is a named place to deliver alerts. URL and header values expand
+// $VARS from the environment, so secrets can stay out of the file.
+type AlertDestination struct {
+	Type     string            `yaml:"type"` // "webhook", "slack" or "ntfy"
+	URL      string            `yaml:"url"`
+	Headers  map[string]string `yaml:"headers"`
+	Priority string            `yaml:"priority"` // ntfy only
+
+	name string
+}
+
+// AlertRule raises an alert for each of its targets whose metric meets the condition
+// for at least For, inside one of its windows.
+type AlertRule struct {
+	Name string `yaml:"name"`
+
+	// Exactly one target list. Stations are matched by station_id or exact name,
+	// neighborhoods by slug.
+	Stations      []string `yaml:"stations"`
+	Neighborhoods []string `yaml:"neighborhoods"`
+	Areas         []string `yaml:"areas"`
+
+	Metric string `yaml:"metric"`
+
+	// Exactly one condition: below or above for counts, is for flags.
+	Below *int  `yaml:"below"`
+	Above *int  `yaml:"above"`
+	Is    *bool `yaml:"is"`
+
+	Windows  []AlertWindow `yaml:"windows"` // none = always
+	For      time.Duration `yaml:"for"`
+	Cooldown time.Duration `yaml:"cooldown"`
+	Resolved bool          `yaml:"resolved"` // also notify when the condition clears
+	Notify   []string      `yaml:"notify"`   // destination names
+}
+
+// AlertWindow is a time of day, on some days of the week, in the config's time zone.
+// A window whose To is before its From runs past midnight; its days are the days it
+// starts on.
+type AlertWindow struct {
+	Days []string `yaml:"days"` // mon..sun; none = every day
+	From string   `yaml:"from"` // HH:MM, inclusive
+	To   string   `yaml:"to"`   // HH:MM, exclusive
+
+	days     map[time.Weekday]bool
+	from, to int // minutes past midnight
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// LoadAlertConfig reads and validates an alert rules file.
+func LoadAlertConfig(path string) (*AlertConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseAlertConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// ParseAlertConfig decodes and validates alert rules. Unknown keys are errors, so a
+// typo doesn't silently disable a rule.
+func ParseAlertConfig(data []byte) (*AlertConfig, error) {
+	var cfg AlertConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (cfg *AlertConfig) validate() error {
+	cfg.location = time.Local
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return fmt.Errorf("timezone: %w", err)
+		}
+		cfg.location = loc
+	}
+	if cfg.Cooldown < 0 {
+		return fmt.Errorf("cooldown must not be negative")
+	}
+	if cfg.Cooldown == 0 {
+		cfg.Cooldown = DefaultAlertCooldown
+	}
+	for name, d := range cfg.Destinations {
+		switch d.Type {
+		case "webhook", "slack", "ntfy":
+		default:
+			return fmt.Errorf("destination %q: type must be webhook, slack or ntfy", name)
+		}
+		d.URL = os.ExpandEnv(d.URL)
+		if d.URL == "" {
+			return fmt.Errorf("destination %q: url is empty", name)
+		}
+		for k, v := range d.Headers {
+			d.Headers[k] = os.ExpandEnv(v)
+		}
+		d.name = name
+		cfg.Destinations[name] = d
+	}
+	if len(cfg.Rules) == 0 {
+		return fmt.Errorf("no rules")
+	}
+	names := make(map[string]bool, len(cfg.Rules))
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		if r.Name == "" {
+			return fmt.Errorf("rule %d: name is required", i+1)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("rule %q: duplicate name", r.Name)
+		}
+		names[r.Name] = true
+		if err := r.validate(cfg); err != nil {
+			return fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+	}
+	return nil
+}
+
+func (r *AlertRule) validate(cfg *AlertConfig) error {
+	var targets int
+	for _, list := range [][]string{r.Stations, r.Neighborhoods, r.Areas} {
+		if len(list) > 0 {
+			targets++
+		}
+	}
+	if targets != 1 {
+		return fmt.Errorf("needs exactly one of stations, neighborhoods or areas")
+	}
+	m, ok := alertMetrics[r.Metric]
+	switch {
+	case !ok:
+		return fmt.Errorf("unknown metric %q", r.Metric)
+	case m.flag && r.targetKind() != AlertTargetStation:
+		return fmt.Errorf("%s is a station flag; neighborhoods and areas can use empty_stations or full_stations", r.Metric)
+	case m.aggregate && r.targetKind() == AlertTargetStation:
+		return fmt.Errorf("%s applies to neighborhoods and areas only", r.Metric)
+	}
+	var conditions int
+	for _, set := range []bool{r.Below != nil, r.Above != nil, r.Is != nil} {
+		if set {
+			conditions++
+		}
+	}
+	switch {
+	case conditions != 1:
+		return fmt.Errorf("needs exactly one of below, above or is")
+	case m.flag && r.Is == nil:
+		return fmt.Errorf("%s is a flag: use is: true or is: false", r.Metric)
+	case !m.flag && r.Is != nil:
+		return fmt.Errorf("%s is a count: use below or above", r.Metric)
+	}
+	if r.For < 0 || r.Cooldown < 0 {
+		return fmt.Errorf("for and cooldown must not be negative")
+	}
+	if r.Cooldown == 0 {
+		r.Cooldown = cfg.Cooldown
+	}
+	for i := range r.Windows {
+		if err := r.Windows[i].parse(); err != nil {
+			return fmt.Errorf("window %d: %w", i+1, err)
+		}
+	}
+	for _, d := range r.Notify {
+		if _, ok := cfg.Destinations[d]; !ok {
+			return fmt.Errorf("unknown destination %q", d)
+		}
+	}
+	return nil
+}
+
+func (w *AlertWindow) parse() error {
+	var err error
+	if w.from, err = parseClock(w.From); err != nil {
+		return fmt.Errorf("from: %w", err)
+	}
+	if w.to, err = parseClock(w.To); err != nil {
+		return fmt.Errorf("to: %w", err)
+	}
+	if w.from == w.to {
+		return fmt.Errorf("from and to are the same; leave out windows to alert at any time")
+	}
+	w.days = make(map[time.Weekday]bool, len(w.Days))
+	for _, d := range w.Days {
+		day, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return fmt.Errorf("unknown day %q (want mon, tue, wed, thu, fri, sat or sun)", d)
+		}
+		w.days[day] = true
+	}
+	return nil
+}
+
+// parseClock parses HH:MM into minutes past midnight; "24:00" is the end of the day.
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hours, err1 := strconv.Atoi(h)
+	minutes, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hours < 0 || minutes < 0 || minutes > 59 ||
+		hours*60+minutes > 24*60 {
+		return 0, fmt.Errorf("want HH:MM, got %q", s)
+	}
+	return hours*60 + minutes, nil
+}
+
+// contains reports whether t (in the config's zone) falls inside the window.
+func (w AlertWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.from > w.to && minute < w.to {
+		day = (day + 6) % 7 // the early hours of a window that started the day before
+	} else if minute < w.from || (w.from < w.to && minute >= w.to) {
+		return false
+	}
+	return len(w.days) == 0 || w.days[day]
+}
+
+func (r *AlertRule) active(t time.Time) bool {
+	if len(r.Windows) == 0 {
+		return true
+	}
+	for _, w := range r.Windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *AlertRule) targetKind() string {
+	switch {
+	case len(r.Neighborhoods) > 0:
+		return AlertTargetNeighborhood
+	case len(r.Areas) > 0:
+		return AlertTargetArea
+	}
+	return AlertTargetStation
+}
+
+func (r *AlertRule) matches(value int) bool {
+	switch {
+	case r.Below != nil:
+		return value < *r.Below
+	case r.Above != nil:
+		return value > *r.Above
+	}
+	return (value == 1) == *r.Is
+}
+
+func (r *AlertRule) condition() string {
+	switch {
+	case r.Below != nil:
+		return fmt.Sprintf("below %d", *r.Below)
+	case r.Above != nil:
+		return fmt.Sprintf("above %d", *r.Above)
+	}
+	return fmt.Sprintf("is %t", *r.Is)
+}
+
+// NeedsNeighborhoods reports whether any rule targets neighborhoods or areas, which
+// needs a neighborhood set to place stations.
+func (cfg *AlertConfig) NeedsNeighborhoods() bool {
+	for _, r := range cfg.Rules {
+		if r.targetKind() != AlertTargetStation {
+			return true
+		}
+	}
+	return false
+}
+
+// AlertEngine evaluates alert rules against a stream of polls. Feed it polls in time
+// order with Evaluate.
+type AlertEngine struct {
+	cfg      *AlertConfig
+	maxGap   time.Duration
+	ns       []Neighborhood
+	area     map[string]string // slug -> area
+	display  map[string]string // slug -> display name
+	stations map[string]*alertStation
+	states   map[alertKey]*alertState
+	lastPoll time.Time
+	// changesOnly is set once a poll carries Keyframe or Delta: stations then drop out
+	// of the polls while unchanged, so only a keyframe says which are gone.
+	changesOnly bool
+}
+
+// alertStation is the latest state seen of a station. Polls may carry only the
+// stations that changed (a --changes-only recording), so targets are evaluated over
+// this rather than over the poll, and a station is kept until a keyframe leaves it out.
+type alertStation struct {
+	station      types.NormalizedStation
+	neighborhood string
+	seen         time.Time
+}
+
+type alertKey struct {
+	rule   int
+	target string
+}
+
+type alertState struct {
+	since   time.Time // first poll of the current run that matched; zero = not matching
+	last    time.Time // last poll evaluated
+	firing  bool
+	firedAt time.Time
+}
+
+// alertTarget is one thing a rule is evaluated on, with its value this poll.
+type alertTarget struct {
+	name  string
+	value int
+}
+
+// NewAlertEngine returns an engine for cfg. ns places stations in neighborhoods and
+// areas when the feed doesn't tag them, and must be set when a rule targets them.
+// Conditions start over across gaps longer than maxGap (zero = DefaultAlertMaxGap).
+func NewAlertEngine(cfg *AlertConfig, ns []Neighborhood, maxGap time.Duration) (*AlertEngine, error) {
+	if maxGap <= 0 {
+		maxGap = DefaultAlertMaxGap
+	}
+	e := &AlertEngine{cfg: cfg, maxGap: maxGap, ns: ns, area: make(map[string]string, len(ns)),
+		display: make(map[string]string, len(ns))}
+	areas := make(map[string]bool)
+	for _, n := range ns {
+		e.area[n.Slug], e.display[n.Slug] = n.Area, n.Display
+		areas[n.Area] = true
+	}
+	for _, r := range cfg.Rules {
+		for _, slug := range r.Neighborhoods {
+			if _, ok := e.area[slug]; !ok {
+				return nil, fmt.Errorf("rule %q: unknown neighborhood %q", r.Name, slug)
+			}
+		}
+		for _, a := range r.Areas {
+			if !areas[a] {
+				return nil, fmt.Errorf("rule %q: unknown area %q", r.Name, a)
+			}
+		}
+	}
+	e.reset()
+	return e, nil
+}
+
+// reset forgets every station and rule state, as after a change of leader.
+func (e *AlertEngine) reset() {
+	e.stations = make(map[string]*alertStation)
+	e.states = make(map[alertKey]*alertState)
+	e.lastPoll = time.Time{}
+	e.changesOnly = false
+}
+
+// Evaluate feeds one poll and returns the alerts it raises, in rule order. A poll no
+// later than the previous one is ignored.
+func (e *AlertEngine) Evaluate(poll []types.NormalizedStationDataTS) []types.Alert {
+	var at time.Time
+	for _, p := range poll {
+		if p.TimeStamp.After(at) {
+			at = p.TimeStamp
+		}
+	}
+	if !at.After(e.lastPoll) {
+		return nil
+	}
+	gap := at.Sub(e.lastPoll) > e.maxGap
+	e.lastPoll = at
+	keyframe := false
+	for _, p := range poll {
+		if p.Keyframe || p.Delta != "" {
+			e.changesOnly = true
+		}
+		keyframe = keyframe || p.Keyframe
+		st, ok := e.stations[p.Station.ID]
+		if !ok {
+			st = &alertStation{}
+			e.stations[p.Station.ID] = st
+		}
+		st.station, st.seen = p.Station, p.TimeStamp
+		switch {
+		case p.Station.Neighborhood != "":
+			st.neighborhood = p.Station.Neighborhood
+		case st.neighborhood == "" && len(e.ns) > 0:
+			st.neighborhood = assignNeighborhood(e.ns, p.Station.Latitude, p.Station.Longitude)
+		}
+	}
+	for id, st := range e.stations {
+		gone := at.Sub(st.seen) > e.maxGap
+		if e.changesOnly {
+			// an unchanged station is simply left out; a keyframe lists every station,
+			// and after a break in the recording nothing older can be trusted
+			gone = st.seen.Before(at) && (keyframe || gap)
+		}
+		if gone {
+			delete(e.stations, id) // gone from the feed; its targets have no value
+		}
+	}
+
+	var alerts []types.Alert
+	local := at.In(e.cfg.location)
+	for i := range e.cfg.Rules {
+		r := &e.cfg.Rules[i]
+		targets := e.targets(r)
+		inWindow := r.active(local)
+		for _, id := range sortedKeys(targets) {
+			t := targets[id]
+			key := alertKey{i, id}
+			st, ok := e.states[key]
+			if !ok {
+				st = &alertState{}
+				e.states[key] = st
+			}
+			if !st.last.IsZero() && at.Sub(st.last) > e.maxGap {
+				st.since = time.Time{} // can't tell it held across the gap
+			}
+			st.last = at
+			if !inWindow {
+				// outside its windows a rule is idle, and says nothing
+				st.since, st.firing = time.Time{}, false
+				continue
+			}
+			if !r.matches(t.value) {
+				if st.firing && r.Resolved {
+					alerts = append(alerts, e.alert(r, AlertResolved, id, t, st.since, at))
+				}
+				st.since, st.firing = time.Time{}, false
+				continue
+			}
+			if st.since.IsZero() {
+				st.since = at
+			}
+			if !st.firing && at.Sub(st.since) >= r.For &&
+				(st.firedAt.IsZero() || at.Sub(st.firedAt) >= r.Cooldown) {
+				st.firing, st.firedAt = true, at
+				alerts = append(alerts, e.alert(r, AlertFiring, id, t, st.since, at))
+			}
+		}
+		for key := range e.states {
+			if _, ok := targets[key.target]; key.rule == i && !ok {
+				delete(e.states, key)
+			}
+		}
+	}
+	return alerts
+}
+
+// targets returns the rule's targets that have a value this poll, by id. A station
+// that isn't installed has no counts; a neighborhood or area with no installed
+// stations has no value.
+func (e *AlertEngine) targets(r *AlertRule) map[string]alertTarget {
+	m := alertMetrics[r.Metric]
+	out := make(map[string]alertTarget)
+	switch r.targetKind() {
+	case AlertTargetStation:
+		for _, st := range e.stations {
+			s := st.station
+			for _, ref := range r.Stations {
+				if (ref == s.ID || ref == s.Name) && (m.flag || s.IsInstalled) {
+					out[s.ID] = alertTarget{name: s.Name, value: m.value(s)}
+				}
+			}
+		}
+	case AlertTargetNeighborhood, AlertTargetArea:
+		want := make(map[string]bool)
+		for _, t := range append(append([]string(nil), r.Neighborhoods...), r.Areas...) {
+			want[t] = true
+		}
+		for _, st := range e.stations {
+			id := st.neighborhood
+			if r.targetKind() == AlertTargetArea {
+				id = e.area[id]
+			}
+			if !want[id] || !st.station.IsInstalled {
+				continue
+			}
+			t, ok := out[id]
+			if !ok {
+				t.name = id
+				if d := e.display[id]; d != "" && r.targetKind() == AlertTargetNeighborhood {
+					t.name = d
+				}
+			}
+			t.value += m.value(st.station)
+			out[id] = t
+		}
+	}
+	return out
+}
+
+func (e *AlertEngine) alert(r *AlertRule, status, id string, t alertTarget, since, at time.Time) types.Alert {
+	a := types.Alert{Rule: r.Name, Status: status, TargetKind: r.targetKind(), Target: id, Name: t.name,
+		Metric: r.Metric, Value: t.value, Condition: r.condition(), Since: since, At: at}
+	value := strconv.Itoa(t.value)
+	if alertMetrics[r.Metric].flag {
+		value = strconv.FormatBool(t.value == 1)
+	}
+	if status == AlertResolved {
+		a.Message = fmt.Sprintf("[%s] resolved: %s: %s %s", r.Name, t.name, r.Metric, value)
+	} else {
+		a.Message = fmt.Sprintf("[%s] %s: %s %s, %s for %s", r.Name, t.name, r.Metric, value,
+			r.condition(), at.Sub(since).Truncate(time.Second))
+	}
+	return a
+}
+
+func sortedKeys(m map[string]alertTarget) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// evaluateAlerts feeds one poll to the alert engine and hands what it raises to the
+// notifier. Alerts are logged and counted whether or not they have destinations.
+func (c *Client) evaluateAlerts(data []types.NormalizedStationDataTS) {
+	if c.alerts == nil || len(data) == 0 {
+		return
+	}
+	for _, a := range c.alerts.Evaluate(data) {
+		slog.Info("alert", "rule", a.Rule, "status", a.Status, "target", a.Target, "value", a.Value)
+		metrics.Alerts.Inc(a.Rule)
+		if c.notifier != nil && !c.notifier.enqueue(a) {
+			metrics.Errors.Inc("alert")
+			slog.Warn("alert dropped: delivery queue full", "rule", a.Rule)
+		}
+	}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,255 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+)
+
+const testAlertRules = `
+timezone: UTC
+destinations:
+  me:
+    type: ntfy
+    url: https://ntfy.example/${ALERT_TEST_TOPIC}
+    priority: high
+  ops:
+    type: slack
+    url: https://hooks.example/ops
+rules:
+  - name: home
+    stations: [a]
+    metric: ebikes
+    below: 2
+    windows:
+      - days: [mon, tue, wed, thu, fri]
+        from: "07:00"
+        to: "10:00"
+    for: 5m
+    cooldown: 30m
+    resolved: true
+    notify: [me]
+  - name: hood
+    neighborhoods: [red-hook]
+    metric: docks
+    below: 1
+    notify: [ops, me]
+`
+
+// TestAlertEngine covers windows, the minimum duration, cooldown, resolved notices,
+// gaps and neighborhood totals.
+func TestAlertEngine(t *testing.T) {
+	cfg, err := ParseAlertConfig([]byte(testAlertRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewAlertEngine(cfg, []Neighborhood{{Slug: "red-hook", Display: "Red Hook", Area: "brooklyn"}}, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2026, 6, 1, 7, 0, 0, 0, time.UTC) // a Monday
+	poll := func(min, aEBikes, aDocks, bDocks int) []types.NormalizedStationDataTS {
+		var out []types.NormalizedStationDataTS
+		for _, s := range []types.NormalizedStation{{ID: "a", Name: "Home", EBikesAvailable: aEBikes, DocksAvailable: aDocks},
+			{ID: "b", Name: "Other", DocksAvailable: bDocks}} {
+			s.BikesAvailable, s.Neighborhood = s.EBikesAvailable, "red-hook"
+			s.IsInstalled, s.IsRenting, s.IsReturning = true, true, true
+			out = append(out, types.NormalizedStationDataTS{Station: s, TimeStamp: t0.Add(time.Duration(min) * time.Minute)})
+		}
+		return out
+	}
+	for _, step := range []struct {
+		poll []types.NormalizedStationDataTS
+		want string
+	}{
+		// the neighborhood has no docks left; home is low on e-bikes, but not for long enough
+		{poll(0, 1, 0, 0), "[hood] Red Hook: docks 0, below 1 for 0s"},
+		{poll(3, 0, 0, 0), ""},
+		{poll(5, 1, 0, 0), "[home] Home: ebikes 1, below 2 for 5m0s"},
+		{poll(6, 3, 0, 0), "[home] resolved: Home: ebikes 3"},
+		// low again, but within the cooldown
+		{poll(7, 0, 0, 0), ""},
+		{poll(12, 0, 0, 0), ""},
+		// after a gap the run starts over
+		{poll(36, 0, 0, 0), ""},
+		{poll(41, 0, 0, 0), "[home] Home: ebikes 0, below 2 for 5m0s"},
+		// outside the window home is idle; hood has docks again but doesn't ask for resolved
+		{poll(180, 0, 0, 2), ""},
+		{poll(180, 0, 0, 0), ""}, // a duplicate poll changes nothing
+	} {
+		var got []string
+		for _, a := range e.Evaluate(step.poll) {
+			got = append(got, a.Message)
+		}
+		if strings.Join(got, "; ") != step.want {
+			t.Errorf("poll at %v:\n got %s\nwant %s", step.poll[0].TimeStamp.Sub(t0), strings.Join(got, "; "), step.want)
+		}
+	}
+}
+
+// TestAlertEngineChangesOnly replays a --changes-only recording the way `alerts test`
+// does: a station left out while unchanged keeps its value until a keyframe omits it.
+func TestAlertEngineChangesOnly(t *testing.T) {
+	cfg, err := ParseAlertConfig([]byte(`rules:
+  - {name: low, stations: [a], metric: ebikes, below: 2, for: 15m}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2026, 6, 1, 7, 0, 0, 0, time.UTC)
+	station := func(id string, ebikes int) types.NormalizedStation {
+		return types.NormalizedStation{ID: id, Name: id, BikesAvailable: ebikes, EBikesAvailable: ebikes, DocksAvailable: 5,
+			IsInstalled: true, IsRenting: true, IsReturning: true}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	tracker := newChangeTracker(time.Hour) // the --keyframe-interval default
+	for min := 0; min < 30; min++ {
+		// a sits at 0 e-bikes; b moves every poll, so every poll has a row
+		poll := []types.NormalizedStationDataTS{
+			{Station: station("a", 0), TimeStamp: t0.Add(time.Duration(min) * time.Minute)},
+			{Station: station("b", min%3), TimeStamp: t0.Add(time.Duration(min) * time.Minute)},
+		}
+		for _, d := range tracker.filter(poll) {
+			if err := enc.Encode(d); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// a keyframe without a: it's gone from the feed
+	kf := types.NormalizedStationDataTS{Station: station("b", 4), TimeStamp: t0.Add(2 * time.Hour), Keyframe: true}
+	if err := enc.Encode(kf); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "changes.jsonl")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewAlertEngine(cfg, nil, DefaultAlertMaxGap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	var poll []types.NormalizedStationDataTS
+	evaluate := func() {
+		for _, a := range e.Evaluate(poll) {
+			got = append(got, a.At.Sub(t0).String()+" "+a.Message)
+		}
+		poll = poll[:0]
+	}
+	if err := ReadSnapshots(path, func(d types.NormalizedStationDataTS) error {
+		if len(poll) > 0 && !d.TimeStamp.Equal(poll[0].TimeStamp) {
+			evaluate()
+		}
+		poll = append(poll, d)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	evaluate()
+	if want := "15m0s [low] a: ebikes 0, below 2 for 15m0s"; strings.Join(got, "; ") != want {
+		t.Errorf("alerts: got %q, want %q", got, want)
+	}
+	if _, ok := e.stations["a"]; ok {
+		t.Error("a is still tracked after a keyframe left it out")
+	}
+}
+
+// TestParseAlertConfig covers validation and windows that run past midnight.
+func TestParseAlertConfig(t *testing.T) {
+	for _, tc := range []struct{ rule, want string }{
+		{"{name: x, metric: bikes, below: 1}", "needs exactly one of stations"},
+		{"{name: x, stations: [a], areas: [b], metric: bikes, below: 1}", "needs exactly one of stations"},
+		{"{name: x, stations: [a], metric: scooters, below: 1}", "unknown metric"},
+		{"{name: x, stations: [a], metric: bikes, below: 1, above: 5}", "exactly one of below, above or is"},
+		{"{name: x, stations: [a], metric: renting, below: 1}", "is a flag"},
+		{"{name: x, areas: [a], metric: renting, is: false}", "station flag"},
+		{"{name: x, stations: [a], metric: empty_stations, above: 0}", "neighborhoods and areas only"},
+		{"{name: x, stations: [a], metric: bikes, below: 1, windows: [{from: '7am', to: '10:00'}]}", "want HH:MM"},
+		{"{name: x, stations: [a], metric: bikes, below: 1, windows: [{days: [monday], from: '07:00', to: '10:00'}]}", "unknown day"},
+		{"{name: x, stations: [a], metric: bikes, below: 1, notify: [pager]}", "unknown destination"},
+		{"{name: x, stations: [a], metric: bikes, below: 1, fro: 5m}", "field fro not found"},
+	} {
+		_, err := ParseAlertConfig([]byte("rules:\n  - " + tc.rule))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want %q", tc.rule, err, tc.want)
+		}
+	}
+
+	cfg, err := ParseAlertConfig([]byte(`rules:
+  - {name: x, stations: [a], metric: installed, is: false, windows: [{days: [fri], from: "22:00", to: "02:00"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Rules[0].Cooldown != DefaultAlertCooldown {
+		t.Errorf("cooldown = %v, want the default", cfg.Rules[0].Cooldown)
+	}
+	w := cfg.Rules[0].Windows[0]
+	for at, want := range map[string]bool{
+		"2026-06-05T23:00:00Z": true,  // Friday night
+		"2026-06-06T01:59:00Z": true,  // early Saturday, still Friday's window
+		"2026-06-06T02:00:00Z": false, // the end is exclusive
+		"2026-06-05T01:00:00Z": false, // early Friday belongs to Thursday
+		"2026-06-06T23:00:00Z": false, // Saturday night
+	} {
+		ts, _ := time.Parse(time.RFC3339, at)
+		if got := w.contains(ts); got != want {
+			t.Errorf("%s: in window = %t, want %t", at, got, want)
+		}
+	}
+}
+
+// fakePoster records requests, failing those to fail the way net/http does.
+type fakePoster struct {
+	sent []string
+	fail string
+}
+
+func (p *fakePoster) Post(endpoint string, headers map[string]string, body []byte) ([]byte, error) {
+	if endpoint == p.fail {
+		return nil, fmt.Errorf("failed to make request: %w", &url.Error{Op: "Post", URL: endpoint, Err: errors.New("connection refused")})
+	}
+	p.sent = append(p.sent, endpoint+" "+headers["Title"]+headers["Priority"]+" "+string(body))
+	return nil, nil
+}
+
+// TestAlertNotifier covers the Slack and ntfy payloads, env expansion and failures,
+// which mustn't quote the webhook URL.
+func TestAlertNotifier(t *testing.T) {
+	t.Setenv("ALERT_TEST_TOPIC", "dock")
+	cfg, err := ParseAlertConfig([]byte(testAlertRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	poster := &fakePoster{fail: "https://hooks.example/ops"}
+	n := NewAlertNotifier(cfg)
+	n.poster = poster
+	err = n.Send(types.Alert{Rule: "hood", Status: AlertFiring, Message: "[hood] Red Hook: docks 0"})
+	if err == nil || !strings.Contains(err.Error(), "slack ops: connection refused") {
+		t.Errorf("failed delivery not reported: %v", err)
+	}
+	if strings.Contains(err.Error(), "hooks.example") {
+		t.Errorf("error leaks the webhook URL: %v", err)
+	}
+	want := "https://ntfy.example/dock dockscan: hoodhigh [hood] Red Hook: docks 0"
+	if len(poster.sent) != 1 || poster.sent[0] != want {
+		t.Errorf("sent %q, want %q", poster.sent, want)
+	}
+
+	poster.fail, poster.sent = "", nil
+	if err := n.Send(types.Alert{Rule: "hood", Message: `say "hi"`}); err != nil {
+		t.Fatal(err)
+	}
+	if len(poster.sent) != 2 || poster.sent[0] != `https://hooks.example/ops  {"text":"say \"hi\""}` {
+		t.Errorf("unexpected slack payload: %q", poster.sent)
+	}
+}
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/kardolus/citi-bike-dock-tracker/http"
+	"github.com/kardolus/citi-bike-dock-tracker/logging"
+	"github.com/kardolus/citi-bike-dock-tracker/metrics"
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+// alertQueue bounds the alerts waiting for delivery, so a slow destination can't hold
+// up polling.
+const alertQueue = 100
+
+// alertPoster sends one request; *http.RestCaller in production.
+type alertPoster interface {
+	Post(url string, headers map[string]string, body []byte) ([]byte, error)
+}
+
+// AlertNotifier delivers alerts to the destinations their rules name:
+//
+//   - webhook: the alert as JSON (see types.Alert)
+//   - slack: {"text": message}, which Slack incoming webhooks and most chat tools accept
+//   - ntfy: the message as plain text, with the rule as title
+type AlertNotifier struct {
+	poster  alertPoster
+	notify  map[string][]AlertDestination // rule -> destinations
+	pending chan types.Alert
+}
+
+// NewAlertNotifier returns a notifier for cfg's rules and destinations.
+func NewAlertNotifier(cfg *AlertConfig) *AlertNotifier {
+	n := &AlertNotifier{poster: http.New(), notify: make(map[string][]AlertDestination, len(cfg.Rules))}
+	for _, r := range cfg.Rules {
+		for _, d := range r.Notify {
+			n.notify[r.Name] = append(n.notify[r.Name], cfg.Destinations[d])
+		}
+	}
+	return n
+}
+
+// Send delivers a to each of its rule's destinations, returning every failure. Errors
+// name the destination, never its URL.
+func (n *AlertNotifier) Send(a types.Alert) error {
+	var errs []error
+	for _, d := range n.notify[a.Rule] {
+		headers, body, err := alertRequest(d, a)
+		if err == nil {
+			_, err = n.poster.Post(d.URL, headers, body)
+		}
+		if err != nil {
+			// a network error quotes the URL, which is the secret for most webhooks
+			var uerr *url.Error
+			if errors.As(err, &uerr) {
+				err = uerr.Err
+			}
+			errs = append(errs, fmt.Errorf("%s %s: %w", d.Type, d.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// alertRequest is the headers and body that deliver a to d.
+func alertRequest(d AlertDestination, a types.Alert) (map[string]string, []byte, error) {
+	headers := make(map[string]string, len(d.Headers)+4)
+	var body []byte
+	var err error
+	switch d.Type {
+	case "webhook":
+		body, err = json.Marshal(a)
+	case "slack":
+		body, err = json.Marshal(map[string]string{"text": a.Message})
+	case "ntfy":
+		body = []byte(a.Message)
+		headers["Content-Type"] = "text/plain; charset=utf-8"
+		headers["Title"] = "dockscan: " + a.Rule
+		headers["Tags"] = "warning"
+		if a.Status == AlertResolved {
+			headers["Tags"] = "white_check_mark"
+		}
+		if d.Priority != "" {
+			headers["Priority"] = d.Priority
+		}
+	}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	return headers, body, err
+}
+
+// start delivers queued alerts in the background, one at a time so they arrive in
+// order. Failures are logged and counted; there is no retry.
+func (n *AlertNotifier) start() {
+	n.pending = make(chan types.Alert, alertQueue)
+	go func() {
+		for a := range n.pending {
+			if err := n.Send(a); err != nil {
+				metrics.Errors.Inc("alert")
+				slog.Warn("alert delivery failed", "rule", a.Rule, logging.Error(err, "alert"))
+			}
+		}
+	}()
+}
+
+// enqueue queues a for delivery, reporting false if the queue is full.
+func (n *AlertNotifier) enqueue(a types.Alert) bool {
+	select {
+	case n.pending <- a:
+		return true
+	default:
+		return false
+	}
+}
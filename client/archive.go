@@ -0,0 +1,477 @@
+package client
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+// dock_status storage kinds, which decide how old rows are dropped.
+const (
+	StorageTimescale   = "timescaledb" // hypertable; drop_chunks
+	StoragePartitioned = "partitioned" // native daily partitions; detach + drop
+	StoragePlain       = "plain"       // one table; DELETE
+)
+
+const (
+	// ArchiveManifestName is the manifest file written next to the archived days.
+	ArchiveManifestName = "manifest.json"
+	archiveFilePrefix   = "dock_status_"
+	archiveFileExt      = ".csv.gz"
+)
+
+// ArchiveManifest describes every archived day in a directory, so a restore (or a
+// person) can check each file before trusting it.
+type ArchiveManifest struct {
+	Table   string        `json:"table"`
+	Columns []string      `json:"columns"`
+	Files   []ArchiveFile `json:"files"`
+}
+
+// ArchiveFile is one archived UTC day: a gzipped CSV with a header row, in ts order.
+type ArchiveFile struct {
+	File       string    `json:"file"`
+	Day        string    `json:"day"`
+	Rows       int64     `json:"rows"`
+	Bytes      int64     `json:"bytes"`
+	SHA256     string    `json:"sha256"`
+	ArchivedAt time.Time `json:"archived_at"`
+}
+
+// ArchiveOptions configures Archive.
+type ArchiveOptions struct {
+	Dest      string
+	OlderThan time.Duration
+	DryRun    bool // report what would be archived and dropped, change nothing
+}
+
+// ArchivePlan is what Archive did (or, in a dry run, would do).
+type ArchivePlan struct {
+	Storage string
+	// Cutoff is the requested cutoff rounded down to what can be dropped whole (a
+	// chunk or partition boundary): every row before it is archived, then dropped.
+	Cutoff time.Time
+	Days   []ArchiveDay
+	Drop   []string // chunks/partitions to drop; empty for plain storage
+}
+
+// ArchiveDay is one UTC day's row count.
+type ArchiveDay struct {
+	Day  time.Time
+	Rows int64
+}
+
+// Archive moves dock_status rows older than opts.OlderThan to per-day gzipped CSV files
+// in opts.Dest. Rows are streamed out in ts order, each file's row count and checksum go
+// into the manifest, every file is re-read and checked against the manifest and the
+// database, and only then are the chunks/partitions (or rows) dropped. Nothing is
+// dropped if any step fails.
+func Archive(dsn string, opts ArchiveOptions) (ArchivePlan, error) {
+	if opts.Dest == "" {
+		return ArchivePlan{}, errors.New("archive destination is empty")
+	}
+	if opts.OlderThan <= 0 {
+		return ArchivePlan{}, errors.New("--older-than must be positive")
+	}
+	db, err := openPostgres(dsn)
+	if err != nil {
+		return ArchivePlan{}, err
+	}
+	defer db.Close()
+
+	plan, err := planArchive(db, time.Now().Add(-opts.OlderThan))
+	if err != nil {
+		return plan, err
+	}
+	if opts.DryRun || plan.Cutoff.IsZero() {
+		return plan, nil
+	}
+
+	if err := os.MkdirAll(opts.Dest, 0o755); err != nil {
+		return plan, err
+	}
+	manifest, err := ReadArchiveManifest(opts.Dest)
+	if err != nil {
+		return plan, err
+	}
+	for _, day := range plan.Days {
+		f, err := archiveDay(db, opts.Dest, day.Day)
+		if err != nil {
+			return plan, fmt.Errorf("archive %s: %w", day.Day.Format("2006-01-02"), err)
+		}
+		if f.Rows != day.Rows {
+			return plan, fmt.Errorf("archive %s: wrote %d rows, database has %d", f.Day, f.Rows, day.Rows)
+		}
+		manifest.put(f)
+		if err := writeArchiveManifest(opts.Dest, manifest); err != nil {
+			return plan, err
+		}
+		slog.Info("archive: wrote day", "day", f.Day, "rows", f.Rows, "file", f.File)
+	}
+
+	// re-read everything from disk before anything is dropped
+	for _, day := range plan.Days {
+		f, ok := manifest.file(day.Day)
+		if !ok {
+			return plan, fmt.Errorf("verify %s: missing from manifest", day.Day.Format("2006-01-02"))
+		}
+		if err := VerifyArchiveFile(opts.Dest, f); err != nil {
+			return plan, err
+		}
+	}
+
+	if err := dropArchived(db, plan); err != nil {
+		return plan, err
+	}
+	return plan, nil
+}
+
+// planArchive works out the droppable cutoff at or before cutoff and the days to archive.
+func planArchive(db *sql.DB, cutoff time.Time) (ArchivePlan, error) {
+	storage, err := dockStatusStorage(db)
+	if err != nil {
+		return ArchivePlan{}, err
+	}
+	plan := ArchivePlan{Storage: storage}
+	switch storage {
+	case StorageTimescale:
+		// drop_chunks(older_than) drops the chunks that end at or before the cutoff
+		var end sql.NullTime
+		if err := db.QueryRow(`SELECT max(range_end) FROM timescaledb_information.chunks
+WHERE hypertable_name = 'dock_status' AND range_end <= $1`, cutoff).Scan(&end); err != nil {
+			return plan, err
+		}
+		plan.Cutoff = end.Time
+		if end.Valid {
+			rows, err := db.Query(`SELECT format('%I.%I', chunk_schema, chunk_name) FROM timescaledb_information.chunks
+WHERE hypertable_name = 'dock_status' AND range_end <= $1 ORDER BY range_start`, end.Time)
+			if err != nil {
+				return plan, err
+			}
+			for rows.Next() {
+				var name string
+				if err := rows.Scan(&name); err != nil {
+					rows.Close()
+					return plan, err
+				}
+				plan.Drop = append(plan.Drop, name)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return plan, err
+			}
+		}
+	case StoragePartitioned:
+		names, err := dockStatusPartitions(db)
+		if err != nil {
+			return plan, err
+		}
+		plan.Drop = expiredPartitions(names, cutoff)
+		for _, name := range plan.Drop {
+			if upper, _ := partitionUpper(name); upper.After(plan.Cutoff) {
+				plan.Cutoff = upper
+			}
+		}
+	default:
+		plan.Cutoff = utcDay(cutoff)
+	}
+	if plan.Cutoff.IsZero() {
+		return plan, nil
+	}
+
+	rows, err := db.Query(`SELECT (ts AT TIME ZONE 'UTC')::date, count(*) FROM dock_status
+WHERE ts < $1 GROUP BY 1 ORDER BY 1`, plan.Cutoff)
+	if err != nil {
+		return plan, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d ArchiveDay
+		if err := rows.Scan(&d.Day, &d.Rows); err != nil {
+			return plan, err
+		}
+		d.Day = utcDay(d.Day)
+		plan.Days = append(plan.Days, d)
+	}
+	return plan, rows.Err()
+}
+
+// dockStatusStorage reports how dock_status is stored.
+func dockStatusStorage(db *sql.DB) (string, error) {
+	var hypertable bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')`).Scan(&hypertable); err != nil {
+		return "", err
+	}
+	if hypertable {
+		if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM timescaledb_information.hypertables
+WHERE hypertable_name = 'dock_status')`).Scan(&hypertable); err != nil {
+			return "", err
+		}
+	}
+	if hypertable {
+		return StorageTimescale, nil
+	}
+	if partitioned, err := isPartitioned(db); err != nil {
+		return "", err
+	} else if partitioned {
+		return StoragePartitioned, nil
+	}
+	return StoragePlain, nil
+}
+
+// archiveDay streams one UTC day of dock_status, in ts order, to its file in dest. It
+// reads through dock_status_wide, so narrow rows (--narrow-facts) are archived with the
+// name, location and neighborhood the station had that day and the file stands on its
+// own once the stations history moves on. The file is written under a temporary name
+// and renamed once complete.
+func archiveDay(db *sql.DB, dest string, day time.Time) (ArchiveFile, error) {
+	f := ArchiveFile{
+		File: archiveFilePrefix + day.Format("2006-01-02") + archiveFileExt,
+		Day:  day.Format("2006-01-02"),
+	}
+	rows, err := db.Query(fmt.Sprintf("SELECT %s FROM dock_status_wide WHERE ts >= $1 AND ts < $2 ORDER BY ts, station_id",
+		strings.Join(dockStatusColumns, ", ")), day, day.AddDate(0, 0, 1))
+	if err != nil {
+		return f, err
+	}
+	defer rows.Close()
+
+	path := filepath.Join(dest, f.File)
+	out, err := os.Create(path + ".tmp")
+	if err != nil {
+		return f, err
+	}
+	defer os.Remove(path + ".tmp")
+	sum := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(out, sum)}
+
+	values := make([]sql.NullString, len(dockStatusColumns))
+	scanArgs := make([]interface{}, len(values))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+	f.Rows, err = writeArchiveCSV(counter, dockStatusColumns, func() ([]string, error) {
+		if !rows.Next() {
+			return nil, rows.Err()
+		}
+		if err := rows.Scan(scanArgs...); err != nil {
+			return nil, err
+		}
+		record := make([]string, len(values))
+		for i, v := range values {
+			record[i] = v.String // NULL archives as empty
+		}
+		return record, nil
+	})
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return f, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return f, err
+	}
+	f.Bytes = counter.n
+	f.SHA256 = hex.EncodeToString(sum.Sum(nil))
+	f.ArchivedAt = time.Now().UTC()
+	return f, nil
+}
+
+// writeArchiveCSV writes a gzipped CSV (header first) of the records next returns until
+// it returns nil, and reports how many records it wrote.
+func writeArchiveCSV(w io.Writer, header []string, next func() ([]string, error)) (int64, error) {
+	gz := gzip.NewWriter(w)
+	cw := csv.NewWriter(gz)
+	if err := cw.Write(header); err != nil {
+		return 0, err
+	}
+	var n int64
+	for {
+		record, err := next()
+		if err != nil {
+			return n, err
+		}
+		if record == nil {
+			break
+		}
+		if err := cw.Write(record); err != nil {
+			return n, err
+		}
+		n++
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return n, err
+	}
+	return n, gz.Close()
+}
+
+// ReadArchiveCSV calls fn with the header-keyed fields of every row in an archived
+// dock_status file.
+func ReadArchiveCSV(r io.Reader, fn func(row map[string]string) error) (int64, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+	cr := csv.NewReader(gz)
+	header, err := cr.Read()
+	if err != nil {
+		return 0, fmt.Errorf("read header: %w", err)
+	}
+	var n int64
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		row := make(map[string]string, len(header))
+		for i, col := range header {
+			if i < len(record) {
+				row[col] = record[i]
+			}
+		}
+		if err := fn(row); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// VerifyArchiveFile re-reads an archived day and checks its checksum, size and row
+// count against the manifest entry.
+func VerifyArchiveFile(dir string, f ArchiveFile) error {
+	in, err := os.Open(filepath.Join(dir, f.File))
+	if err != nil {
+		return fmt.Errorf("verify %s: %w", f.File, err)
+	}
+	defer in.Close()
+	sum := sha256.New()
+	counter := &countingWriter{w: sum}
+	rows, err := ReadArchiveCSV(io.TeeReader(in, counter), func(map[string]string) error { return nil })
+	if err != nil {
+		return fmt.Errorf("verify %s: %w", f.File, err)
+	}
+	// drain anything after the gzip stream so the checksum covers the whole file
+	if _, err := io.Copy(counter, in); err != nil {
+		return fmt.Errorf("verify %s: %w", f.File, err)
+	}
+	switch {
+	case rows != f.Rows:
+		return fmt.Errorf("verify %s: %d rows, manifest says %d", f.File, rows, f.Rows)
+	case counter.n != f.Bytes:
+		return fmt.Errorf("verify %s: %d bytes, manifest says %d", f.File, counter.n, f.Bytes)
+	case hex.EncodeToString(sum.Sum(nil)) != f.SHA256:
+		return fmt.Errorf("verify %s: checksum mismatch", f.File)
+	}
+	return nil
+}
+
+// dropArchived removes the archived rows: whole chunks or partitions where possible,
+// one day at a time otherwise.
+func dropArchived(db *sql.DB, plan ArchivePlan) error {
+	switch plan.Storage {
+	case StorageTimescale:
+		if _, err := db.Exec("SELECT drop_chunks('dock_status', older_than => $1::timestamptz)", plan.Cutoff); err != nil {
+			return fmt.Errorf("drop_chunks: %w", err)
+		}
+		slog.Info("archive: dropped chunks", "chunks", len(plan.Drop), "before", plan.Cutoff.Format(time.RFC3339))
+	case StoragePartitioned:
+		for _, name := range plan.Drop {
+			if err := dropPartition(db, name); err != nil {
+				return err
+			}
+			slog.Info("archive: dropped partition", "partition", name)
+		}
+	default:
+		for _, day := range plan.Days {
+			res, err := db.Exec("DELETE FROM dock_status WHERE ts >= $1 AND ts < $2", day.Day, day.Day.AddDate(0, 0, 1))
+			if err != nil {
+				return fmt.Errorf("delete %s: %w", day.Day.Format("2006-01-02"), err)
+			}
+			n, _ := res.RowsAffected()
+			slog.Info("archive: deleted rows", "rows", n, "day", day.Day.Format("2006-01-02"))
+		}
+	}
+	return nil
+}
+
+// ReadArchiveManifest reads dir's manifest; a missing manifest is an empty one.
+func ReadArchiveManifest(dir string) (ArchiveManifest, error) {
+	m := ArchiveManifest{Table: "dock_status", Columns: dockStatusColumns}
+	raw, err := os.ReadFile(filepath.Join(dir, ArchiveManifestName))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return m, fmt.Errorf("%s: %w", ArchiveManifestName, err)
+	}
+	return m, nil
+}
+
+func writeArchiveManifest(dir string, m ArchiveManifest) error {
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Day < m.Files[j].Day })
+	raw, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, ArchiveManifestName)
+	if err := os.WriteFile(path+".tmp", append(raw, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// put adds f, replacing an earlier archive of the same day.
+func (m *ArchiveManifest) put(f ArchiveFile) {
+	for i := range m.Files {
+		if m.Files[i].Day == f.Day {
+			m.Files[i] = f
+			return
+		}
+	}
+	m.Files = append(m.Files, f)
+}
+
+func (m ArchiveManifest) file(day time.Time) (ArchiveFile, bool) {
+	for _, f := range m.Files {
+		if f.Day == day.Format("2006-01-02") {
+			return f, true
+		}
+	}
+	return ArchiveFile{}, false
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,237 @@
+package client
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/logging"
+	"github.com/kardolus/citi-bike-dock-tracker/metrics"
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+	"github.com/lib/pq"
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+// insertRowsPerStatement caps a multi-row INSERT well under Postgres' 65535 bind
+// parameter limit (17 columns × 1000 rows).
+const insertRowsPerStatement = 1000
+
+var dockStatusColumns = []string{
+	"station_id", "name", "longitude", "latitude", "bikes_available", "ebikes_available", "bikes_disabled",
+	"docks_available", "docks_disabled", "scooters_available", "scooters_unavailable",
+	"is_returning", "is_renting", "is_installed", "neighborhood", "ts", "city_id",
+}
+
+// dockStatusNeighborhood and dockStatusTS are the indexes of neighborhood and ts in
+// dockStatusColumns.
+const (
+	dockStatusNeighborhood = 14
+	dockStatusTS           = 15
+)
+
+func dockStatusRow(d types.NormalizedStationDataTS) []interface{} {
+	s := d.Station
+	return []interface{}{s.ID, s.Name, s.Longitude, s.Latitude, s.BikesAvailable,
+		s.EBikesAvailable, s.BikesDisabled, s.DocksAvailable, s.DocksDisabled,
+		s.ScootersAvailable, s.ScootersUnavailable, s.IsReturning, s.IsRenting,
+		s.IsInstalled, nullable(s.Neighborhood), d.TimeStamp, nil}
+}
+
+// narrowStatusRow is dockStatusRow without the descriptive columns, which live in the
+// stations dimension instead (read them back through dock_status_wide).
+func narrowStatusRow(d types.NormalizedStationDataTS) []interface{} {
+	s := d.Station
+	return []interface{}{s.ID, nil, nil, nil, s.BikesAvailable,
+		s.EBikesAvailable, s.BikesDisabled, s.DocksAvailable, s.DocksDisabled,
+		s.ScootersAvailable, s.ScootersUnavailable, s.IsReturning, s.IsRenting,
+		s.IsInstalled, nil, d.TimeStamp, nil}
+}
+
+// insertBatch writes one poll to dock_status with a single COPY — one round trip
+// instead of one per station. Some poolers and proxies (pgbouncer in transaction mode,
+// a few managed offerings) reject COPY; when COPY fails the batch is written with a
+// multi-row INSERT instead, and if the failure says COPY itself is refused (see
+// isCopyUnsupported) the client sticks to INSERTs from then on. Any other failure is
+// taken as transient, and the next batch tries COPY again. With the (station_id, ts)
+// unique key in place (see Dedupe), rows already in dock_status are skipped rather
+// than failing the batch: the INSERTs say ON CONFLICT DO NOTHING, and COPY goes
+// through a staging table. The write time lands in metrics.DBWriteSeconds either way.
+func (c *Client) insertBatch(db *sql.DB, data []types.NormalizedStationDataTS) error {
+	if len(data) == 0 {
+		return nil
+	}
+	start := time.Now()
+	defer func() { metrics.DBWriteSeconds.ObserveDuration(time.Since(start)) }()
+
+	row := dockStatusRow
+	if c.narrowFacts {
+		row = narrowStatusRow
+	}
+	if c.tenant != "" {
+		base := row
+		row = func(d types.NormalizedStationDataTS) []interface{} {
+			r := base(d)
+			r[len(r)-1] = c.tenant // city_id
+			return r
+		}
+	}
+
+	if !c.copyUnsupported {
+		copyErr := c.copyDockStatus(db, data, row)
+		if copyErr == nil {
+			return nil
+		}
+		if isUniqueViolation(copyErr) && !c.uniqueKey {
+			// the unique key was added while we were running
+			c.uniqueKey = true
+			slog.Info("dock_status has a (station_id, ts) unique key; skipping rows already written")
+			if copyErr = c.copyDockStatus(db, data, row); copyErr == nil {
+				return nil
+			}
+		}
+		if err := insertRows(db, "dock_status", dockStatusColumns, data, row); err != nil {
+			return err
+		}
+		if !isCopyUnsupported(copyErr) {
+			slog.Warn("COPY into dock_status failed; wrote the batch with INSERTs", logging.Error(copyErr, "db"))
+			return nil
+		}
+		c.copyUnsupported = true
+		slog.Warn("COPY into dock_status is not supported; falling back to multi-row INSERTs", logging.Error(copyErr, "db"))
+		return nil
+	}
+	return insertRows(db, "dock_status", dockStatusColumns, data, row)
+}
+
+func (c *Client) copyDockStatus(db *sql.DB, data []types.NormalizedStationDataTS,
+	row func(types.NormalizedStationDataTS) []interface{}) error {
+	if c.uniqueKey {
+		return copyRowsIgnoringConflicts(db, "dock_status", dockStatusColumns, data, row)
+	}
+	return copyRows(db, "dock_status", dockStatusColumns, data, row)
+}
+
+// copyRows streams data into table with COPY FROM STDIN inside one transaction.
+func copyRows(db *sql.DB, table string, cols []string, data []types.NormalizedStationDataTS,
+	row func(types.NormalizedStationDataTS) []interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := copyIn(tx, table, cols, data, row); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// copyRowsIgnoringConflicts is copyRows for a table with a unique key: COPY can't skip
+// conflicting rows, so it copies into a temporary staging table and inserts from there
+// with ON CONFLICT DO NOTHING, still in one transaction.
+func copyRowsIgnoringConflicts(db *sql.DB, table string, cols []string, data []types.NormalizedStationDataTS,
+	row func(types.NormalizedStationDataTS) []interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	staging := table + "_staging"
+	if _, err := tx.Exec(fmt.Sprintf("CREATE TEMP TABLE %s (LIKE %s) ON COMMIT DROP", staging, table)); err != nil {
+		return err
+	}
+	if err := copyIn(tx, staging, cols, data, row); err != nil {
+		return err
+	}
+	list := strings.Join(cols, ",")
+	if _, err := tx.Exec(fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s ON CONFLICT DO NOTHING",
+		table, list, list, staging)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func copyIn(tx *sql.Tx, table string, cols []string, data []types.NormalizedStationDataTS,
+	row func(types.NormalizedStationDataTS) []interface{}) error {
+	stmt, err := tx.Prepare(pq.CopyIn(table, cols...))
+	if err != nil {
+		return err
+	}
+	for _, d := range data {
+		if _, err := stmt.Exec(row(d)...); err != nil {
+			_ = stmt.Close()
+			return err
+		}
+	}
+	if _, err := stmt.Exec(); err != nil { // flush
+		_ = stmt.Close()
+		return err
+	}
+	return stmt.Close()
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// isCopyUnsupported reports whether a COPY failure means COPY itself is refused: the
+// server or a pooler doesn't support it (feature_not_supported, or a pooler's
+// protocol_violation), or the role may not use it (insufficient_privilege).
+func isCopyUnsupported(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	switch pqErr.Code {
+	case "0A000", "42501", "08P01":
+		return true
+	}
+	return false
+}
+
+// insertRows writes data with multi-row INSERTs of up to insertRowsPerStatement rows,
+// all inside one transaction. Rows that hit a unique key are skipped.
+func insertRows(db *sql.DB, table string, cols []string, data []types.NormalizedStationDataTS,
+	row func(types.NormalizedStationDataTS) []interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for lo := 0; lo < len(data); lo += insertRowsPerStatement {
+		hi := lo + insertRowsPerStatement
+		if hi > len(data) {
+			hi = len(data)
+		}
+		query, args := multiRowInsert(table, cols, data[lo:hi], row)
+		if _, err := tx.Exec(query, args...); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func multiRowInsert(table string, cols []string, data []types.NormalizedStationDataTS,
+	row func(types.NormalizedStationDataTS) []interface{}) (string, []interface{}) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "INSERT INTO %s (%s) VALUES ", table, strings.Join(cols, ","))
+	args := make([]interface{}, 0, len(data)*len(cols))
+	for i, d := range data {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('(')
+		for j := range cols {
+			if j > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "$%d", len(args)+j+1)
+		}
+		b.WriteByte(')')
+		args = append(args, row(d)...)
+	}
+	b.WriteString(" ON CONFLICT DO NOTHING")
+	return b.String(), args
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+	"github.com/lib/pq"
+)
+
+// TestMultiRowInsert checks the fallback INSERT numbers its placeholders across rows
+// and skips rows that hit a unique key.
+func TestMultiRowInsert(t *testing.T) {
+	data := []types.NormalizedStationDataTS{{}, {}}
+	query, args := multiRowInsert("dock_status", []string{"a", "b"}, data,
+		func(types.NormalizedStationDataTS) []interface{} { return []interface{}{1, 2} })
+	if want := "INSERT INTO dock_status (a,b) VALUES ($1,$2),($3,$4) ON CONFLICT DO NOTHING"; query != want {
+		t.Errorf("query: got %q, want %q", query, want)
+	}
+	if len(args) != 4 {
+		t.Errorf("args: got %d, want 4", len(args))
+	}
+}
+
+// TestIsCopyUnsupported checks that only errors refusing COPY itself stop the client
+// from trying it again.
+func TestIsCopyUnsupported(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&pq.Error{Code: "0A000"}, true},
+		{fmt.Errorf("copy: %w", &pq.Error{Code: "42501"}), true},
+		{&pq.Error{Code: "08P01"}, true},
+		{&pq.Error{Code: "57014"}, false}, // statement timeout
+		{&pq.Error{Code: "22P02"}, false},
+		{errors.New("read tcp: connection reset by peer"), false},
+	} {
+		if got := isCopyUnsupported(tc.err); got != tc.want {
+			t.Errorf("%v: got %t, want %t", tc.err, got, tc.want)
+		}
+	}
+}
+
+// BenchmarkInsertBatch compares the old one-prepared-INSERT-per-station write with the
+// multi-row INSERT fallback and COPY, on an NYC-sized poll (2,000 stations). It needs a
+// throwaway database — it migrates it and truncates dock_status there:
+//
+//	DOCKSCAN_BENCH_DSN=postgres://localhost/dockscan_bench?sslmode=disable \
+//	    go test ./client -run '^$' -bench InsertBatch
+func BenchmarkInsertBatch(b *testing.B) {
+	dsn := os.Getenv("DOCKSCAN_BENCH_DSN")
+	if dsn == "" {
+		b.Skip("DOCKSCAN_BENCH_DSN not set")
+	}
+	// the full schema: dock_status gains columns (city_id) in later migrations
+	if _, err := Migrate(dsn, 0); err != nil {
+		b.Fatal(err)
+	}
+	db, err := openPostgres(dsn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	data := make([]types.NormalizedStationDataTS, 2000)
+	for i := range data {
+		data[i] = types.NormalizedStationDataTS{
+			Station: types.NormalizedStation{
+				ID: fmt.Sprintf("station-%04d", i), Name: "Bench St & Test Ave", Latitude: 40.7, Longitude: -74,
+				BikesAvailable: i % 30, EBikesAvailable: i % 5, DocksAvailable: 30 - i%30,
+				IsRenting: true, IsReturning: true, IsInstalled: true, Neighborhood: "red-hook",
+			},
+			TimeStamp: now,
+		}
+	}
+
+	run := func(name string, write func() error) {
+		b.Run(name, func(b *testing.B) {
+			if _, err := db.Exec("TRUNCATE dock_status"); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := write(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+	run("prepared-per-row", func() error { return insertPerRow(db, data) })
+	run("multi-row-insert", func() error {
+		return insertRows(db, "dock_status", dockStatusColumns, data, dockStatusRow)
+	})
+	run("copy", func() error {
+		return copyRows(db, "dock_status", dockStatusColumns, data, dockStatusRow)
+	})
+}
+
+// insertPerRow is the pre-COPY write path, kept here as the benchmark baseline.
+func insertPerRow(db *sql.DB, data []types.NormalizedStationDataTS) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	placeholders := make([]string, len(dockStatusColumns))
+	for i := range placeholders {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	stmt, err := tx.Prepare("INSERT INTO dock_status (" + strings.Join(dockStatusColumns, ",") +
+		") VALUES (" + strings.Join(placeholders, ",") + ")")
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, d := range data {
+		if _, err := stmt.Exec(dockStatusRow(d)...); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+)
+
+// changeTracker backs --changes-only: it remembers the last NormalizedStation seen per
+// station ID and passes through only the stations whose counts or flags moved since
+// the previous poll, annotated with the previous values and a human-readable delta.
+// Every keyframeInterval it lets a full snapshot through (Keyframe=true) so a consumer
+// that joined late, or dropped a line, can resync without replaying the whole stream.
+type changeTracker struct {
+	previous         map[string]types.NormalizedStation
+	keyframeInterval time.Duration
+	lastKeyframe     time.Time
+}
+
+func newChangeTracker(keyframeInterval time.Duration) *changeTracker {
+	return &changeTracker{
+		previous:         make(map[string]types.NormalizedStation),
+		keyframeInterval: keyframeInterval,
+	}
+}
+
+// filter reduces one poll to its changed stations (or the whole poll on a keyframe)
+// and records the poll as the new baseline. The first poll is always a keyframe.
+func (t *changeTracker) filter(data []types.NormalizedStationDataTS) []types.NormalizedStationDataTS {
+	if len(data) == 0 {
+		return nil
+	}
+	now := data[0].TimeStamp
+	keyframe := t.lastKeyframe.IsZero() ||
+		(t.keyframeInterval > 0 && now.Sub(t.lastKeyframe) >= t.keyframeInterval)
+	if keyframe {
+		t.lastKeyframe = now
+	}
+
+	var out []types.NormalizedStationDataTS
+	for _, d := range data {
+		prev, seen := t.previous[d.Station.ID]
+		t.previous[d.Station.ID] = d.Station
+		delta := ""
+		if seen {
+			delta = stationDelta(prev, d.Station)
+		}
+		if !keyframe && seen && delta == "" {
+			continue // unchanged since the last poll
+		}
+		d.Keyframe = keyframe
+		d.Delta = delta
+		if seen && delta != "" {
+			p := prev
+			d.Previous = &p
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+// stationDelta describes what moved between two observations of the same station, e.g.
+// "bikes -2, ebikes +1, renting off". Empty when nothing tracked changed (name/position
+// changes are station_information churn, not status, and are ignored).
+func stationDelta(prev, cur types.NormalizedStation) string {
+	var parts []string
+	count := func(label string, a, b int) {
+		if a != b {
+			parts = append(parts, fmt.Sprintf("%s %+d", label, b-a))
+		}
+	}
+	flag := func(label string, a, b bool) {
+		if a != b {
+			state := "off"
+			if b {
+				state = "on"
+			}
+			parts = append(parts, label+" "+state)
+		}
+	}
+	count("bikes", prev.BikesAvailable, cur.BikesAvailable)
+	count("ebikes", prev.EBikesAvailable, cur.EBikesAvailable)
+	count("bikes_disabled", prev.BikesDisabled, cur.BikesDisabled)
+	count("docks", prev.DocksAvailable, cur.DocksAvailable)
+	count("docks_disabled", prev.DocksDisabled, cur.DocksDisabled)
+	count("scooters", prev.ScootersAvailable, cur.ScootersAvailable)
+	count("scooters_unavailable", prev.ScootersUnavailable, cur.ScootersUnavailable)
+	flag("returning", prev.IsReturning, cur.IsReturning)
+	flag("renting", prev.IsRenting, cur.IsRenting)
+	flag("installed", prev.IsInstalled, cur.IsInstalled)
+	return strings.Join(parts, ", ")
+}
+
+// applyChangesOnly is the single hook every output loop calls after a poll: a no-op
+// unless --changes-only is on.
+func (c *Client) applyChangesOnly(data []types.NormalizedStationDataTS) []types.NormalizedStationDataTS {
+	if c.changes == nil {
+		return data
+	}
+	return c.changes.filter(data)
+}
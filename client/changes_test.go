@@ -0,0 +1,53 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+)
+
+// TestChangeTracker covers --changes-only: the first poll is a full keyframe, an
+// unchanged station is suppressed, a changed one carries its previous values and a
+// delta, and a full keyframe comes through again once the keyframe interval elapses.
+func TestChangeTracker(t *testing.T) {
+	t0 := time.Date(2026, 6, 1, 8, 0, 0, 0, time.UTC)
+	poll := func(ts time.Time, stations ...types.NormalizedStation) []types.NormalizedStationDataTS {
+		var out []types.NormalizedStationDataTS
+		for _, s := range stations {
+			out = append(out, types.NormalizedStationDataTS{Station: s, TimeStamp: ts})
+		}
+		return out
+	}
+	a := types.NormalizedStation{ID: "a", BikesAvailable: 5, EBikesAvailable: 1, DocksAvailable: 10, IsRenting: true}
+	b := types.NormalizedStation{ID: "b", BikesAvailable: 3, DocksAvailable: 7, IsRenting: true}
+
+	tr := newChangeTracker(time.Hour)
+
+	first := tr.filter(poll(t0, a, b))
+	if len(first) != 2 || !first[0].Keyframe || first[0].Previous != nil || first[0].Delta != "" {
+		t.Fatalf("first poll should be a full keyframe without deltas: %+v", first)
+	}
+
+	a2 := a
+	a2.BikesAvailable, a2.EBikesAvailable, a2.DocksAvailable, a2.IsRenting = 3, 2, 12, false
+	second := tr.filter(poll(t0.Add(time.Minute), a2, b))
+	if len(second) != 1 || second[0].Station.ID != "a" || second[0].Keyframe {
+		t.Fatalf("second poll should only carry station a: %+v", second)
+	}
+	if got, want := second[0].Delta, "bikes -2, ebikes +1, docks +2, renting off"; got != want {
+		t.Errorf("delta: got %q, want %q", got, want)
+	}
+	if second[0].Previous == nil || second[0].Previous.BikesAvailable != 5 {
+		t.Errorf("previous values missing: %+v", second[0].Previous)
+	}
+
+	if quiet := tr.filter(poll(t0.Add(2*time.Minute), a2, b)); len(quiet) != 0 {
+		t.Errorf("unchanged poll should emit nothing, got %d rows", len(quiet))
+	}
+
+	resync := tr.filter(poll(t0.Add(time.Hour), a2, b))
+	if len(resync) != 2 || !resync[0].Keyframe || !resync[1].Keyframe {
+		t.Errorf("keyframe interval elapsed: want full snapshot, got %+v", resync)
+	}
+}
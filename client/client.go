@@ -7,9 +7,10 @@ import (
 	"errors"
 	"fmt"
 	"github.com/kardolus/citi-bike-dock-tracker/http"
+	"github.com/kardolus/citi-bike-dock-tracker/logging"
 	"github.com/kardolus/citi-bike-dock-tracker/metrics"
 	"github.com/kardolus/citi-bike-dock-tracker/types"
-	"log"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -17,6 +18,7 @@ import (
 	"time"
 
 	_ "github.com/lib/pq"
+	slog "github.com/sagikazarmark/slog-shim"
 )
 
 // BBox is a geographic bounding box used to filter stations by location.
@@ -28,6 +30,23 @@ func (b BBox) contains(lat, lon float64) bool {
 	return lat >= b.MinLat && lat <= b.MaxLat && lon >= b.MinLon && lon <= b.MaxLon
 }
 
+// ParseBBox parses "minLat,minLon,maxLat,maxLon", the form --bbox and the HTTP APIs take.
+func ParseBBox(s string) (BBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return BBox{}, errors.New("bbox must be minLat,minLon,maxLat,maxLon")
+	}
+	var f [4]float64
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return BBox{}, fmt.Errorf("bbox parse error: %w", err)
+		}
+		f[i] = v
+	}
+	return BBox{MinLat: f[0], MinLon: f[1], MaxLat: f[2], MaxLon: f[3]}, nil
+}
+
 const (
 	DefaultInterval        = 60 // in seconds
 	DefaultServiceURL      = "https://gbfs.citibikenyc.com"
@@ -52,17 +71,46 @@ func (RealTime) Now() time.Time {
 var _ TimeProvider = &RealTime{}
 
 type Client struct {
-	caller          http.Caller
-	stationMap      map[string]types.StationEntity
-	neighborhood    map[string]string // station_id -> neighborhood slug (empty when not in neighborhood mode)
-	electricTypes   map[string]bool   // PBSC e-bike vehicle_type_ids (empty for every other operator)
-	timeProvider    TimeProvider
-	interval        int
-	serviceURL      string
-	statusURL       string // full station_status URL; overrides serviceURL+path when set
-	feedFormat      string // "gbfs" (default) or "tfl" (London BikePoint, non-GBFS)
-	currentDate     time.Time
-	outputDirectory string
+	caller           http.Caller
+	stationMap       map[string]types.StationEntity
+	neighborhood     map[string]string // station_id -> neighborhood slug (empty when not in neighborhood mode)
+	electricTypes    map[string]bool   // PBSC e-bike vehicle_type_ids (empty for every other operator)
+	timeProvider     TimeProvider
+	interval         int
+	serviceURL       string
+	statusURL        string // full station_status URL; overrides serviceURL+path when set
+	feedFormat       string // "gbfs" (default) or "tfl" (London BikePoint, non-GBFS)
+	currentDate      time.Time
+	outputDirectory  string
+	changes          *changeTracker // non-nil in --changes-only mode
+	flows            *FlowInferrer  // non-nil when the ingester also writes station_flows
+	filter           stationFilter  // re-applied when station_information is refreshed
+	infoURL          string         // full station_information URL; overrides serviceURL+path when set
+	narrowFacts      bool           // write only station_id + counts + ts; see syncStations
+	lastInfoSync     time.Time
+	spool            *Spool    // failed dock_status batches wait here; nil = no spooling
+	lastFeedUpdate   time.Time // station_status last_updated from the latest fetch
+	partitioned      bool      // dock_status is natively partitioned (plain Postgres); see partitions.go
+	lastPartitionRun time.Time
+	rollups          string // rollupsContinuous or rollupsTables once set up; see rollups.go
+	lastRollupRun    time.Time
+	rollupsBehind    bool              // the last rollup run hit rollupBatch; run again next poll
+	leader           bool              // holds the leader lock; standbys poll without writing
+	storageReady     bool              // becomeLeader has run the storage setup
+	pendingPolls     []PollRecord      // poll_log entries not yet written; see logPoll
+	refs             map[string]string // trip-file station id (short_name/legacy_id) -> station_id; see stationRefs
+	copyUnsupported  bool              // set once COPY has been refused outright; see insertBatch
+	uniqueKey        bool              // dock_status has the (station_id, ts) unique key; see Dedupe
+	tenant           string            // CITY_ID when writing into a shared database; see tenancy.go
+	stream           *EventStream      // every poll is published here when set; see stream.go
+	exporter         *stationExporter  // per-station gauges on /metrics; nil = off
+	vehicleTypesURL  string            // reported in /status; the types are read once at build
+	mode             string            // the poll loop's output, for /status; see reportConfig
+	outages          *OutageDetector   // non-nil when outage episodes are tracked; see outages.go
+	outageFile       io.Writer         // outage events as JSON Lines; nil = none
+	pendingOutages   []types.StationOutage
+	alerts           *AlertEngine   // non-nil when alert rules are evaluated; see alerts.go
+	notifier         *AlertNotifier // delivers what alerts raises
 }
 
 type ClientBuilder struct {
@@ -79,6 +127,20 @@ type ClientBuilder struct {
 	bbox            *BBox
 	neighborhoods   []Neighborhood
 	outputDirectory string
+	changesOnly     bool
+	keyframeEvery   time.Duration
+	inferFlows      bool
+	rebalanceAt     int
+	narrowFacts     bool
+	spoolDir        string
+	spoolMaxBytes   int64
+	stream          *EventStream
+	stationMetrics  bool
+	trackedMetrics  bool
+	detectOutages   bool
+	outagePath      string
+	alertConfig     *AlertConfig
+	alertAreas      []Neighborhood
 }
 
 func NewClientBuilder() *ClientBuilder {
@@ -133,6 +195,75 @@ func (b *ClientBuilder) WithOutputDirectory(dir string) *ClientBuilder {
 	return b
 }
 
+// WithChangesOnly makes every output (JSONL, CSV, Postgres) emit only the stations whose
+// counts or flags changed since the previous poll, plus a full keyframe every
+// keyframeEvery (zero = only the first poll) so downstream consumers can resync.
+func (b *ClientBuilder) WithChangesOnly(keyframeEvery time.Duration) *ClientBuilder {
+	b.changesOnly = true
+	b.keyframeEvery = keyframeEvery
+	return b
+}
+
+// WithFlowInference makes IngestPostgres also infer hourly rentals/returns per station
+// (see FlowInferrer) and upsert each completed hour into station_flows. A
+// rebalanceThreshold of zero uses DefaultRebalanceThreshold.
+func (b *ClientBuilder) WithFlowInference(rebalanceThreshold int) *ClientBuilder {
+	b.inferFlows = true
+	b.rebalanceAt = rebalanceThreshold
+	return b
+}
+
+// WithOutageDetection tracks empty, full, no-e-bike and not-renting episodes per station
+// (see OutageDetector). Every output mode appends their events to eventsPath as JSON
+// Lines when it's set; IngestPostgres also writes them to station_outages.
+func (b *ClientBuilder) WithOutageDetection(eventsPath string) *ClientBuilder {
+	b.detectOutages = true
+	b.outagePath = eventsPath
+	return b
+}
+
+// WithAlerts evaluates cfg's alert rules on every poll and delivers what they raise
+// (see AlertEngine). ns places stations in neighborhoods and areas for the rules that
+// target them.
+func (b *ClientBuilder) WithAlerts(cfg *AlertConfig, ns []Neighborhood) *ClientBuilder {
+	b.alertConfig = cfg
+	b.alertAreas = ns
+	return b
+}
+
+// WithNarrowFacts makes IngestPostgres write only station_id, the counts and ts to
+// dock_status, leaving name, position and neighborhood to the stations dimension.
+// Readers see the old wide shape through the dock_status_wide view.
+func (b *ClientBuilder) WithNarrowFacts() *ClientBuilder {
+	b.narrowFacts = true
+	return b
+}
+
+// WithSpool makes IngestPostgres spool batches it can't write to a write-ahead spool in
+// dir (bounded to maxBytes; zero = DefaultSpoolMaxBytes) and replay them, in order,
+// once Postgres is reachable again.
+func (b *ClientBuilder) WithSpool(dir string, maxBytes int64) *ClientBuilder {
+	b.spoolDir = dir
+	b.spoolMaxBytes = maxBytes
+	return b
+}
+
+// WithEventStream makes every output mode publish each poll to stream (see
+// EventStream), for serving as server-sent events.
+func (b *ClientBuilder) WithEventStream(stream *EventStream) *ClientBuilder {
+	b.stream = stream
+	return b
+}
+
+// WithStationMetrics makes every poll update the per-station and per-neighborhood
+// gauges on /metrics (see metrics.EnableStationGauges). They cover every station in
+// the feed unless trackedOnly restricts them to the filtered stations.
+func (b *ClientBuilder) WithStationMetrics(trackedOnly bool) *ClientBuilder {
+	b.stationMetrics = true
+	b.trackedMetrics = trackedOnly
+	return b
+}
+
 // WithServiceURL overwrites the default service URL (base; combined with the
 // default station_information/station_status paths).
 func (b *ClientBuilder) WithServiceURL(url string) *ClientBuilder {
@@ -187,32 +318,76 @@ func (b *ClientBuilder) Build() (*Client, error) {
 	var electricTypes map[string]bool
 	if b.vehicleTypesURL != "" {
 		if vt, err := b.getVehicleTypes(); err != nil {
-			log.Printf("vehicle_types fetch failed (non-fatal, no e-bike split): %v", err)
+			slog.Warn("vehicle_types fetch failed (non-fatal, no e-bike split)", errorAttrs(err, "fetch")...)
 		} else {
 			electricTypes = vt.ElectricBicycleTypes()
-			log.Printf("vehicle_types: %d e-bike vehicle_type_ids", len(electricTypes))
+			slog.Info("vehicle_types: e-bike vehicle types", "count", len(electricTypes))
 		}
 	}
 
-	neighborhood := make(map[string]string)
-	for _, station := range stationInfo.Data.Stations {
-		// include unless an ID filter, bbox, or neighborhood set excludes it
-		if len(b.filteredIDs) > 0 {
-			if _, ok := b.filteredIDs[station.StationID]; !ok {
-				continue
-			}
+	filter := stationFilter{ids: b.filteredIDs, bbox: b.bbox, neighborhoods: b.neighborhoods}
+	tracked, neighborhood := filter.apply(stationInfo.Data.Stations)
+	for id, station := range tracked {
+		b.stationMap[id] = station
+	}
+
+	var exporter *stationExporter
+	if b.stationMetrics {
+		exporter = newStationExporter(!b.trackedMetrics, b.neighborhoods)
+		exporter.setStations(stationInfo.Data.Stations)
+	}
+
+	var spool *Spool
+	if b.spoolDir != "" {
+		if spool, err = OpenSpool(b.spoolDir, b.spoolMaxBytes); err != nil {
+			return nil, err
 		}
-		if b.bbox != nil && !b.bbox.contains(station.Lat, station.Lon) {
-			continue
+	}
+
+	var changes *changeTracker
+	if b.changesOnly {
+		changes = newChangeTracker(b.keyframeEvery)
+	}
+	var flows *FlowInferrer
+	if b.inferFlows {
+		// tolerate a couple of missed polls before treating a pair as a gap
+		maxGap := 3 * time.Duration(b.interval) * time.Second
+		if maxGap < DefaultFlowMaxGap {
+			maxGap = DefaultFlowMaxGap
 		}
-		if len(b.neighborhoods) > 0 {
-			slug := assignNeighborhood(b.neighborhoods, station.Lat, station.Lon)
-			if slug == "" {
-				continue // not in any curated neighborhood
+		flows = NewFlowInferrer(b.rebalanceAt, maxGap)
+	}
+	var outages *OutageDetector
+	var outageFile io.Writer
+	if b.detectOutages {
+		// as for flows: a couple of missed polls don't end an episode
+		maxGap := 3 * time.Duration(b.interval) * time.Second
+		if maxGap < DefaultOutageMaxGap {
+			maxGap = DefaultOutageMaxGap
+		}
+		outages = NewOutageDetector(maxGap)
+		if b.outagePath != "" {
+			f, err := openOutageFile(b.outagePath)
+			if err != nil {
+				return nil, err
 			}
-			neighborhood[station.StationID] = slug
+			outageFile = f
+		}
+	}
+	var alerts *AlertEngine
+	var notifier *AlertNotifier
+	if b.alertConfig != nil {
+		// as for flows: a couple of missed polls don't restart a rule's minimum duration
+		maxGap := 3 * time.Duration(b.interval) * time.Second
+		if maxGap < DefaultAlertMaxGap {
+			maxGap = DefaultAlertMaxGap
+		}
+		var err error
+		if alerts, err = NewAlertEngine(b.alertConfig, b.alertAreas, maxGap); err != nil {
+			return nil, err
 		}
-		b.stationMap[station.StationID] = station
+		notifier = NewAlertNotifier(b.alertConfig)
+		notifier.start()
 	}
 
 	return &Client{
@@ -227,41 +402,93 @@ func (b *ClientBuilder) Build() (*Client, error) {
 		feedFormat:      b.feedFormat,
 		currentDate:     startOfDay(b.timeProvider.Now()),
 		outputDirectory: b.outputDirectory,
+		changes:         changes,
+		flows:           flows,
+		filter:          filter,
+		infoURL:         b.infoURL,
+		narrowFacts:     b.narrowFacts,
+		spool:           spool,
+		stream:          b.stream,
+		exporter:        exporter,
+		vehicleTypesURL: b.vehicleTypesURL,
+		outages:         outages,
+		outageFile:      outageFile,
+		alerts:          alerts,
+		notifier:        notifier,
 	}, nil
 }
 
+// stationFilter decides which feed stations are tracked: an ID filter, a bbox, or a
+// neighborhood set (which also tags each station with its slug).
+type stationFilter struct {
+	ids           map[string]bool
+	bbox          *BBox
+	neighborhoods []Neighborhood
+}
+
+// apply returns the tracked subset of stations and, in neighborhood mode, each
+// tracked station's slug.
+func (f stationFilter) apply(stations []types.StationEntity) (map[string]types.StationEntity, map[string]string) {
+	tracked := make(map[string]types.StationEntity)
+	neighborhood := make(map[string]string)
+	for _, station := range stations {
+		// include unless an ID filter, bbox, or neighborhood set excludes it
+		if len(f.ids) > 0 {
+			if _, ok := f.ids[station.StationID]; !ok {
+				continue
+			}
+		}
+		if f.bbox != nil && !f.bbox.contains(station.Lat, station.Lon) {
+			continue
+		}
+		if len(f.neighborhoods) > 0 {
+			slug := assignNeighborhood(f.neighborhoods, station.Lat, station.Lon)
+			if slug == "" {
+				continue // not in any curated neighborhood
+			}
+			neighborhood[station.StationID] = slug
+		}
+		tracked[station.StationID] = station
+	}
+	return tracked, neighborhood
+}
+
 func (b *ClientBuilder) getStationInformation() (types.StationInformation, error) {
-	url := b.infoURL
+	return fetchStationInformation(b.caller, b.infoURL, b.serviceURL, b.feedFormat)
+}
+
+func fetchStationInformation(caller http.Caller, infoURL, serviceURL, feedFormat string) (types.StationInformation, error) {
+	url := infoURL
 	if url == "" {
-		url = b.serviceURL + StationInformationPath
+		url = serviceURL + StationInformationPath
 	}
-	raw, err := b.caller.Get(url)
+	raw, err := fetchFeed(caller, feedStationInformation, url)
 	if err != nil {
 		return types.StationInformation{}, err
 	}
-	if raw == nil {
-		return types.StationInformation{}, errors.New(ErrEmptyResponse)
-	}
-
-	if b.feedFormat == "tfl" {
-		return types.TflToInformation(raw)
-	}
 
 	var response types.StationInformation
-	if err := processResponse(raw, &response); err != nil {
+	if err := decodeFeed(feedStationInformation, func() (err error) {
+		if feedFormat == "tfl" {
+			response, err = types.TflToInformation(raw)
+			return err
+		}
+		return processResponse(raw, &response)
+	}); err != nil {
 		return types.StationInformation{}, err
 	}
+	observeFeed(feedStationInformation, response.LastUpdated, len(response.Data.Stations), time.Now())
 
 	return response, nil
 }
 
 func (b *ClientBuilder) getVehicleTypes() (types.VehicleTypes, error) {
-	raw, err := b.caller.Get(b.vehicleTypesURL)
+	raw, err := fetchFeed(b.caller, feedVehicleTypes, b.vehicleTypesURL)
 	if err != nil {
 		return types.VehicleTypes{}, err
 	}
 	var response types.VehicleTypes
-	if err := processResponse(raw, &response); err != nil {
+	if err := decodeFeed(feedVehicleTypes, func() error { return processResponse(raw, &response) }); err != nil {
 		return types.VehicleTypes{}, err
 	}
 	return response, nil
@@ -304,19 +531,37 @@ func (c *Client) ParseStationData() (types.NormalizedStationData, error) {
 // The function runs indefinitely, fetching new data every minute. To stop the function, you must
 // interrupt the program manually.
 func (c *Client) PrintStationDataJSONL() {
+	c.mode = modeJSONL
+	c.reportConfig()
 	for {
+		metrics.IncPolls()
 		stationData, err := c.gatherStationData()
 		if err != nil {
+			metrics.IncFetchError()
+			slog.Error("fetch failed", errorAttrs(err, "fetch")...)
+			time.Sleep(time.Duration(c.interval) * time.Second)
 			continue
 		}
-
+		tracked := len(stationData)
+		c.publish(stationData)
+		c.recordOutages(nil, stationData)
+		c.evaluateAlerts(stationData)
+		stationData = c.applyChangesOnly(stationData)
+
+		var rows int
+		var writeErr error
 		for _, data := range stationData {
 			jsonl, err := json.Marshal(data)
 			if err != nil {
 				continue
 			}
-			fmt.Println(string(jsonl))
+			if _, err := fmt.Println(string(jsonl)); err != nil {
+				writeErr = err
+				break
+			}
+			rows++
 		}
+		recordOutput(sinkJSONL, rows, tracked, writeErr)
 
 		time.Sleep(time.Duration(c.interval) * time.Second)
 	}
@@ -357,6 +602,9 @@ func (c *Client) PrintStationDataCSV(excludeColumns []string) {
 		"IsInstalled",
 		"TimeStamp",
 	}
+	if c.changes != nil {
+		headers = append(headers, "Delta", "Keyframe")
+	}
 
 	// Prepare headers
 	var finalHeaders []string
@@ -368,6 +616,8 @@ func (c *Client) PrintStationDataCSV(excludeColumns []string) {
 
 	_ = w.Write(finalHeaders)
 
+	c.mode = modeCSV
+	c.reportConfig()
 	for {
 		currentDay := startOfDay(c.timeProvider.Now())
 		if currentDay.After(c.currentDate) {
@@ -377,10 +627,19 @@ func (c *Client) PrintStationDataCSV(excludeColumns []string) {
 			c.currentDate = currentDay
 		}
 
+		metrics.IncPolls()
 		stationData, err := c.gatherStationData()
 		if err != nil {
+			metrics.IncFetchError()
+			slog.Error("fetch failed", errorAttrs(err, "fetch")...)
+			time.Sleep(time.Duration(c.interval) * time.Second)
 			continue
 		}
+		tracked := len(stationData)
+		c.publish(stationData)
+		c.recordOutages(nil, stationData)
+		c.evaluateAlerts(stationData)
+		stationData = c.applyChangesOnly(stationData)
 
 		for _, data := range stationData {
 			var record []string
@@ -426,9 +685,16 @@ func (c *Client) PrintStationDataCSV(excludeColumns []string) {
 			if !contains(excludeColumns, "TimeStamp") {
 				record = append(record, data.TimeStamp.Format(time.RFC3339))
 			}
+			if c.changes != nil && !contains(excludeColumns, "Delta") {
+				record = append(record, data.Delta)
+			}
+			if c.changes != nil && !contains(excludeColumns, "Keyframe") {
+				record = append(record, fmt.Sprint(data.Keyframe))
+			}
 			_ = w.Write(record)
 		}
 		w.Flush()
+		recordOutput(sinkCSV, len(stationData), tracked, w.Error())
 
 		time.Sleep(time.Duration(c.interval) * time.Second)
 	}
@@ -448,11 +714,13 @@ func (c *Client) gatherStationData() ([]types.NormalizedStationDataTS, error) {
 	var stationData []types.NormalizedStationDataTS
 
 	statusData, err := c.getStationStatus()
+	metrics.RecordFetch(c.timeProvider.Now(), err)
 	if err != nil {
 		return nil, err
 	}
 
 	now := c.timeProvider.Now()
+	c.lastFeedUpdate = types.FeedTime(statusData.LastUpdated)
 
 	for _, stationStatus := range statusData.Data.Stations {
 		if stationInfo, ok := c.stationMap[stationStatus.StationID]; ok {
@@ -465,6 +733,7 @@ func (c *Client) gatherStationData() ([]types.NormalizedStationDataTS, error) {
 			stationData = append(stationData, data)
 		}
 	}
+	c.exportStations(statusData, stationData)
 
 	return stationData, nil
 }
@@ -474,22 +743,22 @@ func (c *Client) getStationStatus() (types.StationStatus, error) {
 	if url == "" {
 		url = c.serviceURL + StationStatusPath
 	}
-	raw, err := c.caller.Get(url)
+	raw, err := fetchFeed(c.caller, feedStationStatus, url)
 	if err != nil {
 		return types.StationStatus{}, err
 	}
-	if raw == nil {
-		return types.StationStatus{}, errors.New(ErrEmptyResponse)
-	}
-
-	if c.feedFormat == "tfl" {
-		return types.TflToStatus(raw)
-	}
 
 	var response types.StationStatus
-	if err := processResponse(raw, &response); err != nil {
+	if err := decodeFeed(feedStationStatus, func() (err error) {
+		if c.feedFormat == "tfl" {
+			response, err = types.TflToStatus(raw)
+			return err
+		}
+		return processResponse(raw, &response)
+	}); err != nil {
 		return types.StationStatus{}, err
 	}
+	observeFeed(feedStationStatus, response.LastUpdated, len(response.Data.Stations), time.Now())
 
 	return response, nil
 }
@@ -583,86 +852,240 @@ ALTER TABLE dock_status SET (timescaledb.compress, timescaledb.compress_segmentb
 SELECT add_compression_policy('dock_status', INTERVAL '7 days', if_not_exists => true);
 `
 
-// IngestPostgres runs the polling loop, writing each tracked station's status to
-// the dock_status table on every interval. It creates the table if missing and
-// runs indefinitely. Health is surfaced via the metrics package.
+// IngestPostgres runs the polling loop, writing each tracked station's status to the
+// dock_status table on every interval, recording each attempt in poll_log, and keeps
+// the stations dimension current by re-reading station_information every
+// stationSyncInterval. The database must already be migrated to this binary's schema
+// version (see Migrate). Replicas for the same CITY_ID elect a leader through a
+// Postgres advisory lock (see leader.go); the others poll without writing until they
+// take it over. It runs indefinitely. Health is surfaced via the metrics package.
 func (c *Client) IngestPostgres(dsn string) error {
-	if dsn == "" {
-		return errors.New("postgres DSN is empty (set DATABASE_URL)")
-	}
-	db, err := sql.Open("postgres", dsn)
+	db, err := openPostgres(dsn)
 	if err != nil {
-		return fmt.Errorf("open postgres: %w", err)
+		return err
 	}
 	defer db.Close()
-	db.SetMaxOpenConns(2)
-	// recycle connections so a Postgres restart doesn't wedge ingestion on a
-	// stale pooled conn (lib/pq won't otherwise evict broken conns for a while)
-	db.SetConnMaxLifetime(5 * time.Minute)
-	db.SetConnMaxIdleTime(5 * time.Minute)
 
-	if err := db.Ping(); err != nil {
-		return fmt.Errorf("ping postgres: %w", err)
-	}
-	if _, err := db.Exec(createDockStatusTable); err != nil {
-		return fmt.Errorf("ensure schema: %w", err)
+	// The schema is owned by `dockscan db migrate`; refuse to write into a database
+	// that is behind (or ahead of) what this binary was built for.
+	if err := ensureSchemaCurrent(db); err != nil {
+		return err
 	}
 	// Guard against a misconfigured deploy (a city's ingester pointed at another city's
 	// DB): stamp/assert this DB's city_id. Fatal on mismatch so we never corrupt data.
-	if err := ensureCityID(db); err != nil {
+	// A shared database (see tenancy.go) hosts several cities instead; there CITY_ID
+	// names the city this ingester writes as.
+	shared, err := isShared(db)
+	if err != nil {
 		return err
 	}
-	// If TimescaleDB is available, make dock_status a compressed hypertable.
-	// Non-fatal: plain Postgres (or any failure here) just means uncompressed rows.
-	var hasTimescale bool
-	if err := db.QueryRow(
-		"SELECT EXISTS(SELECT 1 FROM pg_available_extensions WHERE name = 'timescaledb')",
-	).Scan(&hasTimescale); err != nil {
-		log.Printf("timescaledb availability check failed (non-fatal): %v", err)
-	}
-	if hasTimescale {
-		if _, err := db.Exec(timescaleSetup); err != nil {
-			log.Printf("timescaledb setup failed (non-fatal, continuing uncompressed): %v", err)
-		} else {
-			log.Printf("timescaledb: dock_status is a compressed hypertable")
-		}
-		// Optional 90-day-style retention: drop chunks older than RETENTION_DAYS so the
-		// table stays bounded. Opt-in via env — NYC leaves it unset and instead uses its
-		// archive-to-cold-drive prune CronJob; the chart-deployed cities set it to 90.
-		if days := strings.TrimSpace(os.Getenv("RETENTION_DAYS")); days != "" {
-			if n, err := strconv.Atoi(days); err != nil || n <= 0 {
-				log.Printf("invalid RETENTION_DAYS=%q (want a positive integer); skipping retention policy", days)
-			} else if _, err := db.Exec(fmt.Sprintf(
-				"SELECT add_retention_policy('dock_status', INTERVAL '%d days', if_not_exists => true)", n)); err != nil {
-				log.Printf("retention policy setup failed (non-fatal): %v", err)
-			} else {
-				log.Printf("timescaledb: retention policy drops chunks older than %d days", n)
-			}
+	if shared {
+		if c.tenant, err = tenantFromEnv(); err != nil {
+			return err
 		}
+		slog.Info("shared database: writing as this city", "tenant", c.tenant)
+	} else if err := ensureCityID(db); err != nil {
+		return err
 	}
-	log.Printf("ingesting to postgres every %ds (%d stations tracked)", c.interval, len(c.stationMap))
-
+	// Replicas of one city's ingester elect a leader; only the leader writes. One pooled
+	// connection stays pinned to the lock session, so allow one more than usual.
+	db.SetMaxOpenConns(3)
+	lock := newLeaderLock(db, os.Getenv("CITY_ID"))
+	defer lock.release()
+	slog.Info("ingesting to postgres", logging.KeyStations, len(c.stationMap), "interval", time.Duration(c.interval)*time.Second)
+	c.mode = modePostgres
+	c.reportConfig()
+
+	processStart := c.timeProvider.Now()
+	announced := false
 	for {
 		metrics.IncPolls()
+		leader := c.holdLeader(lock)
+		switch {
+		case leader && (!c.leader || lock.acquired):
+			// also when a leader retakes the lock after a database outage ended its
+			// session: another replica may have led in between
+			slog.Info("leader: took the lock; writing", "lock", lock.key)
+			if err := c.becomeLeader(db); err != nil {
+				return err
+			}
+		case !leader && c.leader:
+			slog.Warn("leader: lost the lock; standing by", "lock", lock.key)
+		case !leader && !announced:
+			slog.Info("leader: another replica holds the lock; standing by", "lock", lock.key)
+		}
+		c.leader, announced = leader, true
+		metrics.SetLeader(leader)
+		if !leader {
+			if lock.held {
+				c.setSpoolAside()
+			}
+			c.standbyPoll()
+			time.Sleep(time.Duration(c.interval) * time.Second)
+			continue
+		}
+
+		if c.timeProvider.Now().Sub(c.lastInfoSync) >= stationSyncInterval {
+			if err := c.refreshStations(db); err != nil {
+				slog.Warn("station refresh failed (non-fatal, retrying next poll)", errorAttrs(err, "stations")...)
+			}
+		}
+		c.maintainPartitionsIfDue(db)
+		if c.rollups == rollupsTables && (c.rollupsBehind || c.timeProvider.Now().Sub(c.lastRollupRun) >= rollupInterval) {
+			caughtUp, err := refreshRollups(db, c.timeProvider.Now(), c.tenant)
+			if err != nil {
+				slog.Warn("rollup refresh failed (non-fatal, retrying next poll)", logging.Error(err, "db"))
+			} else {
+				c.lastRollupRun, c.rollupsBehind = c.timeProvider.Now(), !caughtUp
+			}
+		}
+		poll := PollRecord{StartedAt: c.timeProvider.Now(), ProcessStartedAt: processStart}
+		fetchStart := time.Now()
 		stationData, err := c.gatherStationData()
+		poll.FetchLatency = time.Since(fetchStart)
 		if err != nil {
 			metrics.IncFetchError()
-			log.Printf("fetch error: %v", err)
+			slog.Error("fetch failed", append(errorAttrs(err, "fetch"), logging.KeyDuration, poll.FetchLatency)...)
+			poll.Outcome, poll.Error = PollFetchError, err.Error()
+			c.logPoll(db, poll)
 			time.Sleep(time.Duration(c.interval) * time.Second)
 			continue
 		}
-		if err := c.insertBatch(db, stationData); err != nil {
+		tracked := len(stationData)
+		c.publish(stationData)
+		c.evaluateAlerts(stationData)
+		stationData = c.namespace(stationData)
+		poll.FeedLastUpdated, poll.Stations = c.lastFeedUpdate, tracked
+		c.recordFlows(db, stationData)
+		c.recordOutages(db, stationData)
+		stationData = c.applyChangesOnly(stationData)
+		written, err := c.writeBatch(db, stationData)
+		metrics.AddRows(written)
+		metrics.SinkRows.Add(sinkPostgres, float64(written))
+		metrics.RecordWrite(sinkPostgres, c.timeProvider.Now(), err)
+		poll.Rows = written
+		if err != nil {
 			metrics.IncDBError()
-			log.Printf("db write error: %v", err)
+			metrics.SinkErrors.Inc(sinkPostgres)
+			metrics.Errors.Inc("db")
+			slog.Error("db write failed", logging.Error(err, "db"), logging.KeyStations, len(stationData), "written", written)
+			poll.Outcome, poll.Error = PollDBError, err.Error()
 		} else {
-			metrics.AddRows(len(stationData))
-			metrics.SetStations(len(stationData))
+			metrics.SetStations(tracked)
 			metrics.MarkSuccess(c.timeProvider.Now())
+			poll.Outcome = PollOK
+			slog.Debug("poll written", logging.KeyStations, tracked, "written", written, logging.KeyDuration, poll.FetchLatency)
 		}
+		c.logPoll(db, poll)
 		time.Sleep(time.Duration(c.interval) * time.Second)
 	}
 }
 
+// becomeLeader prepares the database for writing when this replica takes the leader
+// lock: the storage setup (once per process), then the stations dimension.
+func (c *Client) becomeLeader(db *sql.DB) error {
+	if !c.storageReady {
+		// If TimescaleDB is available, make dock_status a compressed hypertable.
+		// Non-fatal: plain Postgres (or any failure here) just means uncompressed rows.
+		var hasTimescale, hypertable bool
+		if err := db.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM pg_available_extensions WHERE name = 'timescaledb')",
+		).Scan(&hasTimescale); err != nil {
+			slog.Warn("timescaledb availability check failed (non-fatal)", logging.Error(err, "db"))
+		}
+		if hasTimescale {
+			if _, err := db.Exec(timescaleSetup); err != nil {
+				slog.Warn("timescaledb setup failed (non-fatal, continuing uncompressed)", logging.Error(err, "db"))
+			} else {
+				hypertable = true
+				slog.Info("timescaledb: dock_status is a compressed hypertable")
+			}
+			// Optional 90-day-style retention: drop chunks older than RETENTION_DAYS so the
+			// table stays bounded. Opt-in via env — NYC leaves it unset and instead uses its
+			// archive-to-cold-drive prune CronJob; the chart-deployed cities set it to 90.
+			if n, ok := retentionDays(); ok {
+				if _, err := db.Exec(fmt.Sprintf(
+					"SELECT add_retention_policy('dock_status', INTERVAL '%d days', if_not_exists => true)", n)); err != nil {
+					slog.Warn("retention policy setup failed (non-fatal)", logging.Error(err, "db"))
+				} else {
+					slog.Info("timescaledb: retention policy drops old chunks", "retention_days", n)
+				}
+			}
+		} else {
+			// Plain Postgres: dock_status may be partitioned by day instead (`db partition`),
+			// so RETENTION_DAYS can drop whole partitions (see maintainPartitionsIfDue).
+			partitioned, err := isPartitioned(db)
+			if err != nil {
+				slog.Warn("partition check failed (non-fatal)", logging.Error(err, "db"))
+			}
+			c.partitioned = partitioned
+			if _, ok := retentionDays(); ok && !partitioned {
+				slog.Warn("RETENTION_DAYS needs a partitioned dock_status on plain Postgres; run `dockscan db partition`")
+			}
+		}
+		// Hourly/daily rollups: continuous aggregates on a hypertable, otherwise tables
+		// IngestPostgres keeps current.
+		c.setupRollups(db, hypertable)
+		if ok, err := hasUniqueKey(db); err != nil {
+			slog.Warn("unique key check failed (non-fatal)", logging.Error(err, "db"))
+		} else {
+			c.uniqueKey = ok
+		}
+		c.reportStorage(hasTimescale, hypertable)
+		c.storageReady = true
+	}
+	// Record the tracked stations in the stations dimension before the first fact row
+	// lands; narrow fact rows are unreadable without it.
+	if err := c.syncStationDimension(db); err != nil {
+		return err
+	}
+	// A standby's change tracker never saw what the old leader wrote; start over
+	// from a keyframe.
+	if c.changes != nil {
+		c.changes = newChangeTracker(c.changes.keyframeInterval)
+	}
+	// Likewise the outage detector; episodes the old leader left open are closed where
+	// it last saw them.
+	if c.outages != nil {
+		c.outages = NewOutageDetector(c.outages.maxGap)
+		if err := closeStaleOutages(db, c.tenant); err != nil {
+			slog.Warn("closing stale outages failed (non-fatal)", logging.Error(err, "db"))
+		}
+	}
+	// Alert rules start over too: a condition's run can't span the polls we didn't
+	// evaluate while standing by.
+	if c.alerts != nil {
+		c.alerts.reset()
+	}
+	if c.spool != nil && c.spool.Len() > 0 {
+		slog.Info("spool: rows to replay", "spool", c.spool.String())
+	}
+	return nil
+}
+
+// openPostgres opens and pings the pool shared by the ingester and the offline
+// commands (flows, trips, …). The caller owns Close.
+func openPostgres(dsn string) (*sql.DB, error) {
+	if dsn == "" {
+		return nil, errors.New("postgres DSN is empty (set DATABASE_URL)")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open postgres: %w", err)
+	}
+	db.SetMaxOpenConns(2)
+	// recycle connections so a Postgres restart doesn't wedge ingestion on a
+	// stale pooled conn (lib/pq won't otherwise evict broken conns for a while)
+	db.SetConnMaxLifetime(5 * time.Minute)
+	db.SetConnMaxIdleTime(5 * time.Minute)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping postgres: %w", err)
+	}
+	return db, nil
+}
+
 // ensureCityID stamps app_metadata.city_id with the CITY_ID env on first run and asserts
 // it never changes — so a Paris ingester pointed at the CDMX DB (or similar) fails fast
 // instead of writing into the wrong database. No-op when CITY_ID is unset (the original
@@ -672,9 +1095,6 @@ func ensureCityID(db *sql.DB) error {
 	if cityID == "" {
 		return nil
 	}
-	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS app_metadata (key text PRIMARY KEY, value text NOT NULL)`); err != nil {
-		return fmt.Errorf("app_metadata: %w", err)
-	}
 	var existing string
 	switch err := db.QueryRow("SELECT value FROM app_metadata WHERE key='city_id'").Scan(&existing); err {
 	case sql.ErrNoRows:
@@ -698,34 +1118,3 @@ func nullable(s string) interface{} {
 	}
 	return s
 }
-
-func (c *Client) insertBatch(db *sql.DB, data []types.NormalizedStationDataTS) error {
-	if len(data) == 0 {
-		return nil
-	}
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	stmt, err := tx.Prepare(`INSERT INTO dock_status
-        (station_id,name,longitude,latitude,bikes_available,ebikes_available,bikes_disabled,
-         docks_available,docks_disabled,scooters_available,scooters_unavailable,
-         is_returning,is_renting,is_installed,neighborhood,ts)
-        VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16)`)
-	if err != nil {
-		_ = tx.Rollback()
-		return err
-	}
-	defer stmt.Close()
-	for _, d := range data {
-		s := d.Station
-		if _, err := stmt.Exec(s.ID, s.Name, s.Longitude, s.Latitude, s.BikesAvailable,
-			s.EBikesAvailable, s.BikesDisabled, s.DocksAvailable, s.DocksDisabled,
-			s.ScootersAvailable, s.ScootersUnavailable, s.IsReturning, s.IsRenting,
-			s.IsInstalled, nullable(s.Neighborhood), d.TimeStamp); err != nil {
-			_ = tx.Rollback()
-			return err
-		}
-	}
-	return tx.Commit()
-}
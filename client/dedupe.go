@@ -0,0 +1,144 @@
+package client
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+// DefaultDedupeWindow is how much of dock_status one Dedupe batch covers.
+const DefaultDedupeWindow = 24 * time.Hour
+
+const (
+	uniqueKeyName = "dock_status_station_ts_key"
+	// createUniqueKey includes ts, so it's valid on a hypertable and on a table
+	// partitioned by ts.
+	createUniqueKey = "CREATE UNIQUE INDEX IF NOT EXISTS " + uniqueKeyName + " ON dock_status (station_id, ts)"
+	uniqueKeyExists = "SELECT EXISTS (SELECT 1 FROM pg_indexes WHERE tablename = 'dock_status' AND indexname = '" + uniqueKeyName + "')"
+)
+
+// countDuplicates counts the surplus rows (all but one per station and ts) in a window.
+const countDuplicates = `
+SELECT coalesce(sum(n - 1), 0) FROM (
+    SELECT count(*) AS n FROM dock_status WHERE ts >= $1 AND ts < $2
+    GROUP BY station_id, ts HAVING count(*) > 1
+) d`
+
+// deleteDuplicates keeps one row per station and ts in a window, preferring a wide row
+// over a narrow one, and deletes the rest. tableoid disambiguates ctid across chunks
+// and partitions.
+const deleteDuplicates = `
+DELETE FROM dock_status d USING (
+    SELECT tableoid, ctid FROM (
+        SELECT tableoid, ctid, row_number() OVER (
+                   PARTITION BY station_id, ts ORDER BY name IS NULL, neighborhood IS NULL) AS rn
+        FROM dock_status WHERE ts >= $1 AND ts < $2
+    ) r WHERE rn > 1
+) dup
+WHERE d.ts >= $1 AND d.ts < $2 AND d.tableoid = dup.tableoid AND d.ctid = dup.ctid`
+
+// DedupeOptions configures Dedupe.
+type DedupeOptions struct {
+	Window    time.Duration // each window is scanned (and cleaned) in its own transaction
+	DryRun    bool          // count the duplicates without deleting them
+	UniqueKey bool          // afterwards, add the (station_id, ts) unique key
+}
+
+// DedupeStats summarizes a Dedupe.
+type DedupeStats struct {
+	Windows    int
+	Duplicates int64 // surplus rows found (DryRun) or deleted
+}
+
+// Dedupe removes duplicate (station_id, ts) rows from dock_status, one window of ts at
+// a time so no single transaction holds locks on (or bloats) the whole table. With
+// UniqueKey it then adds the unique key that keeps new duplicates out: once it exists,
+// the ingester skips rows already written instead of inserting them again.
+func Dedupe(dsn string, opts DedupeOptions) (DedupeStats, error) {
+	var stats DedupeStats
+	if opts.Window <= 0 {
+		opts.Window = DefaultDedupeWindow
+	}
+	db, err := openPostgres(dsn)
+	if err != nil {
+		return stats, err
+	}
+	defer db.Close()
+	if err := ensureSchemaCurrent(db); err != nil {
+		return stats, err
+	}
+
+	var first, last sql.NullTime
+	if err := db.QueryRow("SELECT min(ts), max(ts) FROM dock_status").Scan(&first, &last); err != nil {
+		return stats, err
+	}
+	var windows []timeRange
+	if first.Valid {
+		windows = dedupeWindows(first.Time, last.Time, opts.Window)
+	}
+	for _, w := range windows {
+		n, err := dedupeWindow(db, w, opts.DryRun)
+		if err != nil {
+			return stats, err
+		}
+		stats.Windows++
+		stats.Duplicates += n
+		if n > 0 {
+			slog.Info("dedupe: duplicate rows", "window", w, "rows", n)
+		}
+	}
+	if !opts.UniqueKey || opts.DryRun {
+		return stats, nil
+	}
+
+	// The ingester may have written duplicates since the newest window was cleaned.
+	if len(windows) > 0 {
+		n, err := dedupeWindow(db, timeRange{From: windows[len(windows)-1].From, To: time.Now().Add(time.Hour)}, false)
+		if err != nil {
+			return stats, err
+		}
+		stats.Duplicates += n
+	}
+	if _, err := db.Exec(createUniqueKey); err != nil {
+		return stats, fmt.Errorf("create unique key (were duplicates written meanwhile? run dedupe again): %w", err)
+	}
+	slog.Info("dedupe: dock_status has the unique key", "key", uniqueKeyName)
+	return stats, nil
+}
+
+func dedupeWindow(db *sql.DB, w timeRange, dryRun bool) (int64, error) {
+	if dryRun {
+		var n int64
+		err := db.QueryRow(countDuplicates, w.From, w.To).Scan(&n)
+		return n, err
+	}
+	res, err := db.Exec(deleteDuplicates, w.From, w.To)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func hasUniqueKey(db *sql.DB) (bool, error) {
+	var ok bool
+	err := db.QueryRow(uniqueKeyExists).Scan(&ok)
+	return ok, err
+}
+
+type timeRange struct{ From, To time.Time }
+
+func (r timeRange) String() string {
+	return r.From.UTC().Format(time.RFC3339) + " – " + r.To.UTC().Format(time.RFC3339)
+}
+
+// dedupeWindows splits [first, last] into consecutive windows aligned to multiples of
+// window (UTC midnights for the default day).
+func dedupeWindows(first, last time.Time, window time.Duration) []timeRange {
+	var out []timeRange
+	for from := first.UTC().Truncate(window); !from.After(last); from = from.Add(window) {
+		out = append(out, timeRange{From: from, To: from.Add(window)})
+	}
+	return out
+}
@@ -0,0 +1,23 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestDedupeWindows covers how Dedupe batches dock_status.
+func TestDedupeWindows(t *testing.T) {
+	at := func(d, h int) time.Time { return time.Date(2023, 7, d, h, 0, 0, 0, time.UTC) }
+
+	got := dedupeWindows(at(21, 13), at(23, 0), 24*time.Hour)
+	want := []timeRange{{at(21, 0), at(22, 0)}, {at(22, 0), at(23, 0)}, {at(23, 0), at(24, 0)}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("days: got %v, want %v", got, want)
+	}
+
+	// a single row still gets a window
+	if got := dedupeWindows(at(21, 13), at(21, 13), 6*time.Hour); !reflect.DeepEqual(got, []timeRange{{at(21, 12), at(21, 18)}}) {
+		t.Errorf("one row: got %v", got)
+	}
+}
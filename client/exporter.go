@@ -0,0 +1,87 @@
+package client
+
+import (
+	"github.com/kardolus/citi-bike-dock-tracker/logging"
+	"github.com/kardolus/citi-bike-dock-tracker/metrics"
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+// stationExporter backs the per-station gauges on /metrics (see
+// metrics.SetStationGauges). By default it exports every station in the feed, which
+// needs its own copy of station_information: the client only keeps the tracked ones.
+type stationExporter struct {
+	all           bool                           // every feed station, not just the tracked ones
+	stations      map[string]types.StationEntity // every feed station, when all
+	neighborhood  map[string]string              // station_id -> slug, when all
+	neighborhoods []Neighborhood
+	area          map[string]string // slug -> area
+	withheld      bool              // the last poll was over the cardinality limit
+}
+
+func newStationExporter(all bool, ns []Neighborhood) *stationExporter {
+	e := &stationExporter{all: all, neighborhoods: ns, area: make(map[string]string, len(ns))}
+	for _, n := range ns {
+		e.area[n.Slug] = n.Area
+	}
+	return e
+}
+
+// setStations records the feed's stations (and their neighborhoods) for exporting
+// every station. A no-op when only the tracked stations are exported.
+func (e *stationExporter) setStations(stations []types.StationEntity) {
+	if !e.all {
+		return
+	}
+	e.stations = make(map[string]types.StationEntity, len(stations))
+	e.neighborhood = make(map[string]string, len(stations))
+	for _, s := range stations {
+		e.stations[s.StationID] = s
+		if len(e.neighborhoods) > 0 {
+			e.neighborhood[s.StationID] = assignNeighborhood(e.neighborhoods, s.Lat, s.Lon)
+		}
+	}
+}
+
+func (e *stationExporter) gauge(s types.NormalizedStation, neighborhood string) metrics.StationGauge {
+	return metrics.StationGauge{
+		ID:           s.ID,
+		Name:         s.Name,
+		Neighborhood: neighborhood,
+		Area:         e.area[neighborhood],
+		Bikes:        s.BikesAvailable,
+		EBikes:       s.EBikesAvailable,
+		Docks:        s.DocksAvailable,
+	}
+}
+
+// exportStations updates the station gauges from one poll: the whole station_status
+// feed, or only the tracked stations. A no-op unless the exporter is on.
+func (c *Client) exportStations(status types.StationStatus, tracked []types.NormalizedStationDataTS) {
+	e := c.exporter
+	if e == nil {
+		return
+	}
+	var gauges []metrics.StationGauge
+	if e.all {
+		gauges = make([]metrics.StationGauge, 0, len(status.Data.Stations))
+		for _, s := range status.Data.Stations {
+			if info, ok := e.stations[s.StationID]; ok {
+				gauges = append(gauges, e.gauge(normalizeStationData(s, info, c.electricTypes), e.neighborhood[s.StationID]))
+			}
+		}
+	} else {
+		gauges = make([]metrics.StationGauge, 0, len(tracked))
+		for _, d := range tracked {
+			gauges = append(gauges, e.gauge(d.Station, d.Station.Neighborhood))
+		}
+	}
+	withheld := metrics.SetStationGauges(gauges)
+	switch {
+	case withheld && !e.withheld:
+		slog.Warn("station metrics: over the limit; exporting neighborhood aggregates only", logging.KeyStations, len(gauges))
+	case !withheld && e.withheld:
+		slog.Info("station metrics: within the limit again; exporting per-station gauges", logging.KeyStations, len(gauges))
+	}
+	e.withheld = withheld
+}
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/http"
+	"github.com/kardolus/citi-bike-dock-tracker/logging"
+	"github.com/kardolus/citi-bike-dock-tracker/metrics"
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+// Feed names, as the feed label of the fetch metrics.
+const (
+	feedStationStatus      = "station_status"
+	feedStationInformation = "station_information"
+	feedVehicleTypes       = "vehicle_types"
+)
+
+// Sinks, as the sink label of the output metrics.
+const (
+	sinkPostgres = "postgres"
+	sinkSpool    = "spool"
+	sinkCSV      = "csv"
+	sinkJSONL    = "jsonl"
+)
+
+// fetchFeed downloads one feed, recording its download time and size, or the class of
+// error that stopped it.
+func fetchFeed(caller http.Caller, feed, url string) ([]byte, error) {
+	start := time.Now()
+	raw, err := caller.Get(url)
+	metrics.FetchSeconds.With(feed).ObserveDuration(time.Since(start))
+	if err != nil {
+		class := fetchErrorClass(err)
+		metrics.Errors.Inc(class)
+		return nil, &feedError{feed: feed, kind: class, err: err}
+	}
+	if raw == nil {
+		metrics.Errors.Inc("empty_response")
+		return nil, &feedError{feed: feed, kind: "empty_response", err: errors.New(ErrEmptyResponse)}
+	}
+	metrics.FetchBytes.With(feed).Observe(float64(len(raw)))
+	return raw, nil
+}
+
+// fetchErrorClass tells a timeout from an operator error response from any other
+// failure to reach the feed.
+func fetchErrorClass(err error) string {
+	var status http.StatusError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &status):
+		return "http_status"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "network"
+}
+
+// decodeFeed times parsing a fetched feed and counts decode errors.
+func decodeFeed(feed string, decode func() error) error {
+	start := time.Now()
+	err := decode()
+	metrics.DecodeSeconds.With(feed).ObserveDuration(time.Since(start))
+	if err != nil {
+		metrics.Errors.Inc("decode")
+		return &feedError{feed: feed, kind: "decode", err: err}
+	}
+	return nil
+}
+
+// feedError is a failed fetch or decode of one feed. It reads as the underlying error
+// and carries the feed and error class for the logs.
+type feedError struct {
+	feed, kind string
+	err        error
+}
+
+func (e *feedError) Error() string { return e.err.Error() }
+func (e *feedError) Unwrap() error { return e.err }
+
+// errorAttrs are the log attrs for err: the error, its kind and, for a feed error, the
+// feed. kind is used when err isn't a feed error.
+func errorAttrs(err error, kind string) []any {
+	var fe *feedError
+	if errors.As(err, &fe) {
+		return []any{logging.Error(err, fe.kind), slog.String(logging.KeyFeed, fe.feed)}
+	}
+	return []any{logging.Error(err, kind)}
+}
+
+// observeFeed records a decoded feed's station count and how stale its last_updated
+// is. Feeds without last_updated (TfL) have no age.
+func observeFeed(feed string, lastUpdated any, stations int, now time.Time) {
+	metrics.FeedStations.Set(feed, float64(stations))
+	if updated := types.FeedTime(lastUpdated); !updated.IsZero() {
+		metrics.FeedAge.Set(feed, now.Sub(updated).Seconds())
+	} else {
+		metrics.FeedAge.Delete(feed)
+	}
+}
+
+// recordOutput records one poll written to a CSV or JSONL sink: tracked stations
+// fetched, rows written, or the write error.
+func recordOutput(sink string, rows, tracked int, err error) {
+	metrics.RecordWrite(sink, time.Now(), err)
+	if err != nil {
+		metrics.SinkErrors.Inc(sink)
+		metrics.Errors.Inc("output")
+		return
+	}
+	metrics.SinkRows.Add(sink, float64(rows))
+	metrics.SetStations(tracked)
+	metrics.MarkSuccess(time.Now())
+}
@@ -0,0 +1,31 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/kardolus/citi-bike-dock-tracker/http"
+)
+
+// TestFetchErrorClass covers how failed fetches are classified for citibike_errors_total.
+func TestFetchErrorClass(t *testing.T) {
+	for err, want := range map[error]string{
+		http.StatusError{Code: 503}:                                "http_status",
+		fmt.Errorf("failed to make request: %w", timeoutError{}):   "timeout",
+		fmt.Errorf("failed to make request: %w", context.Canceled): "network",
+		errors.New("connection refused"):                           "network",
+	} {
+		if got := fetchErrorClass(err); got != want {
+			t.Errorf("fetchErrorClass(%v) = %q, want %q", err, got, want)
+		}
+	}
+}
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
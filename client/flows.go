@@ -0,0 +1,248 @@
+package client
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/logging"
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+const (
+	// DefaultRebalanceThreshold is the smallest single-interval change (in bikes, either
+	// direction) treated as a rebalancing truck rather than riders.
+	DefaultRebalanceThreshold = 8
+	// DefaultFlowMaxGap is the longest gap between two snapshots of a station that is
+	// still diffed. Across a longer gap (feed outage, pod restart) we can't tell how
+	// many trips happened, so the pair is skipped rather than guessed.
+	DefaultFlowMaxGap = 10 * time.Minute
+)
+
+// FlowInferrer turns a stream of snapshots into per-station, per-hour StationFlows.
+// Feed it snapshots in time order with Observe; each consecutive pair of a station's
+// snapshots is diffed and attributed to the hour of the later one.
+type FlowInferrer struct {
+	rebalanceThreshold int
+	maxGap             time.Duration
+	previous           map[string]types.NormalizedStationDataTS
+	buckets            map[flowKey]*types.StationFlow
+}
+
+type flowKey struct {
+	stationID string
+	hour      time.Time
+}
+
+func NewFlowInferrer(rebalanceThreshold int, maxGap time.Duration) *FlowInferrer {
+	if rebalanceThreshold <= 0 {
+		rebalanceThreshold = DefaultRebalanceThreshold
+	}
+	if maxGap <= 0 {
+		maxGap = DefaultFlowMaxGap
+	}
+	return &FlowInferrer{
+		rebalanceThreshold: rebalanceThreshold,
+		maxGap:             maxGap,
+		previous:           make(map[string]types.NormalizedStationDataTS),
+		buckets:            make(map[flowKey]*types.StationFlow),
+	}
+}
+
+// Observe diffs d against the station's previous snapshot. Pairs that straddle a gap
+// longer than maxGap, go backwards in time, or involve an uninstalled station are
+// skipped. Hours are bucketed in UTC so every city rolls over on the same boundary.
+func (f *FlowInferrer) Observe(d types.NormalizedStationDataTS) {
+	prev, ok := f.previous[d.Station.ID]
+	if ok && !d.TimeStamp.After(prev.TimeStamp) {
+		return // duplicate or out of order; keep the newer baseline
+	}
+	f.previous[d.Station.ID] = d
+	if !ok {
+		return
+	}
+	if d.TimeStamp.Sub(prev.TimeStamp) > f.maxGap || !prev.Station.IsInstalled || !d.Station.IsInstalled {
+		return
+	}
+
+	hour := d.TimeStamp.UTC().Truncate(time.Hour)
+	key := flowKey{stationID: d.Station.ID, hour: hour}
+	b, ok := f.buckets[key]
+	if !ok {
+		b = &types.StationFlow{StationID: d.Station.ID, Neighborhood: d.Station.Neighborhood, Hour: hour}
+		f.buckets[key] = b
+	}
+	b.Intervals++
+
+	dEbike := d.Station.EBikesAvailable - prev.Station.EBikesAvailable
+	dClassic := (d.Station.BikesAvailable - d.Station.EBikesAvailable) -
+		(prev.Station.BikesAvailable - prev.Station.EBikesAvailable)
+	if total := dClassic + dEbike; abs(total) >= f.rebalanceThreshold {
+		if total < 0 {
+			b.RebalanceOut += -total
+		} else {
+			b.RebalanceIn += total
+		}
+		return
+	}
+	if dClassic < 0 {
+		b.ClassicRentals += -dClassic
+	} else {
+		b.ClassicReturns += dClassic
+	}
+	if dEbike < 0 {
+		b.EBikeRentals += -dEbike
+	} else {
+		b.EBikeReturns += dEbike
+	}
+}
+
+// Flush removes and returns every bucket for an hour that ended at or before `before`
+// (i.e. hours that can no longer receive intervals), ordered by hour then station.
+// The ingester calls it each poll; offline reports call FlushAll at EOF.
+func (f *FlowInferrer) Flush(before time.Time) []types.StationFlow {
+	var out []types.StationFlow
+	for k, b := range f.buckets {
+		if !k.hour.Add(time.Hour).After(before) {
+			out = append(out, *b)
+			delete(f.buckets, k)
+		}
+	}
+	sortFlows(out)
+	return out
+}
+
+// FlushAll returns every remaining bucket, including the current partial hour.
+func (f *FlowInferrer) FlushAll() []types.StationFlow {
+	var out []types.StationFlow
+	for k, b := range f.buckets {
+		out = append(out, *b)
+		delete(f.buckets, k)
+	}
+	sortFlows(out)
+	return out
+}
+
+func sortFlows(fs []types.StationFlow) {
+	sort.Slice(fs, func(i, j int) bool {
+		if !fs[i].Hour.Equal(fs[j].Hour) {
+			return fs[i].Hour.Before(fs[j].Hour)
+		}
+		return fs[i].StationID < fs[j].StationID
+	})
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// PrintFlows writes a flows report as CSV (with a header row) or JSON Lines.
+func PrintFlows(out io.Writer, flows []types.StationFlow, format string) error {
+	if format == "jsonl" {
+		enc := json.NewEncoder(out)
+		for _, f := range flows {
+			if err := enc.Encode(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w := csv.NewWriter(out)
+	_ = w.Write([]string{"StationID", "Neighborhood", "Hour", "ClassicRentals", "ClassicReturns",
+		"EBikeRentals", "EBikeReturns", "RebalanceOut", "RebalanceIn", "Intervals"})
+	for _, f := range flows {
+		_ = w.Write([]string{f.StationID, f.Neighborhood, f.Hour.Format(time.RFC3339),
+			strconv.Itoa(f.ClassicRentals), strconv.Itoa(f.ClassicReturns),
+			strconv.Itoa(f.EBikeRentals), strconv.Itoa(f.EBikeReturns),
+			strconv.Itoa(f.RebalanceOut), strconv.Itoa(f.RebalanceIn), strconv.Itoa(f.Intervals)})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+const createStationFlowsTable = `
+CREATE TABLE IF NOT EXISTS station_flows (
+    station_id      text        NOT NULL,
+    neighborhood    text,
+    hour            timestamptz NOT NULL,
+    classic_rentals integer     NOT NULL,
+    classic_returns integer     NOT NULL,
+    ebike_rentals   integer     NOT NULL,
+    ebike_returns   integer     NOT NULL,
+    rebalance_out   integer     NOT NULL,
+    rebalance_in    integer     NOT NULL,
+    intervals       integer     NOT NULL,
+    PRIMARY KEY (station_id, hour)
+);
+CREATE INDEX IF NOT EXISTS station_flows_nbhd_hour_idx ON station_flows (neighborhood, hour) WHERE neighborhood IS NOT NULL;
+`
+
+// WriteFlowsPostgres upserts flows into station_flows. A
+// re-run over the same input replaces the rows it wrote before rather than doubling.
+func WriteFlowsPostgres(dsn string, flows []types.StationFlow) error {
+	db, err := openPostgres(dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := ensureSchemaCurrent(db); err != nil {
+		return err
+	}
+	return upsertFlows(db, flows)
+}
+
+func upsertFlows(db *sql.DB, flows []types.StationFlow) error {
+	if len(flows) == 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO station_flows
+        (station_id,neighborhood,hour,classic_rentals,classic_returns,ebike_rentals,ebike_returns,
+         rebalance_out,rebalance_in,intervals)
+        VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)
+        ON CONFLICT (station_id, hour) DO UPDATE SET
+            neighborhood=EXCLUDED.neighborhood, classic_rentals=EXCLUDED.classic_rentals,
+            classic_returns=EXCLUDED.classic_returns, ebike_rentals=EXCLUDED.ebike_rentals,
+            ebike_returns=EXCLUDED.ebike_returns, rebalance_out=EXCLUDED.rebalance_out,
+            rebalance_in=EXCLUDED.rebalance_in, intervals=EXCLUDED.intervals`)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, f := range flows {
+		if _, err := stmt.Exec(f.StationID, nullable(f.Neighborhood), f.Hour, f.ClassicRentals,
+			f.ClassicReturns, f.EBikeRentals, f.EBikeReturns, f.RebalanceOut, f.RebalanceIn,
+			f.Intervals); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// recordFlows feeds one full poll to the ingester's FlowInferrer and upserts any hour
+// that has closed. Non-fatal: a failed write only loses that hour's flows, never the
+// dock_status rows.
+func (c *Client) recordFlows(db *sql.DB, data []types.NormalizedStationDataTS) {
+	if c.flows == nil || len(data) == 0 {
+		return
+	}
+	for _, d := range data {
+		c.flows.Observe(d)
+	}
+	if err := upsertFlows(db, c.flows.Flush(data[0].TimeStamp)); err != nil {
+		slog.Warn("station_flows write failed (non-fatal)", logging.Error(err, "db"))
+	}
+}
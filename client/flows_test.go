@@ -0,0 +1,75 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+)
+
+// TestFlowInferrer covers demand inference: bike-count drops are rentals and rises are
+// returns (split classic/e-bike), a large single-interval jump is rebalancing, pairs
+// across a polling gap are skipped, and intervals land in the hour of the later snapshot.
+func TestFlowInferrer(t *testing.T) {
+	t0 := time.Date(2026, 6, 1, 7, 58, 0, 0, time.UTC)
+	snap := func(min, bikes, ebikes int) types.NormalizedStationDataTS {
+		return types.NormalizedStationDataTS{
+			Station:   types.NormalizedStation{ID: "a", BikesAvailable: bikes, EBikesAvailable: ebikes, IsInstalled: true},
+			TimeStamp: t0.Add(time.Duration(min) * time.Minute),
+		}
+	}
+	inf := NewFlowInferrer(8, 10*time.Minute)
+	for _, d := range []types.NormalizedStationDataTS{
+		snap(0, 10, 2),  // 07:58 baseline
+		snap(1, 9, 2),   // 07:59 one classic rental
+		snap(3, 8, 1),   // 08:01 one e-bike rental
+		snap(4, 10, 1),  // 08:02 two classic returns
+		snap(5, 20, 1),  // 08:03 +10 in one interval: rebalancing
+		snap(30, 19, 1), // 08:28 after a 25-minute gap: skipped
+	} {
+		inf.Observe(d)
+	}
+
+	closed := inf.Flush(t0.Add(3 * time.Minute))
+	if len(closed) != 1 || closed[0].ClassicRentals != 1 || closed[0].Intervals != 1 {
+		t.Fatalf("07:00 hour: %+v", closed)
+	}
+
+	rest := inf.FlushAll()
+	if len(rest) != 1 {
+		t.Fatalf("want one 08:00 bucket, got %+v", rest)
+	}
+	f := rest[0]
+	if f.EBikeRentals != 1 || f.ClassicReturns != 2 || f.ClassicRentals != 0 ||
+		f.RebalanceIn != 10 || f.Intervals != 3 {
+		t.Errorf("08:00 hour: %+v", f)
+	}
+}
+
+// TestReadSnapshotsCSV replays a file in the shape PrintStationDataCSV writes, including
+// its header-only "Status" column, and checks columns are still mapped correctly.
+func TestReadSnapshotsCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "2026-06-01.csv")
+	data := "ID,Name,Longitude,Latitude,Location,Status,BikesAvailable,EBikesAvailable,BikesDisabled," +
+		"DocksAvailable,DocksDisabled,IsReturning,IsRenting,IsInstalled,TimeStamp\n" +
+		"a,Van Brunt St,-74.01,40.67,https://maps,21,4,3,2,7,true,false,true,2026-06-01T08:00:00-04:00\n"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var got []types.NormalizedStationDataTS
+	if err := ReadSnapshots(path, func(d types.NormalizedStationDataTS) error {
+		got = append(got, d)
+		return nil
+	}); err != nil {
+		t.Fatalf("ReadSnapshots: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("want 1 row, got %d", len(got))
+	}
+	s := got[0].Station
+	if s.BikesAvailable != 21 || s.EBikesAvailable != 4 || s.DocksAvailable != 2 || s.IsRenting || !s.IsInstalled {
+		t.Errorf("columns misaligned: %+v", s)
+	}
+}
@@ -0,0 +1,413 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/logging"
+	"github.com/kardolus/citi-bike-dock-tracker/metrics"
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+// The GBFS republisher serves the tracked stations back out as a GBFS feed set, v2.3
+// under /gbfs/2.3/ and v3.0 under /gbfs/3.0/, whatever the upstream format (a TfL
+// BikePoint feed included). Each version has gbfs.json, gbfs_versions.json,
+// system_information, station_information and station_status.
+
+const (
+	DefaultGBFSAddr = ":8081"
+
+	gbfsV2 = "2.3"
+	gbfsV3 = "3.0"
+	// gbfsMaxTTL is the largest ttl the spec allows.
+	gbfsMaxTTL = 86400
+)
+
+// GBFSOptions describes the system for system_information and where the feed is served.
+type GBFSOptions struct {
+	Addr string
+	// BaseURL is the public URL /gbfs/ is served under, for the URLs in gbfs.json. Empty
+	// derives it from each request's Host (and X-Forwarded-Proto).
+	BaseURL      string
+	SystemID     string
+	Name         string
+	Language     string // e.g. "en"
+	Timezone     string // IANA, e.g. "Europe/London"
+	Operator     string
+	ContactEmail string // feed_contact_email; required by v3.0
+}
+
+// gbfsSnapshot is everything one poll publishes. The handler only reads snapshots, so
+// polling never races a request.
+type gbfsSnapshot struct {
+	stations      []types.StationEntity // sorted by station_id
+	status        []types.NormalizedStationDataTS
+	infoUpdated   time.Time
+	statusUpdated time.Time // the feed's last_updated, or the poll time when it has none
+	nextInfo      time.Time // when station_information is next refreshed
+	nextStatus    time.Time // when station_status is next polled
+}
+
+type gbfsFeed struct {
+	opts    GBFSOptions
+	started time.Time
+	mu      sync.RWMutex
+	snap    *gbfsSnapshot
+}
+
+func (f *gbfsFeed) set(s *gbfsSnapshot) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.snap = s
+}
+
+func (f *gbfsFeed) get() *gbfsSnapshot {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.snap
+}
+
+// ServeGBFS polls the feed every interval and serves the result as GBFS until the
+// listener fails.
+func (c *Client) ServeGBFS(opts GBFSOptions) error {
+	if opts.Addr == "" {
+		opts.Addr = DefaultGBFSAddr
+	}
+	if opts.Language == "" {
+		opts.Language = "en"
+	}
+	if opts.ContactEmail == "" {
+		slog.Warn("gbfs: no contact email; the v3.0 system_information requires feed_contact_email")
+	}
+	feed := &gbfsFeed{opts: opts, started: time.Now()}
+	errs := make(chan error, 1)
+	go func() {
+		srv := &http.Server{Addr: opts.Addr, Handler: feed.handler(), ReadHeaderTimeout: 10 * time.Second}
+		errs <- srv.ListenAndServe()
+	}()
+	slog.Info("gbfs: serving", logging.KeyStations, len(c.stationMap), "addr", opts.Addr, "interval", time.Duration(c.interval)*time.Second)
+
+	c.mode = modeGBFS
+	c.reportConfig()
+	interval := time.Duration(c.interval) * time.Second
+	for {
+		metrics.IncPolls()
+		if c.timeProvider.Now().Sub(c.lastInfoSync) >= stationSyncInterval {
+			if err := c.refreshStations(nil); err != nil {
+				slog.Warn("station refresh failed (non-fatal, retrying next poll)", errorAttrs(err, "stations")...)
+			}
+		}
+		stationData, err := c.gatherStationData()
+		if err != nil {
+			metrics.IncFetchError()
+			slog.Error("fetch failed", errorAttrs(err, "fetch")...)
+		} else {
+			now := time.Now()
+			feed.set(c.snapshotGBFS(stationData, now, interval))
+			metrics.SetStations(len(stationData))
+			metrics.MarkSuccess(now)
+		}
+		select {
+		case err := <-errs:
+			return err
+		case <-time.After(interval):
+		}
+	}
+}
+
+// snapshotGBFS captures one poll along with the station set it was matched against.
+func (c *Client) snapshotGBFS(data []types.NormalizedStationDataTS, now time.Time, interval time.Duration) *gbfsSnapshot {
+	s := &gbfsSnapshot{
+		status:        data,
+		infoUpdated:   c.lastInfoSync,
+		statusUpdated: c.lastFeedUpdate,
+		nextInfo:      c.lastInfoSync.Add(stationSyncInterval),
+		nextStatus:    now.Add(interval),
+	}
+	if s.statusUpdated.IsZero() {
+		s.statusUpdated = now
+	}
+	if s.infoUpdated.IsZero() {
+		// station_information as of Build, before the first refresh
+		s.infoUpdated, s.nextInfo = now, now
+	}
+	for _, st := range c.stationMap {
+		s.stations = append(s.stations, st)
+	}
+	sort.Slice(s.stations, func(i, j int) bool { return s.stations[i].StationID < s.stations[j].StationID })
+	return s
+}
+
+// gbfsTTL is the whole seconds until next, within the range the spec allows.
+func gbfsTTL(next, now time.Time) int {
+	ttl := int(math.Ceil(next.Sub(now).Seconds()))
+	switch {
+	case ttl < 0:
+		return 0
+	case ttl > gbfsMaxTTL:
+		return gbfsMaxTTL
+	}
+	return ttl
+}
+
+// gbfsFiles are the feeds each version publishes besides gbfs.json, in the order
+// gbfs.json lists them.
+var gbfsFiles = []string{"gbfs_versions", "system_information", "station_information", "station_status"}
+
+func (f *gbfsFeed) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/gbfs/", f.serve)
+	return mux
+}
+
+// serve answers /gbfs/2.3/gbfs.json, /gbfs/2.3/gbfs_versions.json,
+// /gbfs/2.3/<lang>/<file>.json and /gbfs/3.0/<file>.json.
+func (f *gbfsFeed) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	version, file, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/gbfs/"), "/")
+	if !ok || (version != gbfsV2 && version != gbfsV3) {
+		http.NotFound(w, r)
+		return
+	}
+	if version == gbfsV2 && file != "gbfs.json" && file != "gbfs_versions.json" {
+		// v2.3 keeps the per-language feeds under a language directory
+		var lang string
+		if lang, file, ok = strings.Cut(file, "/"); !ok || lang != f.opts.Language {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	name := strings.TrimSuffix(file, ".json")
+	if name == file || (name != "gbfs" && !contains(gbfsFiles, name)) {
+		http.NotFound(w, r)
+		return
+	}
+	snap := f.get()
+	if snap == nil {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "no successful poll yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	now := time.Now()
+	updated, next, data := f.started, now.Add(time.Hour), interface{}(nil)
+	switch name {
+	case "gbfs":
+		data = f.discovery(version, f.baseURL(r))
+	case "gbfs_versions":
+		data = f.versions(f.baseURL(r))
+	case "system_information":
+		data = f.systemInformation(version)
+	case "station_information":
+		updated, next, data = snap.infoUpdated, snap.nextInfo, stationInformation(version, f.opts.Language, snap.stations)
+	case "station_status":
+		updated, next, data = snap.statusUpdated, snap.nextStatus, stationStatus(version, snap)
+	}
+	ttl := gbfsTTL(next, now)
+	out := map[string]interface{}{"ttl": ttl, "version": version, "data": data}
+	if version == gbfsV2 {
+		out["last_updated"] = updated.Unix()
+	} else {
+		out["last_updated"] = updated.UTC().Format(time.RFC3339)
+	}
+	body, err := json.Marshal(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", ttl))
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write(append(body, '\n'))
+}
+
+func (f *gbfsFeed) baseURL(r *http.Request) string {
+	if f.opts.BaseURL != "" {
+		return strings.TrimSuffix(f.opts.BaseURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p := r.Header.Get("X-Forwarded-Proto"); p == "http" || p == "https" {
+		scheme = p
+	}
+	return scheme + "://" + r.Host + "/gbfs"
+}
+
+func (f *gbfsFeed) fileURL(base, version, name string) string {
+	if version == gbfsV2 && name != "gbfs" && name != "gbfs_versions" {
+		return fmt.Sprintf("%s/%s/%s/%s.json", base, version, f.opts.Language, name)
+	}
+	return fmt.Sprintf("%s/%s/%s.json", base, version, name)
+}
+
+type gbfsFeedURL struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+func (f *gbfsFeed) discovery(version, base string) interface{} {
+	feeds := make([]gbfsFeedURL, 0, len(gbfsFiles))
+	for _, name := range gbfsFiles {
+		feeds = append(feeds, gbfsFeedURL{Name: name, URL: f.fileURL(base, version, name)})
+	}
+	if version == gbfsV2 {
+		return map[string]interface{}{f.opts.Language: map[string]interface{}{"feeds": feeds}}
+	}
+	return map[string]interface{}{"feeds": feeds}
+}
+
+func (f *gbfsFeed) versions(base string) interface{} {
+	type entry struct {
+		Version string `json:"version"`
+		URL     string `json:"url"`
+	}
+	return map[string]interface{}{"versions": []entry{
+		{gbfsV2, f.fileURL(base, gbfsV2, "gbfs")},
+		{gbfsV3, f.fileURL(base, gbfsV3, "gbfs")},
+	}}
+}
+
+// localized is a v3.0 localized string.
+type localized []struct {
+	Text     string `json:"text"`
+	Language string `json:"language"`
+}
+
+func localize(text, lang string) localized {
+	return localized{{Text: text, Language: lang}}
+}
+
+func (f *gbfsFeed) systemInformation(version string) interface{} {
+	o := f.opts
+	if version == gbfsV2 {
+		return struct {
+			SystemID     string `json:"system_id"`
+			Language     string `json:"language"`
+			Name         string `json:"name"`
+			Operator     string `json:"operator,omitempty"`
+			Timezone     string `json:"timezone"`
+			ContactEmail string `json:"feed_contact_email,omitempty"`
+		}{o.SystemID, o.Language, o.Name, o.Operator, o.Timezone, o.ContactEmail}
+	}
+	info := struct {
+		SystemID     string    `json:"system_id"`
+		Languages    []string  `json:"languages"`
+		Name         localized `json:"name"`
+		Operator     localized `json:"operator,omitempty"`
+		OpeningHours string    `json:"opening_hours"`
+		ContactEmail string    `json:"feed_contact_email"`
+		Timezone     string    `json:"timezone"`
+	}{
+		SystemID: o.SystemID, Languages: []string{o.Language}, Name: localize(o.Name, o.Language),
+		OpeningHours: "24/7", ContactEmail: o.ContactEmail, Timezone: o.Timezone,
+	}
+	if o.Operator != "" {
+		info.Operator = localize(o.Operator, o.Language)
+	}
+	return info
+}
+
+func stationInformation(version, lang string, stations []types.StationEntity) interface{} {
+	type v2Station struct {
+		StationID string  `json:"station_id"`
+		Name      string  `json:"name"`
+		ShortName string  `json:"short_name,omitempty"`
+		Lat       float64 `json:"lat"`
+		Lon       float64 `json:"lon"`
+		RegionID  string  `json:"region_id,omitempty"`
+		Capacity  int     `json:"capacity,omitempty"`
+	}
+	type v3Station struct {
+		StationID string    `json:"station_id"`
+		Name      localized `json:"name"`
+		ShortName localized `json:"short_name,omitempty"`
+		Lat       float64   `json:"lat"`
+		Lon       float64   `json:"lon"`
+		RegionID  string    `json:"region_id,omitempty"`
+		Capacity  int       `json:"capacity,omitempty"`
+	}
+	if version == gbfsV2 {
+		out := make([]v2Station, 0, len(stations))
+		for _, s := range stations {
+			out = append(out, v2Station{s.StationID, s.Name.String(), s.ShortName.String(), s.Lat, s.Lon, s.RegionID, s.Capacity})
+		}
+		return map[string]interface{}{"stations": out}
+	}
+	out := make([]v3Station, 0, len(stations))
+	for _, s := range stations {
+		st := v3Station{StationID: s.StationID, Name: localize(s.Name.String(), lang), Lat: s.Lat, Lon: s.Lon,
+			RegionID: s.RegionID, Capacity: s.Capacity}
+		if s.ShortName != "" {
+			st.ShortName = localize(s.ShortName.String(), lang)
+		}
+		out = append(out, st)
+	}
+	return map[string]interface{}{"stations": out}
+}
+
+// stationStatus renders the poll. Neither version has a standard e-bike count without
+// vehicle_types.json, so both carry num_ebikes_available the way Lyft's feeds do.
+// last_reported is the feed's last_updated, since per-station report times aren't kept.
+func stationStatus(version string, snap *gbfsSnapshot) interface{} {
+	type v2Station struct {
+		StationID          string `json:"station_id"`
+		NumBikesAvailable  int    `json:"num_bikes_available"`
+		NumEbikesAvailable int    `json:"num_ebikes_available"`
+		NumBikesDisabled   int    `json:"num_bikes_disabled"`
+		NumDocksAvailable  int    `json:"num_docks_available"`
+		NumDocksDisabled   int    `json:"num_docks_disabled"`
+		IsInstalled        bool   `json:"is_installed"`
+		IsRenting          bool   `json:"is_renting"`
+		IsReturning        bool   `json:"is_returning"`
+		LastReported       int64  `json:"last_reported"`
+	}
+	type v3Station struct {
+		StationID            string `json:"station_id"`
+		NumVehiclesAvailable int    `json:"num_vehicles_available"`
+		NumEbikesAvailable   int    `json:"num_ebikes_available"`
+		NumVehiclesDisabled  int    `json:"num_vehicles_disabled"`
+		NumDocksAvailable    int    `json:"num_docks_available"`
+		NumDocksDisabled     int    `json:"num_docks_disabled"`
+		IsInstalled          bool   `json:"is_installed"`
+		IsRenting            bool   `json:"is_renting"`
+		IsReturning          bool   `json:"is_returning"`
+		LastReported         string `json:"last_reported"`
+	}
+	if version == gbfsV2 {
+		out := make([]v2Station, 0, len(snap.status))
+		for _, d := range snap.status {
+			s := d.Station
+			out = append(out, v2Station{s.ID, s.BikesAvailable, s.EBikesAvailable, s.BikesDisabled, s.DocksAvailable,
+				s.DocksDisabled, s.IsInstalled, s.IsRenting, s.IsReturning, snap.statusUpdated.Unix()})
+		}
+		return map[string]interface{}{"stations": out}
+	}
+	reported := snap.statusUpdated.UTC().Format(time.RFC3339)
+	out := make([]v3Station, 0, len(snap.status))
+	for _, d := range snap.status {
+		s := d.Station
+		out = append(out, v3Station{s.ID, s.BikesAvailable, s.EBikesAvailable, s.BikesDisabled, s.DocksAvailable,
+			s.DocksDisabled, s.IsInstalled, s.IsRenting, s.IsReturning, reported})
+	}
+	return map[string]interface{}{"stations": out}
+}
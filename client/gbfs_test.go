@@ -0,0 +1,115 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+)
+
+// TestGBFSFeed fetches every file of both versions and checks the shape consumers rely on.
+func TestGBFSFeed(t *testing.T) {
+	now := time.Now()
+	f := &gbfsFeed{
+		opts:    GBFSOptions{SystemID: "london", Name: "Santander Cycles", Language: "en", Timezone: "Europe/London"},
+		started: now.Add(-time.Hour),
+	}
+	h := f.handler()
+	get := func(path string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = "feeds.example"
+		h.ServeHTTP(rec, req)
+		var body map[string]interface{}
+		_ = json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec, body
+	}
+
+	if rec, _ := get("/gbfs/2.3/gbfs.json"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("before the first poll: got %d, want 503", rec.Code)
+	}
+
+	updated := now.Add(-20 * time.Second).Truncate(time.Second)
+	f.set(&gbfsSnapshot{
+		stations: []types.StationEntity{{StationID: "BikePoints_1", Name: "River Street", Lat: 51.5, Lon: -0.1, Capacity: 19}},
+		status: []types.NormalizedStationDataTS{{Station: types.NormalizedStation{
+			ID: "BikePoints_1", BikesAvailable: 5, EBikesAvailable: 2, DocksAvailable: 14, IsInstalled: true, IsRenting: true, IsReturning: true,
+		}}},
+		infoUpdated:   updated,
+		statusUpdated: updated,
+		nextInfo:      now.Add(30 * time.Minute),
+		nextStatus:    now.Add(40 * time.Second),
+	})
+
+	rec, body := get("/gbfs/2.3/gbfs.json")
+	feeds := body["data"].(map[string]interface{})["en"].(map[string]interface{})["feeds"].([]interface{})
+	if len(feeds) != 4 || feeds[3].(map[string]interface{})["url"] != "http://feeds.example/gbfs/2.3/en/station_status.json" {
+		t.Errorf("v2.3 discovery: %v", feeds)
+	}
+	if rec.Header().Get("Cache-Control") == "" || body["version"] != "2.3" {
+		t.Errorf("v2.3 discovery headers %v, version %v", rec.Header(), body["version"])
+	}
+
+	rec, body = get("/gbfs/2.3/en/station_status.json")
+	if body["last_updated"] != float64(updated.Unix()) {
+		t.Errorf("v2.3 last_updated %v, want %d", body["last_updated"], updated.Unix())
+	}
+	if ttl := body["ttl"].(float64); ttl < 39 || ttl > 40 {
+		t.Errorf("station_status ttl %v, want the 40s until the next poll", ttl)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "public, max-age=40" && got != "public, max-age=39" {
+		t.Errorf("Cache-Control %q", got)
+	}
+	st := body["data"].(map[string]interface{})["stations"].([]interface{})[0].(map[string]interface{})
+	if st["num_bikes_available"] != 5.0 || st["is_renting"] != true || st["last_reported"] != float64(updated.Unix()) {
+		t.Errorf("v2.3 station: %v", st)
+	}
+
+	_, body = get("/gbfs/3.0/station_information.json")
+	if body["last_updated"] != updated.UTC().Format(time.RFC3339) {
+		t.Errorf("v3.0 last_updated %v", body["last_updated"])
+	}
+	st = body["data"].(map[string]interface{})["stations"].([]interface{})[0].(map[string]interface{})
+	name := st["name"].([]interface{})[0].(map[string]interface{})
+	if name["text"] != "River Street" || name["language"] != "en" || st["capacity"] != 19.0 {
+		t.Errorf("v3.0 station: %v", st)
+	}
+
+	_, body = get("/gbfs/3.0/station_status.json")
+	st = body["data"].(map[string]interface{})["stations"].([]interface{})[0].(map[string]interface{})
+	if st["num_vehicles_available"] != 5.0 || st["last_reported"] != updated.UTC().Format(time.RFC3339) {
+		t.Errorf("v3.0 status: %v", st)
+	}
+
+	_, body = get("/gbfs/3.0/system_information.json")
+	info := body["data"].(map[string]interface{})
+	if info["opening_hours"] != "24/7" || info["languages"].([]interface{})[0] != "en" {
+		t.Errorf("v3.0 system_information: %v", info)
+	}
+
+	for _, path := range []string{"/gbfs/2.3/fr/station_status.json", "/gbfs/3.0/en/station_status.json", "/gbfs/1.1/gbfs.json", "/gbfs/3.0/free_bike_status.json"} {
+		if rec, _ := get(path); rec.Code != http.StatusNotFound {
+			t.Errorf("%s: got %d, want 404", path, rec.Code)
+		}
+	}
+}
+
+// TestGBFSTTL covers rounding ttl up and clamping it to what the spec allows.
+func TestGBFSTTL(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	for _, tc := range []struct {
+		next time.Time
+		want int
+	}{
+		{now.Add(59500 * time.Millisecond), 60},
+		{now.Add(-time.Second), 0},
+		{now.Add(48 * time.Hour), gbfsMaxTTL},
+	} {
+		if got := gbfsTTL(tc.next, now); got != tc.want {
+			t.Errorf("gbfsTTL(%s) = %d, want %d", tc.next.Sub(now), got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/logging"
+	"github.com/kardolus/citi-bike-dock-tracker/metrics"
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+const (
+	// leaderLockNamespace is the first key of the two-key advisory lock ("dock"); the
+	// second is hashtext(CITY_ID), so each city elects its own leader.
+	leaderLockNamespace = 0x646f636b
+	leaderLockTimeout   = 10 * time.Second
+)
+
+// leaderLock is the ingester's leader election: a session-level Postgres advisory lock
+// held on one pinned connection. Postgres releases it the moment that session ends
+// (the leader exits, crashes, or loses its connection), and standbys try to take it on
+// every poll, so a standby takes over within one interval.
+type leaderLock struct {
+	db       *sql.DB
+	key      string
+	conn     *sql.Conn // the session holding the lock; nil while standing by
+	acquired bool      // the last hold took the lock afresh rather than finding it held
+	held     bool      // the last hold found another replica holding the lock
+}
+
+func newLeaderLock(db *sql.DB, key string) *leaderLock {
+	return &leaderLock{db: db, key: key}
+}
+
+// hold reports whether this process holds the lock, trying to take it if not. A
+// leader whose lock session died has lost the lock (another replica may have it by
+// now), so it drops the session and competes for the lock again like a standby.
+func (l *leaderLock) hold() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), leaderLockTimeout)
+	defer cancel()
+	l.acquired, l.held = false, false
+	if l.conn != nil {
+		if _, err := l.conn.ExecContext(ctx, "SELECT 1"); err == nil {
+			return true, nil
+		}
+		_ = l.conn.Close()
+		l.conn = nil
+	}
+
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1, hashtext($2))",
+		leaderLockNamespace, l.key).Scan(&acquired); err != nil {
+		_ = conn.Close()
+		return false, err
+	}
+	if !acquired {
+		_ = conn.Close()
+		l.held = true
+		return false, nil
+	}
+	l.conn, l.acquired = conn, true
+	return true, nil
+}
+
+// holdLeader is a poll's lock check, reporting whether this replica writes the poll.
+// A failed check means the database is unreachable, not that another replica holds
+// the lock: a leader then carries on, so its batches go to the spool (see writeBatch)
+// instead of becoming a gap, and finds out whether it's still leader when the
+// database is back.
+func (c *Client) holdLeader(lock *leaderLock) bool {
+	leader, err := lock.hold()
+	if err == nil {
+		return leader
+	}
+	if c.leader {
+		slog.Warn("leader lock check failed (still leading; writes spool until the database is back)", logging.Error(err, "db"))
+		return true
+	}
+	slog.Warn("leader lock check failed (standing by)", logging.Error(err, "db"))
+	return false
+}
+
+// setSpoolAside moves a standby's spool out of the way (see Spool.SetAside): whatever
+// it spooled while leading may be written by the replica that leads now. It's only
+// called once another replica is known to hold the lock; a replica that merely can't
+// reach the database keeps its spool.
+func (c *Client) setSpoolAside() {
+	if c.spool == nil || c.spool.Len() == 0 {
+		return
+	}
+	rows, err := c.spool.SetAside()
+	if err != nil {
+		metrics.Errors.Inc("spool")
+		slog.Warn("spool: setting the spool aside failed (retrying next poll)", logging.Error(err, "spool"))
+		return
+	}
+	slog.Warn("spool: not leading; set the spooled rows aside instead of replaying them later",
+		"rows", rows, "dir", c.spool.dir)
+}
+
+// release gives the lock up on the way out, so a standby needn't wait for Postgres to
+// notice the session is gone.
+func (l *leaderLock) release() {
+	if l.conn == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), leaderLockTimeout)
+	defer cancel()
+	_, _ = l.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1, hashtext($2))", leaderLockNamespace, l.key)
+	_ = l.conn.Close()
+	l.conn = nil
+}
+
+// standbyPoll is a standby's poll: it fetches the feed, so /ready and the fetch metrics
+// show it's healthy and able to take over, and keeps its station set current, but
+// writes nothing.
+func (c *Client) standbyPoll() {
+	if c.timeProvider.Now().Sub(c.lastInfoSync) >= stationSyncInterval {
+		if err := c.refreshStations(nil); err != nil {
+			slog.Warn("station refresh failed (non-fatal, retrying next poll)", errorAttrs(err, "stations")...)
+		}
+	}
+	stationData, err := c.gatherStationData()
+	if err != nil {
+		metrics.IncFetchError()
+		slog.Error("fetch failed", errorAttrs(err, "fetch")...)
+		return
+	}
+	c.publish(stationData)
+	metrics.SetStations(len(stationData))
+	metrics.MarkSuccess(c.timeProvider.Now())
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestLeaderSpoolsWhenDatabaseUnreachable checks that a leader that can't reach the
+// database to check its lock keeps polling and spools its batches, while a standby
+// stays on standby, and that a leader that then stands down sets its spool aside.
+func TestLeaderSpoolsWhenDatabaseUnreachable(t *testing.T) {
+	// nothing listens on port 1, so every connection is refused
+	db, err := sql.Open("postgres", "postgres://dockscan@127.0.0.1:1/dockscan?sslmode=disable&connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	spool, err := OpenSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock := newLeaderLock(db, "nyc")
+
+	standby := &Client{}
+	if standby.holdLeader(lock) {
+		t.Error("a standby took the leader role without the lock")
+	}
+	if lock.held {
+		t.Error("an unreachable database counted as another replica holding the lock")
+	}
+
+	c := &Client{leader: true, spool: spool}
+	if !c.holdLeader(lock) {
+		t.Fatal("the leader stood down when the database became unreachable")
+	}
+	t0 := time.Date(2023, 7, 23, 8, 0, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		if written, err := c.writeBatch(db, spoolBatch(t0.Add(time.Duration(i)*time.Minute), "a", "b")); err == nil || written != 0 {
+			t.Fatalf("writeBatch: written=%d err=%v, want 0 and an error", written, err)
+		}
+	}
+	if spool.Len() != 4 {
+		t.Errorf("spooled %d rows, want 4", spool.Len())
+	}
+
+	// it then loses the lock: the spool is set aside, not kept for when it next leads
+	c.leader = false
+	c.setSpoolAside()
+	if spool.Len() != 0 {
+		t.Errorf("standby still holds %d spooled rows", spool.Len())
+	}
+	aside, _ := filepath.Glob(filepath.Join(spool.dir, "*.unreplayed"))
+	if len(aside) != 1 {
+		t.Fatalf("set-aside files: %v", aside)
+	}
+	reopened, err := OpenSpool(spool.dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Len() != 0 {
+		t.Errorf("a restart would replay %d set-aside rows", reopened.Len())
+	}
+}
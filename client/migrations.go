@@ -0,0 +1,340 @@
+package client
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+// migration is one ordered, checksummed schema change. Versions start at 1 and are
+// never reused or edited once released: the checksum of Up is recorded when it is
+// applied, and a binary whose copy differs refuses to run against that database. An
+// empty Down marks a migration that can't be rolled back (it would destroy data).
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// migrations is the full schema history. Migration 1 is the ad-hoc DDL the ingester
+// used to re-run on every start; it is idempotent, so applying it to a database that
+// predates migrations just records the baseline.
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "baseline dock_status and app_metadata",
+		Up: createDockStatusTable + `
+CREATE TABLE IF NOT EXISTS app_metadata (key text PRIMARY KEY, value text NOT NULL);
+`,
+	},
+	{
+		Version: 2,
+		Name:    "station_flows",
+		Up:      createStationFlowsTable,
+		Down:    `DROP TABLE IF EXISTS station_flows;`,
+	},
+	{
+		Version: 3,
+		Name:    "trips",
+		Up:      createTripsTable,
+		Down:    `DROP TABLE IF EXISTS trips;`,
+	},
+	{
+		Version: 4,
+		Name:    "stations dimension and dock_status_wide",
+		Up: createStationsTable + `
+ALTER TABLE dock_status ALTER COLUMN name DROP NOT NULL;
+` + createDockStatusWideView,
+		Down: dropStationsDimension,
+	},
+	{
+		Version: 5,
+		Name:    "poll_log",
+		Up:      createPollLogTable,
+		Down:    `DROP TABLE IF EXISTS poll_log;`,
+	},
+	{
+		Version: 6,
+		Name:    "neighborhood_areas",
+		Up:      createNeighborhoodAreasTable,
+		// area_daily (created by the ingester, see rollups.go) reads neighborhood_areas
+		Down: `DROP VIEW IF EXISTS area_daily; DROP TABLE IF EXISTS neighborhood_areas;`,
+	},
+	{
+		Version: 7,
+		Name:    "city_id for shared databases",
+		Up:      addCityColumns,
+		Down:    dropCityColumns,
+	},
+	{
+		Version: 8,
+		Name:    "station_outages",
+		Up:      createStationOutagesTable,
+		Down:    dropStationOutagesTable,
+	},
+}
+
+// migrationLockKey serializes concurrent `db migrate` runs (e.g. two pods' init
+// containers) via pg_advisory_xact_lock.
+const migrationLockKey = 7320158426
+
+const createSchemaMigrationsTable = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version    integer     PRIMARY KEY,
+    name       text        NOT NULL,
+    checksum   text        NOT NULL,
+    applied_at timestamptz NOT NULL DEFAULT now()
+);
+`
+
+func (m migration) checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+// LatestSchemaVersion is the schema version this binary expects.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// MigrationState is one row of `db status`.
+type MigrationState struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+	Modified  bool // applied with a different checksum than this binary's copy
+	Unknown   bool // applied in the database but not known to this binary (DB is ahead)
+}
+
+type appliedMigration struct {
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+func loadApplied(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}) (map[int]appliedMigration, error) {
+	rows, err := q.Query("SELECT version, name, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var v int
+		var a appliedMigration
+		if err := rows.Scan(&v, &a.name, &a.checksum, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		applied[v] = a
+	}
+	return applied, rows.Err()
+}
+
+// schemaStates merges the known migrations with what the database has applied.
+func schemaStates(applied map[int]appliedMigration) []MigrationState {
+	var out []MigrationState
+	known := make(map[int]bool, len(migrations))
+	for _, m := range migrations {
+		known[m.Version] = true
+		st := MigrationState{Version: m.Version, Name: m.Name}
+		if a, ok := applied[m.Version]; ok {
+			st.Applied, st.AppliedAt = true, a.appliedAt
+			st.Modified = a.checksum != m.checksum()
+		}
+		out = append(out, st)
+	}
+	for v, a := range applied {
+		if !known[v] {
+			out = append(out, MigrationState{Version: v, Name: a.name, Applied: true, AppliedAt: a.appliedAt, Unknown: true})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out
+}
+
+// schemaDrift explains why a database can't be used by this binary, or returns nil
+// when every known migration is applied unmodified and nothing newer is.
+func schemaDrift(states []MigrationState) error {
+	var pending int
+	for _, st := range states {
+		switch {
+		case st.Unknown:
+			return fmt.Errorf("database schema is ahead of this binary (has migration %d %q, binary knows up to %d) — upgrade dockscan",
+				st.Version, st.Name, LatestSchemaVersion())
+		case st.Modified:
+			return fmt.Errorf("migration %d %q was changed after it was applied (checksum mismatch)", st.Version, st.Name)
+		case !st.Applied:
+			pending++
+		}
+	}
+	if pending > 0 {
+		return fmt.Errorf("database schema is behind this binary (%d pending migrations) — run `dockscan db migrate`", pending)
+	}
+	return nil
+}
+
+// ensureSchemaCurrent is the start-up gate for everything that writes to Postgres.
+func ensureSchemaCurrent(db *sql.DB) error {
+	if _, err := db.Exec(createSchemaMigrationsTable); err != nil {
+		return fmt.Errorf("schema_migrations: %w", err)
+	}
+	applied, err := loadApplied(db)
+	if err != nil {
+		return err
+	}
+	return schemaDrift(schemaStates(applied))
+}
+
+// SchemaStatus reports every known (and unknown) migration and whether it's applied.
+func SchemaStatus(dsn string) ([]MigrationState, error) {
+	db, err := openPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if _, err := db.Exec(createSchemaMigrationsTable); err != nil {
+		return nil, err
+	}
+	applied, err := loadApplied(db)
+	if err != nil {
+		return nil, err
+	}
+	return schemaStates(applied), nil
+}
+
+// Migrate applies pending migrations in order up to target (0 = latest), each in its
+// own transaction under an advisory lock. It returns the versions it applied.
+func Migrate(dsn string, target int) ([]int, error) {
+	if target <= 0 {
+		target = LatestSchemaVersion()
+	}
+	db, err := openPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if _, err := db.Exec(createSchemaMigrationsTable); err != nil {
+		return nil, err
+	}
+
+	var done []int
+	for _, m := range migrations {
+		if m.Version > target {
+			break
+		}
+		ran, err := applyMigration(db, m)
+		if err != nil {
+			return done, fmt.Errorf("migration %d %q: %w", m.Version, m.Name, err)
+		}
+		if ran {
+			slog.Info("migrated", "version", m.Version, "name", m.Name)
+			done = append(done, m.Version)
+		}
+	}
+	return done, nil
+}
+
+func applyMigration(db *sql.DB, m migration) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockKey); err != nil {
+		return false, err
+	}
+	// re-check under the lock: another migrator may have got here first
+	applied, err := loadApplied(tx)
+	if err != nil {
+		return false, err
+	}
+	if a, ok := applied[m.Version]; ok {
+		if a.checksum != m.checksum() {
+			return false, errors.New("already applied with a different checksum")
+		}
+		return false, nil
+	}
+	if _, err := tx.Exec(m.Up); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)",
+		m.Version, m.Name, m.checksum()); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// Rollback reverts the most recently applied `steps` migrations, newest first. It
+// stops at (and refuses) a migration without a Down.
+func Rollback(dsn string, steps int) ([]int, error) {
+	db, err := openPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if _, err := db.Exec(createSchemaMigrationsTable); err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]migration, len(migrations))
+	for _, m := range migrations {
+		byVersion[m.Version] = m
+	}
+
+	var undone []int
+	for i := 0; i < steps; i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return undone, err
+		}
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockKey); err != nil {
+			_ = tx.Rollback()
+			return undone, err
+		}
+		var latest sql.NullInt64
+		if err := tx.QueryRow("SELECT max(version) FROM schema_migrations").Scan(&latest); err != nil {
+			_ = tx.Rollback()
+			return undone, err
+		}
+		if !latest.Valid {
+			_ = tx.Rollback()
+			if undone == nil {
+				return nil, errors.New("no migrations applied")
+			}
+			return undone, nil
+		}
+		v := int(latest.Int64)
+		m, ok := byVersion[v]
+		if !ok {
+			_ = tx.Rollback()
+			return undone, fmt.Errorf("migration %d is not known to this binary; roll back with the binary that applied it", v)
+		}
+		if m.Down == "" {
+			_ = tx.Rollback()
+			return undone, fmt.Errorf("migration %d %q can't be rolled back", m.Version, m.Name)
+		}
+		if _, err := tx.Exec(m.Down); err != nil {
+			_ = tx.Rollback()
+			return undone, fmt.Errorf("rollback %d: %w", m.Version, err)
+		}
+		if _, err := tx.Exec("DELETE FROM schema_migrations WHERE version = $1", m.Version); err != nil {
+			_ = tx.Rollback()
+			return undone, err
+		}
+		if err := tx.Commit(); err != nil {
+			return undone, err
+		}
+		slog.Info("rolled back", "version", m.Version, "name", m.Name)
+		undone = append(undone, m.Version)
+	}
+	return undone, nil
+}
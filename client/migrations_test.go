@@ -0,0 +1,53 @@
+package client
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestMigrationsOrdered guards the migration list itself: versions must run 1..N with
+// no gaps or reuse, since schema_migrations records them by number.
+func TestMigrationsOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Fatalf("migration at index %d has version %d, want %d", i, m.Version, i+1)
+		}
+		if m.Name == "" || strings.TrimSpace(m.Up) == "" {
+			t.Errorf("migration %d needs a name and an Up script", m.Version)
+		}
+	}
+}
+
+// TestSchemaDrift covers the ingester's start-up gate: a current database passes, and
+// a database that is behind, ahead, or was migrated with different SQL is refused.
+func TestSchemaDrift(t *testing.T) {
+	all := func() map[int]appliedMigration {
+		applied := make(map[int]appliedMigration)
+		for _, m := range migrations {
+			applied[m.Version] = appliedMigration{name: m.Name, checksum: m.checksum()}
+		}
+		return applied
+	}
+
+	if err := schemaDrift(schemaStates(all())); err != nil {
+		t.Errorf("current schema should pass: %v", err)
+	}
+
+	behind := all()
+	delete(behind, LatestSchemaVersion())
+	if err := schemaDrift(schemaStates(behind)); err == nil || !strings.Contains(err.Error(), "behind") {
+		t.Errorf("behind: got %v", err)
+	}
+
+	ahead := all()
+	ahead[LatestSchemaVersion()+1] = appliedMigration{name: "from the future", checksum: "x"}
+	if err := schemaDrift(schemaStates(ahead)); err == nil || !strings.Contains(err.Error(), "ahead") {
+		t.Errorf("ahead: got %v", err)
+	}
+
+	modified := all()
+	modified[1] = appliedMigration{name: migrations[0].Name, checksum: "edited"}
+	if err := schemaDrift(schemaStates(modified)); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("modified: got %v", err)
+	}
+}
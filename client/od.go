@@ -0,0 +1,237 @@
+package client
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// OD matrix levels.
+const (
+	ODLevelNeighborhood = "neighborhood"
+	ODLevelArea         = "area"
+)
+
+// ODCell is one origin→destination count for one hour of the week (0 = Monday
+// 00:00–00:59 local time, 167 = Sunday 23:00–23:59).
+type ODCell struct {
+	Origin      string `json:"origin"`
+	Destination string `json:"destination"`
+	HourOfWeek  int    `json:"hourOfWeek"`
+	Trips       int    `json:"trips"`
+}
+
+// ODNode is a matrix row/column label: a neighborhood (or an area rolled up from its
+// neighborhoods) with the centroid used to draw flow lines.
+type ODNode struct {
+	Slug     string     `json:"slug"`
+	Display  string     `json:"display"`
+	Area     string     `json:"area,omitempty"`
+	Centroid [2]float64 `json:"centroid"` // [lat, lon]
+}
+
+// ODMatrix is a sparse origin–destination matrix by hour of week.
+type ODMatrix struct {
+	Level string    `json:"level"`
+	From  time.Time `json:"from"`
+	To    time.Time `json:"to"`
+	Nodes []ODNode  `json:"nodes"`
+	Cells []ODCell  `json:"cells"`
+	nodes map[string]ODNode
+}
+
+// ODFilter narrows a matrix before export. Zero values keep everything.
+type ODFilter struct {
+	Origin   string // only trips starting here
+	Hour     *int   // only trips starting in this hour of day, 0–23
+	MinTrips int    // drop cells below this count
+}
+
+// LoadODMatrix aggregates the trips table into a neighborhood×neighborhood matrix by
+// hour of week, in loc, for trips started in [from, to). Trips with an untagged end
+// are left out.
+func LoadODMatrix(dsn string, ns []Neighborhood, from, to time.Time, loc *time.Location) (*ODMatrix, error) {
+	db, err := openPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query(`
+        SELECT start_neighborhood, end_neighborhood,
+               ((extract(isodow FROM started_at AT TIME ZONE $3)::int - 1) * 24
+                 + extract(hour FROM started_at AT TIME ZONE $3)::int) AS how,
+               count(*)
+        FROM trips
+        WHERE started_at >= $1 AND started_at < $2
+          AND start_neighborhood IS NOT NULL AND end_neighborhood IS NOT NULL
+        GROUP BY 1, 2, 3`, from, to, loc.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	m := newNeighborhoodODMatrix(ns, from, to)
+	for rows.Next() {
+		var cell ODCell
+		if err := rows.Scan(&cell.Origin, &cell.Destination, &cell.HourOfWeek, &cell.Trips); err != nil {
+			return nil, err
+		}
+		m.Cells = append(m.Cells, cell)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	m.sort()
+	return m, nil
+}
+
+func newNeighborhoodODMatrix(ns []Neighborhood, from, to time.Time) *ODMatrix {
+	m := &ODMatrix{Level: ODLevelNeighborhood, From: from, To: to, nodes: make(map[string]ODNode, len(ns))}
+	for _, n := range ns {
+		node := ODNode{Slug: n.Slug, Display: n.Display, Area: n.Area, Centroid: n.Centroid}
+		m.Nodes = append(m.Nodes, node)
+		m.nodes[n.Slug] = node
+	}
+	return m
+}
+
+// RollupToAreas returns the area×area matrix implied by a neighborhood matrix. An area's
+// centroid is the station-count-weighted mean of its neighborhoods' centroids.
+func (m *ODMatrix) RollupToAreas(ns []Neighborhood) *ODMatrix {
+	areaOf := make(map[string]string, len(ns))
+	type acc struct{ lat, lon, w float64 }
+	centroids := make(map[string]*acc)
+	for _, n := range ns {
+		areaOf[n.Slug] = n.Area
+		a, ok := centroids[n.Area]
+		if !ok {
+			a = &acc{}
+			centroids[n.Area] = a
+		}
+		w := float64(n.Count)
+		if w <= 0 {
+			w = 1
+		}
+		a.lat += n.Centroid[0] * w
+		a.lon += n.Centroid[1] * w
+		a.w += w
+	}
+
+	out := &ODMatrix{Level: ODLevelArea, From: m.From, To: m.To, nodes: make(map[string]ODNode)}
+	for area, a := range centroids {
+		node := ODNode{Slug: area, Display: area, Centroid: [2]float64{a.lat / a.w, a.lon / a.w}}
+		out.Nodes = append(out.Nodes, node)
+		out.nodes[area] = node
+	}
+	sort.Slice(out.Nodes, func(i, j int) bool { return out.Nodes[i].Slug < out.Nodes[j].Slug })
+
+	sums := make(map[ODCell]int)
+	for _, c := range m.Cells {
+		key := ODCell{Origin: areaOf[c.Origin], Destination: areaOf[c.Destination], HourOfWeek: c.HourOfWeek}
+		sums[key] += c.Trips
+	}
+	for k, n := range sums {
+		k.Trips = n
+		out.Cells = append(out.Cells, k)
+	}
+	out.sort()
+	return out
+}
+
+// Filter returns a copy of m keeping only the cells that match f.
+func (m *ODMatrix) Filter(f ODFilter) *ODMatrix {
+	out := *m
+	out.Cells = nil
+	for _, c := range m.Cells {
+		if f.Origin != "" && c.Origin != f.Origin {
+			continue
+		}
+		if f.Hour != nil && c.HourOfWeek%24 != *f.Hour {
+			continue
+		}
+		if c.Trips < f.MinTrips {
+			continue
+		}
+		out.Cells = append(out.Cells, c)
+	}
+	return &out
+}
+
+func (m *ODMatrix) sort() {
+	sort.Slice(m.Cells, func(i, j int) bool {
+		a, b := m.Cells[i], m.Cells[j]
+		if a.Origin != b.Origin {
+			return a.Origin < b.Origin
+		}
+		if a.Destination != b.Destination {
+			return a.Destination < b.Destination
+		}
+		return a.HourOfWeek < b.HourOfWeek
+	})
+}
+
+// WriteOD exports the matrix as "csv" (one row per cell), "json" (nodes + cells) or
+// "geojson" (one LineString per origin→destination pair between centroids, with trips
+// summed over the hours kept by the filter; same-node pairs have no line and are left
+// out).
+func (m *ODMatrix) WriteOD(w io.Writer, format string) error {
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"Origin", "Destination", "HourOfWeek", "Trips"})
+		for _, c := range m.Cells {
+			_ = cw.Write([]string{c.Origin, c.Destination, strconv.Itoa(c.HourOfWeek), strconv.Itoa(c.Trips)})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "json":
+		return json.NewEncoder(w).Encode(m)
+	case "geojson":
+		return json.NewEncoder(w).Encode(m.flowLines())
+	}
+	return fmt.Errorf("unknown format %q (want csv, json or geojson)", format)
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   map[string]interface{} `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+func (m *ODMatrix) flowLines() map[string]interface{} {
+	type pair struct{ o, d string }
+	sums := make(map[pair]int)
+	for _, c := range m.Cells {
+		if c.Origin != c.Destination {
+			sums[pair{c.Origin, c.Destination}] += c.Trips
+		}
+	}
+	features := make([]geoJSONFeature, 0, len(sums))
+	for p, n := range sums {
+		o, okO := m.nodes[p.o]
+		d, okD := m.nodes[p.d]
+		if !okO || !okD {
+			continue // slug no longer in the neighborhood set
+		}
+		features = append(features, geoJSONFeature{
+			Type: "Feature",
+			Geometry: map[string]interface{}{
+				"type": "LineString",
+				// GeoJSON is [lon, lat]; centroids are [lat, lon]
+				"coordinates": [][2]float64{{o.Centroid[1], o.Centroid[0]}, {d.Centroid[1], d.Centroid[0]}},
+			},
+			Properties: map[string]interface{}{"origin": p.o, "destination": p.d, "trips": n},
+		})
+	}
+	sort.Slice(features, func(i, j int) bool {
+		a, b := features[i].Properties, features[j].Properties
+		if a["trips"].(int) != b["trips"].(int) {
+			return a["trips"].(int) > b["trips"].(int)
+		}
+		return a["origin"].(string)+"\x00"+a["destination"].(string) < b["origin"].(string)+"\x00"+b["destination"].(string)
+	})
+	return map[string]interface{}{"type": "FeatureCollection", "features": features}
+}
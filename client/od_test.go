@@ -0,0 +1,75 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// TestODMatrixRollupAndExport checks the area rollup, the origin/hour filter and that
+// the GeoJSON layer draws [lon, lat] lines between centroids with summed trips.
+func TestODMatrixRollupAndExport(t *testing.T) {
+	ns := []Neighborhood{
+		{Slug: "red-hook", Area: "brooklyn", Centroid: [2]float64{40.67, -74.01}, Count: 1},
+		{Slug: "gowanus", Area: "brooklyn", Centroid: [2]float64{40.69, -73.99}, Count: 3},
+		{Slug: "soho", Area: "manhattan", Centroid: [2]float64{40.72, -74.00}, Count: 1},
+	}
+	m := newNeighborhoodODMatrix(ns, time.Time{}, time.Time{})
+	m.Cells = []ODCell{
+		{Origin: "red-hook", Destination: "gowanus", HourOfWeek: 8, Trips: 4},   // Mon 08:00
+		{Origin: "red-hook", Destination: "soho", HourOfWeek: 8, Trips: 2},      // Mon 08:00
+		{Origin: "red-hook", Destination: "soho", HourOfWeek: 24 + 8, Trips: 3}, // Tue 08:00
+		{Origin: "gowanus", Destination: "soho", HourOfWeek: 8, Trips: 5},
+		{Origin: "red-hook", Destination: "soho", HourOfWeek: 17, Trips: 9}, // Mon 17:00
+	}
+
+	areas := m.RollupToAreas(ns)
+	if len(areas.Cells) != 4 {
+		t.Fatalf("area cells: %+v", areas.Cells)
+	}
+	for _, c := range areas.Cells {
+		if c.Origin == "brooklyn" && c.Destination == "manhattan" && c.HourOfWeek == 8 && c.Trips != 7 {
+			t.Errorf("brooklyn→manhattan Mon 08: want 7, got %d", c.Trips)
+		}
+	}
+	for _, n := range areas.Nodes {
+		if n.Slug == "brooklyn" && (n.Centroid[0] != (40.67+3*40.69)/4) {
+			t.Errorf("brooklyn centroid should be count-weighted: %v", n.Centroid)
+		}
+	}
+
+	if all := m.Filter(ODFilter{}); len(all.Cells) != len(m.Cells) {
+		t.Errorf("the zero filter kept %d of %d cells", len(all.Cells), len(m.Cells))
+	}
+	eight := 8
+	morning := m.Filter(ODFilter{Origin: "red-hook", Hour: &eight})
+	if len(morning.Cells) != 3 {
+		t.Fatalf("red-hook at 8am: %+v", morning.Cells)
+	}
+
+	var buf bytes.Buffer
+	if err := morning.WriteOD(&buf, "geojson"); err != nil {
+		t.Fatal(err)
+	}
+	var fc struct {
+		Features []struct {
+			Geometry struct {
+				Coordinates [][2]float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties struct {
+				Destination string `json:"destination"`
+				Trips       int    `json:"trips"`
+			} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &fc); err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.Features) != 2 || fc.Features[0].Properties.Destination != "soho" || fc.Features[0].Properties.Trips != 5 {
+		t.Fatalf("flow lines: %s", buf.String())
+	}
+	if got := fc.Features[0].Geometry.Coordinates[0]; got != [2]float64{-74.01, 40.67} {
+		t.Errorf("line should start at red-hook's [lon, lat], got %v", got)
+	}
+}
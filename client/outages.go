@@ -0,0 +1,260 @@
+package client
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/logging"
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+// Outage kinds; see outageKinds for what each means.
+const (
+	OutageEmpty      = "empty"
+	OutageFull       = "full"
+	OutageNoEBikes   = "no_ebikes"
+	OutageNotRenting = "not_renting"
+)
+
+// Outage events.
+const (
+	OutageOpened = "opened"
+	OutageClosed = "closed"
+)
+
+// DefaultOutageMaxGap is the longest gap between two polls of a station across which
+// an episode is assumed to have carried on. Past it we can't tell whether the station
+// recovered in between, so the episode is closed at the last poll before the gap.
+const DefaultOutageMaxGap = 10 * time.Minute
+
+// outageBacklog bounds the station_outages writes held while Postgres is unreachable.
+const outageBacklog = 10000
+
+// outageKinds are the conditions tracked, in the order their events are emitted. An
+// uninstalled station is in none of them: it's gone, not out of service.
+var outageKinds = []struct {
+	kind   string
+	active func(types.NormalizedStation) bool
+}{
+	{OutageEmpty, func(s types.NormalizedStation) bool { return s.IsInstalled && s.IsRenting && s.BikesAvailable == 0 }},
+	{OutageFull, func(s types.NormalizedStation) bool { return s.IsInstalled && s.IsReturning && s.DocksAvailable == 0 }},
+	{OutageNoEBikes, func(s types.NormalizedStation) bool { return s.IsInstalled && s.IsRenting && s.EBikesAvailable == 0 }},
+	{OutageNotRenting, func(s types.NormalizedStation) bool { return s.IsInstalled && !s.IsRenting }},
+}
+
+// OutageDetector turns a stream of polls into outage episodes per station (see
+// types.StationOutage). Feed it polls in time order with Observe.
+type OutageDetector struct {
+	maxGap   time.Duration
+	stations map[string]*outageStation
+}
+
+type outageStation struct {
+	lastSeen time.Time
+	open     map[string]*types.StationOutage // kind -> the open episode
+}
+
+// NewOutageDetector returns a detector that closes episodes across gaps longer than
+// maxGap (zero = DefaultOutageMaxGap).
+func NewOutageDetector(maxGap time.Duration) *OutageDetector {
+	if maxGap <= 0 {
+		maxGap = DefaultOutageMaxGap
+	}
+	return &OutageDetector{maxGap: maxGap, stations: make(map[string]*outageStation)}
+}
+
+// Observe feeds one poll and returns the events it causes, by station then kind. A
+// station missing from polls for longer than maxGap has its episodes closed at the
+// last poll that saw it.
+func (d *OutageDetector) Observe(poll []types.NormalizedStationDataTS) []types.StationOutage {
+	var events []types.StationOutage
+	var now time.Time
+	for _, p := range poll {
+		if p.TimeStamp.After(now) {
+			now = p.TimeStamp
+		}
+		st, seen := d.stations[p.Station.ID]
+		if seen && !p.TimeStamp.After(st.lastSeen) {
+			continue // duplicate or out of order
+		}
+		censored := !seen
+		if seen && p.TimeStamp.Sub(st.lastSeen) > d.maxGap {
+			events = append(events, st.closeAll()...)
+			censored = true
+		}
+		if !seen {
+			st = &outageStation{open: make(map[string]*types.StationOutage)}
+			d.stations[p.Station.ID] = st
+		}
+		st.lastSeen = p.TimeStamp
+
+		for _, k := range outageKinds {
+			ep, open := st.open[k.kind]
+			switch active := k.active(p.Station); {
+			case active && !open:
+				ep = &types.StationOutage{StationID: p.Station.ID, Name: p.Station.Name,
+					Neighborhood: p.Station.Neighborhood, Kind: k.kind, Start: p.TimeStamp, CensoredStart: censored}
+				st.open[k.kind] = ep
+				opened := *ep
+				opened.Event = OutageOpened
+				events = append(events, opened)
+			case !active && open:
+				delete(st.open, k.kind)
+				events = append(events, closeOutage(*ep, p.TimeStamp, false))
+			}
+		}
+	}
+
+	for id, st := range d.stations {
+		if now.Sub(st.lastSeen) > d.maxGap {
+			events = append(events, st.closeAll()...)
+			delete(d.stations, id)
+		}
+	}
+	sortOutages(events)
+	return events
+}
+
+// closeAll closes a station's open episodes at its last poll, for a gap.
+func (st *outageStation) closeAll() []types.StationOutage {
+	var out []types.StationOutage
+	for kind, ep := range st.open {
+		out = append(out, closeOutage(*ep, st.lastSeen, true))
+		delete(st.open, kind)
+	}
+	return out
+}
+
+// closeOutage is the closed event of an episode that ended at end.
+func closeOutage(ep types.StationOutage, end time.Time, censored bool) types.StationOutage {
+	ep.Event, ep.End, ep.CensoredEnd = OutageClosed, &end, censored
+	ep.DurationSeconds = end.Sub(ep.Start).Seconds()
+	return ep
+}
+
+func sortOutages(events []types.StationOutage) {
+	rank := make(map[string]int, len(outageKinds))
+	for i, k := range outageKinds {
+		rank[k.kind] = i
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].StationID != events[j].StationID {
+			return events[i].StationID < events[j].StationID
+		}
+		return rank[events[i].Kind] < rank[events[j].Kind]
+	})
+}
+
+// recordOutages feeds one poll to the detector and writes the events it causes: as
+// JSON Lines to the outage file and, when db is set, to station_outages. Non-fatal:
+// a failed write is logged, and station_outages writes are retried with the next poll.
+func (c *Client) recordOutages(db *sql.DB, data []types.NormalizedStationDataTS) {
+	if c.outages == nil || len(data) == 0 {
+		return
+	}
+	events := c.outages.Observe(data)
+	if c.outageFile != nil {
+		enc := json.NewEncoder(c.outageFile)
+		for _, e := range events {
+			if err := enc.Encode(e); err != nil {
+				slog.Warn("outage event write failed", logging.Error(err, "output"))
+				break
+			}
+		}
+	}
+	if db == nil {
+		return
+	}
+	c.pendingOutages = append(c.pendingOutages, events...)
+	if n := len(c.pendingOutages); n > outageBacklog {
+		c.pendingOutages = c.pendingOutages[n-outageBacklog:]
+	}
+	if err := writeOutages(db, c.tenant, c.pendingOutages, data[0].TimeStamp); err != nil {
+		slog.Warn("station_outages write failed (non-fatal)", logging.Error(err, "db"), "held", len(c.pendingOutages))
+		return
+	}
+	c.pendingOutages = c.pendingOutages[:0]
+}
+
+const createStationOutagesTable = `
+CREATE TABLE IF NOT EXISTS station_outages (
+    station_id       text        NOT NULL,
+    kind             text        NOT NULL,
+    started_at       timestamptz NOT NULL,
+    ended_at         timestamptz,
+    last_seen_at     timestamptz NOT NULL,
+    duration_seconds double precision,
+    neighborhood     text,
+    censored_start   boolean     NOT NULL DEFAULT false,
+    censored_end     boolean     NOT NULL DEFAULT false,
+    city_id          text,
+    PRIMARY KEY (station_id, kind, started_at)
+);
+CREATE INDEX IF NOT EXISTS station_outages_open_idx ON station_outages (station_id) WHERE ended_at IS NULL;
+CREATE INDEX IF NOT EXISTS station_outages_started_idx ON station_outages (started_at);
+`
+
+const dropStationOutagesTable = `DROP TABLE IF EXISTS station_outages;`
+
+// writeOutages applies events to station_outages: an opened event inserts the
+// episode, a closed one ends it. Episodes still open are marked seen at now, so one
+// left open by a crash can be closed at its last known poll (see closeStaleOutages).
+func writeOutages(db *sql.DB, city string, events []types.StationOutage, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, e := range events {
+		var end interface{}
+		var duration interface{}
+		if e.End != nil {
+			end, duration = *e.End, e.DurationSeconds
+		}
+		if _, err := tx.Exec(`INSERT INTO station_outages
+(station_id, kind, started_at, ended_at, last_seen_at, duration_seconds, neighborhood, censored_start, censored_end, city_id)
+VALUES ($1, $2, $3, $4, COALESCE($4, $3), $5, $6, $7, $8, $9)
+ON CONFLICT (station_id, kind, started_at) DO UPDATE SET
+    ended_at = EXCLUDED.ended_at, last_seen_at = EXCLUDED.last_seen_at,
+    duration_seconds = EXCLUDED.duration_seconds, censored_end = EXCLUDED.censored_end`,
+			e.StationID, e.Kind, e.Start, end, duration, nullable(e.Neighborhood), e.CensoredStart,
+			e.CensoredEnd, nullable(city)); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE station_outages SET last_seen_at = $1
+WHERE ended_at IS NULL AND last_seen_at < $1 AND city_id IS NOT DISTINCT FROM $2`, now, nullable(city)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// closeStaleOutages closes the episodes a previous leader left open, at the last poll
+// it saw them, as censored. The new leader's detector reopens any still under way.
+func closeStaleOutages(db *sql.DB, city string) error {
+	res, err := db.Exec(`UPDATE station_outages
+SET ended_at = last_seen_at, censored_end = true,
+    duration_seconds = EXTRACT(EPOCH FROM last_seen_at - started_at)
+WHERE ended_at IS NULL AND city_id IS NOT DISTINCT FROM $1`, nullable(city))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		slog.Info("outages: closed episodes left open by a previous leader", "episodes", n)
+	}
+	return nil
+}
+
+// openOutageFile opens path for appending outage events.
+func openOutageFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("outage events: %w", err)
+	}
+	return f, nil
+}
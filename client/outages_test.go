@@ -0,0 +1,76 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+)
+
+// TestOutageDetector covers opening and closing episodes, censoring at the first poll
+// and across a gap, and closing the episodes of a station that leaves the feed.
+func TestOutageDetector(t *testing.T) {
+	t0 := time.Date(2026, 6, 1, 8, 0, 0, 0, time.UTC)
+	station := func(id string, bikes, ebikes, docks int) types.NormalizedStation {
+		return types.NormalizedStation{ID: id, BikesAvailable: bikes, EBikesAvailable: ebikes, DocksAvailable: docks,
+			IsInstalled: true, IsRenting: true, IsReturning: true}
+	}
+	poll := func(min int, stations ...types.NormalizedStation) []types.NormalizedStationDataTS {
+		var out []types.NormalizedStationDataTS
+		for _, s := range stations {
+			out = append(out, types.NormalizedStationDataTS{Station: s, TimeStamp: t0.Add(time.Duration(min) * time.Minute)})
+		}
+		return out
+	}
+	// summarize renders events as "event station kind start-end[censoring]" in minutes
+	summarize := func(events []types.StationOutage) string {
+		var parts []string
+		for _, e := range events {
+			s := fmt.Sprintf("%s %s %s %g", e.Event, e.StationID, e.Kind, e.Start.Sub(t0).Minutes())
+			if e.End != nil {
+				s += fmt.Sprintf("-%g", e.End.Sub(t0).Minutes())
+				if e.DurationSeconds != e.End.Sub(e.Start).Seconds() {
+					s += " bad-duration"
+				}
+			}
+			if e.CensoredStart {
+				s += " cs"
+			}
+			if e.CensoredEnd {
+				s += " ce"
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, "; ")
+	}
+
+	d := NewOutageDetector(10 * time.Minute)
+	notRenting := station("b", 0, 0, 5)
+	notRenting.IsRenting = false
+	for _, step := range []struct {
+		poll []types.NormalizedStationDataTS
+		want string
+	}{
+		// a is already out of e-bikes when first seen; b isn't renting
+		{poll(0, station("a", 3, 0, 7), notRenting),
+			"opened a no_ebikes 0 cs; opened b not_renting 0 cs"},
+		// a runs empty, then fills up
+		{poll(1, station("a", 0, 0, 10), notRenting), "opened a empty 1"},
+		{poll(2, station("a", 10, 1, 0), notRenting),
+			"closed a empty 1-2; opened a full 2; closed a no_ebikes 0-2 cs"},
+		// b leaves the feed; a goes unpolled for 20 minutes while full
+		{poll(5, station("a", 10, 1, 0)), ""},
+		{poll(25, station("a", 10, 1, 0)),
+			"closed a full 2-5 ce; opened a full 25 cs; closed b not_renting 0-2 cs ce"},
+		// an uninstalled station is gone, not out of service
+		{poll(26, types.NormalizedStation{ID: "a"}), "closed a full 25-26 cs"},
+		// duplicates change nothing
+		{poll(26, station("a", 0, 0, 10)), ""},
+	} {
+		if got := summarize(d.Observe(step.poll)); got != step.want {
+			t.Errorf("poll at %v:\n got %s\nwant %s", step.poll[0].TimeStamp.Sub(t0), got, step.want)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package client
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/logging"
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+const (
+	// partitionsAhead is how many days of dock_status partitions past today are kept
+	// created, so a missed maintenance run never leaves a poll without a partition.
+	partitionsAhead = 3
+	// partitionMaintenanceInterval is how often the ingester creates upcoming
+	// partitions and enforces RETENTION_DAYS.
+	partitionMaintenanceInterval = time.Hour
+
+	partitionPrefix = "dock_status_p"       // + YYYYMMDD: one UTC day
+	legacyPrefix    = "dock_status_before_" // + YYYYMMDD: every row from before partitioning
+	partitionDay    = "20060102"
+)
+
+// dockStatusIndexes are the dock_status indexes from the migrations; a partitioned
+// dock_status gets the same set as partitioned indexes.
+var dockStatusIndexes = []string{
+	"CREATE INDEX IF NOT EXISTS dock_status_station_ts_desc_idx ON dock_status (station_id, ts DESC)",
+	"CREATE INDEX IF NOT EXISTS dock_status_nbhd_ts_idx ON dock_status (neighborhood, ts) WHERE neighborhood IS NOT NULL",
+	"CREATE INDEX IF NOT EXISTS idx_dock_status_ts_brin ON dock_status USING brin (ts)",
+	createDockStatusCityIndex,
+}
+
+// retentionDays reads RETENTION_DAYS; ok is false when it's unset or invalid.
+func retentionDays() (days int, ok bool) {
+	v := strings.TrimSpace(os.Getenv("RETENTION_DAYS"))
+	if v == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		slog.Warn("invalid RETENTION_DAYS (want a positive integer); skipping retention", "value", v)
+		return 0, false
+	}
+	return n, true
+}
+
+// partitionBound is the CHECK constraint that lets ATTACH PARTITION skip scanning the
+// legacy table: validated beforehand, it proves every row is below the partition bound.
+const partitionBound = "dock_status_partition_bound"
+
+// PartitionStats summarizes a PartitionDockStatus.
+type PartitionStats struct {
+	Already bool   // dock_status was partitioned already
+	Legacy  string // the partition holding the rows from before; empty when there were none
+}
+
+// PartitionDockStatus is the plain-Postgres alternative to the TimescaleDB hypertable
+// (`dockscan db partition`): it turns dock_status into a table range-partitioned by UTC
+// day, so RETENTION_DAYS can drop whole partitions (see maintainPartitions, which the
+// ingester runs once it sees the partitioned table). An empty dock_status is simply
+// recreated; a populated one is renamed to dock_status_before_<day> and attached as
+// the partition holding everything up to the first daily partition, so no rows are
+// copied. It's a no-op once partitioned.
+//
+// The one scan, proving the old rows fit the legacy partition's bound, runs first as
+// a VALIDATE CONSTRAINT, which doesn't block ingest or reads. Only the swap itself
+// holds dock_status exclusively, and briefly.
+func PartitionDockStatus(dsn string, now time.Time) (PartitionStats, error) {
+	var stats PartitionStats
+	db, err := openPostgres(dsn)
+	if err != nil {
+		return stats, err
+	}
+	defer db.Close()
+	if err := ensureSchemaCurrent(db); err != nil {
+		return stats, err
+	}
+	if stats.Already, err = isPartitioned(db); err != nil || stats.Already {
+		return stats, err
+	}
+	if hypertable, err := isHypertable(db); err != nil {
+		return stats, err
+	} else if hypertable {
+		return stats, errors.New("dock_status is a TimescaleDB hypertable, which is partitioned into chunks already")
+	}
+
+	boundary := utcDay(now).AddDate(0, 0, 1)
+	legacy := legacyPrefix + boundary.Format(partitionDay)
+	for _, stmt := range partitionBoundStatements(boundary) {
+		if _, err := db.Exec(stmt); err != nil {
+			return stats, fmt.Errorf("partition dock_status: %w", err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return stats, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("LOCK TABLE dock_status IN ACCESS EXCLUSIVE MODE"); err != nil {
+		return stats, err
+	}
+	var empty, uniqueKey bool
+	if err := tx.QueryRow("SELECT NOT EXISTS (SELECT 1 FROM dock_status)").Scan(&empty); err != nil {
+		return stats, err
+	}
+	if err := tx.QueryRow(uniqueKeyExists).Scan(&uniqueKey); err != nil {
+		return stats, err
+	}
+	for _, stmt := range partitionStatements(empty, uniqueKey, boundary) {
+		if _, err := tx.Exec(stmt); err != nil {
+			return stats, fmt.Errorf("partition dock_status: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return stats, err
+	}
+	if !empty {
+		stats.Legacy = legacy
+	}
+	// the days ahead, so the ingester has somewhere to write before its next maintenance
+	return stats, maintainPartitions(db, now, 0)
+}
+
+// partitionBoundStatements add and validate the CHECK constraint matching the legacy
+// partition's bound, outside the swap's transaction: VALIDATE takes a lock that lets
+// inserts and reads through, and rows inserted meanwhile are checked as they land.
+func partitionBoundStatements(boundary time.Time) []string {
+	return []string{
+		"ALTER TABLE dock_status DROP CONSTRAINT IF EXISTS " + partitionBound,
+		fmt.Sprintf("ALTER TABLE dock_status ADD CONSTRAINT %s CHECK (ts < '%s') NOT VALID",
+			partitionBound, boundary.Format(time.RFC3339)),
+		"ALTER TABLE dock_status VALIDATE CONSTRAINT " + partitionBound,
+	}
+}
+
+// partitionStatements swap dock_status for a partitioned table, run with dock_status
+// locked.
+func partitionStatements(empty, uniqueKey bool, boundary time.Time) []string {
+	// the view pins the old table; it's recreated against the partitioned one below
+	stmts := []string{"DROP VIEW IF EXISTS dock_status_wide"}
+	legacy := legacyPrefix + boundary.Format(partitionDay)
+	if empty {
+		stmts = append(stmts,
+			"CREATE TABLE dock_status_unpartitioned (LIKE dock_status INCLUDING DEFAULTS)",
+			"DROP TABLE dock_status",
+			"CREATE TABLE dock_status (LIKE dock_status_unpartitioned INCLUDING DEFAULTS) PARTITION BY RANGE (ts)",
+			"DROP TABLE dock_status_unpartitioned",
+		)
+	} else {
+		stmts = append(stmts, "ALTER TABLE dock_status RENAME TO "+legacy)
+		// free the index names for the partitioned indexes
+		for _, idx := range [][2]string{
+			{"dock_status_station_ts_desc_idx", "station_ts_desc_idx"},
+			{"dock_status_nbhd_ts_idx", "nbhd_ts_idx"},
+			{"idx_dock_status_ts_brin", "ts_brin_idx"},
+			{uniqueKeyName, "station_ts_key"},
+			{"dock_status_city_ts_idx", "city_ts_idx"},
+		} {
+			stmts = append(stmts, fmt.Sprintf("ALTER INDEX IF EXISTS %s RENAME TO %s_%s", idx[0], legacy, idx[1]))
+		}
+		stmts = append(stmts, fmt.Sprintf("CREATE TABLE dock_status (LIKE %s INCLUDING DEFAULTS) PARTITION BY RANGE (ts)", legacy))
+	}
+	stmts = append(stmts, dockStatusIndexes...)
+	if uniqueKey {
+		stmts = append(stmts, createUniqueKey)
+	}
+	if !empty {
+		stmts = append(stmts,
+			fmt.Sprintf("ALTER TABLE dock_status ATTACH PARTITION %s FOR VALUES FROM (MINVALUE) TO ('%s')",
+				legacy, boundary.Format(time.RFC3339)),
+			// the partition bound enforces it from here on
+			fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s", legacy, partitionBound),
+		)
+	}
+	return append(stmts, dockStatusWideView)
+}
+
+// isHypertable reports whether dock_status is a TimescaleDB hypertable.
+func isHypertable(db *sql.DB) (bool, error) {
+	var installed bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')").Scan(&installed); err != nil || !installed {
+		return false, err
+	}
+	var hypertable bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM timescaledb_information.hypertables
+WHERE hypertable_name = 'dock_status')`).Scan(&hypertable)
+	return hypertable, err
+}
+
+// maintainPartitionsIfDue is the ingester's hourly partition maintenance. It first
+// checks whether dock_status has been partitioned (by `db partition`) while it ran.
+func (c *Client) maintainPartitionsIfDue(db *sql.DB) {
+	now := c.timeProvider.Now()
+	if now.Sub(c.lastPartitionRun) < partitionMaintenanceInterval {
+		return
+	}
+	if !c.partitioned {
+		partitioned, err := isPartitioned(db)
+		if err != nil {
+			slog.Warn("partition check failed (non-fatal, retrying next poll)", logging.Error(err, "db"))
+			return
+		}
+		if !partitioned {
+			c.lastPartitionRun = now
+			return
+		}
+		c.partitioned = true
+		slog.Info("partitioning: dock_status is partitioned by day; maintaining partitions")
+	}
+	retention, _ := retentionDays()
+	if err := maintainPartitions(db, now, retention); err != nil {
+		slog.Warn("partition maintenance failed (non-fatal, retrying next poll)", logging.Error(err, "db"))
+		return
+	}
+	c.lastPartitionRun = now
+}
+
+func isPartitioned(db *sql.DB) (bool, error) {
+	var kind string
+	if err := db.QueryRow("SELECT relkind FROM pg_class WHERE oid = 'dock_status'::regclass").Scan(&kind); err != nil {
+		return false, err
+	}
+	return kind == "p", nil
+}
+
+// maintainPartitions creates the partitions from the end of the newest one through
+// partitionsAhead days from now, then detaches and drops every partition entirely
+// older than the retention window (when retention > 0).
+func maintainPartitions(db *sql.DB, now time.Time, retention int) error {
+	names, err := dockStatusPartitions(db)
+	if err != nil {
+		return err
+	}
+	for _, day := range partitionsToCreate(names, now, partitionsAhead) {
+		if err := createDayPartition(db, day); err != nil {
+			return err
+		}
+	}
+	if retention <= 0 {
+		return nil
+	}
+	for _, name := range expiredPartitions(names, utcDay(now).AddDate(0, 0, -retention)) {
+		if err := dropPartition(db, name); err != nil {
+			return err
+		}
+		slog.Info("retention: dropped partition", "partition", name, "retention_days", retention)
+	}
+	return nil
+}
+
+// ensurePartitionsFor creates the daily dock_status partitions covering [from, to) when
+// dock_status is natively partitioned, so rows outside the ingester's window (e.g. a
+// restore) have somewhere to land. It's a no-op on any other dock_status.
+func ensurePartitionsFor(db *sql.DB, from, to time.Time) error {
+	if partitioned, err := isPartitioned(db); err != nil || !partitioned {
+		return err
+	}
+	names, err := dockStatusPartitions(db)
+	if err != nil {
+		return err
+	}
+	var legacyUntil time.Time
+	existing := make(map[string]bool, len(names))
+	for _, name := range names {
+		existing[name] = true
+		if strings.HasPrefix(name, legacyPrefix) {
+			legacyUntil, _ = partitionUpper(name)
+		}
+	}
+	for day := utcDay(from); day.Before(to); day = day.AddDate(0, 0, 1) {
+		if existing[partitionPrefix+day.Format(partitionDay)] || day.Before(legacyUntil) {
+			continue
+		}
+		if err := createDayPartition(db, day); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropPartition detaches a dock_status partition and drops it in one transaction.
+func dropPartition(db *sql.DB, name string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("ALTER TABLE dock_status DETACH PARTITION " + name); err != nil {
+		return fmt.Errorf("detach %s: %w", name, err)
+	}
+	if _, err := tx.Exec("DROP TABLE " + name); err != nil {
+		return fmt.Errorf("drop %s: %w", name, err)
+	}
+	return tx.Commit()
+}
+
+func createDayPartition(db *sql.DB, day time.Time) error {
+	if _, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s%s PARTITION OF dock_status FOR VALUES FROM ('%s') TO ('%s')",
+		partitionPrefix, day.Format(partitionDay), day.Format(time.RFC3339), day.AddDate(0, 0, 1).Format(time.RFC3339))); err != nil {
+		return fmt.Errorf("create partition for %s: %w", day.Format("2006-01-02"), err)
+	}
+	return nil
+}
+
+func dockStatusPartitions(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid
+WHERE i.inhparent = 'dock_status'::regclass`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// partitionUpper returns the exclusive upper bound encoded in a partition's name.
+func partitionUpper(name string) (time.Time, bool) {
+	switch {
+	case strings.HasPrefix(name, partitionPrefix):
+		day, err := time.Parse(partitionDay, strings.TrimPrefix(name, partitionPrefix))
+		return day.AddDate(0, 0, 1), err == nil
+	case strings.HasPrefix(name, legacyPrefix):
+		day, err := time.Parse(partitionDay, strings.TrimPrefix(name, legacyPrefix))
+		return day, err == nil
+	}
+	return time.Time{}, false
+}
+
+// partitionsToCreate lists the days (UTC midnights) that need a partition: from the
+// end of the newest existing partition (or today, on a fresh table) through ahead days
+// from now.
+func partitionsToCreate(names []string, now time.Time, ahead int) []time.Time {
+	start := utcDay(now)
+	var newest time.Time
+	for _, name := range names {
+		if upper, ok := partitionUpper(name); ok && upper.After(newest) {
+			newest = upper
+		}
+	}
+	if !newest.IsZero() {
+		start = newest
+	}
+	var days []time.Time
+	for day := start; !day.After(utcDay(now).AddDate(0, 0, ahead)); day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
+	}
+	return days
+}
+
+// expiredPartitions lists the partitions whose every row is older than cutoff, oldest first.
+func expiredPartitions(names []string, cutoff time.Time) []string {
+	var out []string
+	for _, name := range names {
+		if upper, ok := partitionUpper(name); ok && !upper.After(cutoff) {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out) // legacy ("before") sorts ahead of daily ("p") partitions
+	return out
+}
+
+func utcDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPartitionPlanning covers the plain-Postgres partition maintenance: which daily
+// partitions to pre-create and which to drop for RETENTION_DAYS.
+func TestPartitionPlanning(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2023, 7, d, 0, 0, 0, 0, time.UTC) }
+	// 22:00 in New York is already the next UTC day
+	now := time.Date(2023, 7, 22, 22, 0, 0, 0, time.FixedZone("EDT", -4*3600))
+
+	if got, want := partitionsToCreate(nil, now, 2), []time.Time{day(23), day(24), day(25)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("fresh table: create %v, want %v", got, want)
+	}
+
+	// converted on the 20th (legacy holds everything before the 21st), maintained
+	// through the 23rd, then the ingester was down for a day
+	names := []string{"dock_status_before_20230721", "dock_status_p20230721", "dock_status_p20230722", "dock_status_p20230723"}
+	if got, want := partitionsToCreate(names, now.Add(24*time.Hour), 1), []time.Time{day(24), day(25)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after downtime: create %v, want %v", got, want)
+	}
+	if got := partitionsToCreate(names, now, 0); len(got) != 0 {
+		t.Errorf("fully covered: create %v, want none", got)
+	}
+
+	if got, want := expiredPartitions(names, day(22)), []string{"dock_status_before_20230721", "dock_status_p20230721"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expired before the 22nd: %v, want %v", got, want)
+	}
+	if got := expiredPartitions(append(names, "dock_status_wide"), day(21)); !reflect.DeepEqual(got, []string{"dock_status_before_20230721"}) {
+		t.Errorf("expired before the 21st: %v", got)
+	}
+}
+
+// TestPartitionStatements checks that a populated dock_status is attached under the
+// bound its validated CHECK constraint proves, and the constraint dropped after.
+func TestPartitionStatements(t *testing.T) {
+	boundary := time.Date(2023, 7, 23, 0, 0, 0, 0, time.UTC)
+	bound := "'2023-07-23T00:00:00Z'"
+	check := partitionBoundStatements(boundary)
+	if !strings.Contains(check[1], "CHECK (ts < "+bound+") NOT VALID") || !strings.HasPrefix(check[2], "ALTER TABLE dock_status VALIDATE") {
+		t.Errorf("bound statements: %q", check)
+	}
+
+	stmts := partitionStatements(false, true, boundary)
+	attach, drop := -1, -1
+	for i, stmt := range stmts {
+		switch {
+		case strings.Contains(stmt, "ATTACH PARTITION dock_status_before_20230723"):
+			attach = i
+			if !strings.Contains(stmt, "TO ("+bound+")") {
+				t.Errorf("attach bound differs from the check: %s", stmt)
+			}
+		case stmt == "ALTER TABLE dock_status_before_20230723 DROP CONSTRAINT "+partitionBound:
+			drop = i
+		}
+	}
+	if attach < 0 || drop < attach {
+		t.Errorf("want the attach then the check dropped, got %q", stmts)
+	}
+
+	for _, stmt := range partitionStatements(true, false, boundary) {
+		if strings.Contains(stmt, "ATTACH") || strings.Contains(stmt, partitionBound) {
+			t.Errorf("empty table: unexpected %s", stmt)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package client
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/logging"
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+// Poll outcomes recorded in poll_log.
+const (
+	PollOK         = "ok"
+	PollFetchError = "fetch_error"
+	PollDBError    = "db_error"
+)
+
+// Gap causes reported by FindGaps.
+const (
+	GapFeed     = "feed"     // polls ran but the feed couldn't be fetched or parsed
+	GapDatabase = "database" // polls ran but Postgres rejected the write
+	GapRestart  = "restart"  // no polls: the ingester was down and came back as a new process
+	GapStalled  = "stalled"  // no polls, yet the same process polled before and after
+	GapDown     = "down"     // no polls, and none since: the ingester is still down
+	GapUnknown  = "unknown"  // nothing in poll_log explains it
+)
+
+// pollLogBacklog bounds the poll_log entries held in memory while Postgres is
+// unreachable (a day of 1-minute polls); the oldest are dropped beyond it.
+const pollLogBacklog = 1440
+
+const createPollLogTable = `
+CREATE TABLE IF NOT EXISTS poll_log (
+    started_at         timestamptz NOT NULL,
+    process_started_at timestamptz NOT NULL,
+    fetch_ms           integer,
+    feed_last_updated  timestamptz,
+    station_count      integer,
+    rows_written       integer     NOT NULL DEFAULT 0,
+    outcome            text        NOT NULL,
+    error              text
+);
+CREATE INDEX IF NOT EXISTS poll_log_started_at_idx ON poll_log (started_at);
+`
+
+// PollRecord is one ingest attempt.
+type PollRecord struct {
+	StartedAt        time.Time
+	ProcessStartedAt time.Time // identifies the ingester process; a new value means a restart
+	FetchLatency     time.Duration
+	FeedLastUpdated  time.Time // zero when the feed doesn't say (or the fetch failed)
+	Stations         int
+	Rows             int
+	Outcome          string
+	Error            string
+}
+
+// logPoll records a poll in poll_log. Entries that can't be written (usually because
+// Postgres is down, which is exactly what poll_log should show later) are kept in
+// memory and written with the next entry that gets through.
+func (c *Client) logPoll(db *sql.DB, rec PollRecord) {
+	c.pendingPolls = append(c.pendingPolls, rec)
+	if n := len(c.pendingPolls); n > pollLogBacklog {
+		c.pendingPolls = c.pendingPolls[n-pollLogBacklog:]
+	}
+	if err := insertPollRecords(db, c.tenant, c.pendingPolls); err != nil {
+		slog.Warn("poll_log write failed", logging.Error(err, "db"), "held", len(c.pendingPolls))
+		return
+	}
+	c.pendingPolls = c.pendingPolls[:0]
+}
+
+// insertPollRecords writes recs; city is the ingester's city in a shared database.
+func insertPollRecords(db *sql.DB, city string, recs []PollRecord) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO poll_log
+(started_at, process_started_at, fetch_ms, feed_last_updated, station_count, rows_written, outcome, error, city_id)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range recs {
+		var feedUpdated interface{}
+		if !r.FeedLastUpdated.IsZero() {
+			feedUpdated = r.FeedLastUpdated
+		}
+		if _, err := stmt.Exec(r.StartedAt, r.ProcessStartedAt, r.FetchLatency.Milliseconds(), feedUpdated,
+			r.Stations, r.Rows, r.Outcome, nullable(r.Error), nullable(city)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Gap is a stretch with no dock_status rows, strictly between From and To (the last
+// covered timestamp before it and the first after, or the bounds of the search).
+type Gap struct {
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Cause  string    `json:"cause"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// Duration is how long the gap lasted.
+func (g Gap) Duration() time.Duration { return g.To.Sub(g.From) }
+
+// FindGaps lists every stretch in [from, to) longer than maxGap without dock_status rows,
+// and attributes each to a cause using poll_log. In a shared database it looks at one
+// city's rows and polls, so city is required there; elsewhere it's ignored.
+func FindGaps(dsn string, from, to time.Time, maxGap time.Duration, city string) ([]Gap, error) {
+	db, err := openPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	shared, err := isShared(db)
+	if err != nil {
+		return nil, err
+	}
+	cityFilter, firstPollQuery := "", "SELECT min(started_at) FROM poll_log"
+	args := []interface{}{from, to}
+	if shared {
+		if city == "" {
+			return nil, errors.New("this is a shared database: pass the city (CITY_ID or --city)")
+		}
+		cityFilter = " AND city_id = $3"
+		firstPollQuery += " WHERE city_id = $1"
+		args = append(args, city)
+	}
+
+	var coverage []time.Time
+	rows, err := db.Query("SELECT DISTINCT ts FROM dock_status WHERE ts >= $1 AND ts < $2"+cityFilter+" ORDER BY ts", args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var ts time.Time
+		if err := rows.Scan(&ts); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		coverage = append(coverage, ts)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The poll after the search window tells a restart from an ingester that's still down.
+	var polls []PollRecord
+	rows, err = db.Query(`SELECT started_at, process_started_at, coalesce(fetch_ms, 0), feed_last_updated,
+       coalesce(station_count, 0), rows_written, outcome, coalesce(error, '')
+FROM poll_log
+WHERE started_at >= $1`+cityFilter+`
+  AND started_at <= coalesce((SELECT min(started_at) FROM poll_log WHERE started_at >= $2`+cityFilter+`), 'infinity')
+ORDER BY started_at`, append([]interface{}{from.Add(-maxGap), to}, args[2:]...)...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var r PollRecord
+		var fetchMS int64
+		var feedUpdated sql.NullTime
+		if err := rows.Scan(&r.StartedAt, &r.ProcessStartedAt, &fetchMS, &feedUpdated,
+			&r.Stations, &r.Rows, &r.Outcome, &r.Error); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		r.FetchLatency = time.Duration(fetchMS) * time.Millisecond
+		r.FeedLastUpdated = feedUpdated.Time
+		polls = append(polls, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var firstPoll sql.NullTime
+	if err := db.QueryRow(firstPollQuery, args[2:]...).Scan(&firstPoll); err != nil {
+		return nil, err
+	}
+	return findGaps(coverage, polls, firstPoll.Time, from, to, maxGap), nil
+}
+
+// findGaps finds the gaps in sorted coverage timestamps and attributes each from the
+// polls (sorted by start) around it. firstPoll is the earliest poll_log entry ever, so
+// a gap from before poll_log existed is reported as unknown rather than as downtime.
+func findGaps(coverage []time.Time, polls []PollRecord, firstPoll, from, to time.Time, maxGap time.Duration) []Gap {
+	var gaps []Gap
+	prev := from
+	check := func(next time.Time) {
+		if next.Sub(prev) > maxGap {
+			gaps = append(gaps, attributeGap(Gap{From: prev, To: next}, polls, firstPoll))
+		}
+		prev = next
+	}
+	for _, ts := range coverage {
+		check(ts)
+	}
+	check(to)
+	return gaps
+}
+
+func attributeGap(g Gap, polls []PollRecord, firstPoll time.Time) Gap {
+	var fetchErrs, dbErrs, oks int
+	var lastErr string
+	var before, after *PollRecord
+	for i := range polls {
+		p := &polls[i]
+		switch {
+		case !p.StartedAt.After(g.From):
+			before = p
+			continue
+		case !p.StartedAt.Before(g.To):
+			if after == nil {
+				after = p
+			}
+			continue
+		}
+		switch p.Outcome {
+		case PollFetchError:
+			fetchErrs++
+			lastErr = p.Error
+		case PollDBError:
+			dbErrs++
+			lastErr = p.Error
+		default:
+			oks++
+		}
+	}
+
+	switch {
+	case dbErrs > 0 || fetchErrs > 0:
+		g.Cause = GapFeed
+		if dbErrs >= fetchErrs {
+			g.Cause = GapDatabase
+		}
+		g.Detail = fmt.Sprintf("%d db errors, %d fetch errors, %d ok polls; last error: %s", dbErrs, fetchErrs, oks, lastErr)
+	case oks > 0:
+		g.Cause = GapUnknown
+		g.Detail = fmt.Sprintf("%d polls succeeded but their rows are missing", oks)
+	case firstPoll.IsZero() || g.To.Before(firstPoll):
+		g.Cause = GapUnknown
+		g.Detail = "before poll_log was recorded"
+	case after == nil:
+		g.Cause = GapDown
+		g.Detail = "no polls since"
+	case before == nil || !after.ProcessStartedAt.Equal(before.ProcessStartedAt):
+		g.Cause = GapRestart
+		g.Detail = "ingester restarted at " + after.ProcessStartedAt.Format(time.RFC3339)
+	default:
+		g.Cause = GapStalled
+		g.Detail = "same ingester process, no polls"
+	}
+	return g
+}
+
+// WriteGaps writes gaps as an aligned table ("text") or JSON lines ("jsonl").
+func WriteGaps(w io.Writer, gaps []Gap, format string) error {
+	switch format {
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		for _, g := range gaps {
+			if err := enc.Encode(g); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "text", "":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "FROM\tTO\tDURATION\tCAUSE\tDETAIL")
+		for _, g := range gaps {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", g.From.Format(time.RFC3339), g.To.Format(time.RFC3339),
+				g.Duration().Round(time.Second), g.Cause, strings.ReplaceAll(g.Detail, "\n", " "))
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown format %q (want text or jsonl)", format)
+	}
+}
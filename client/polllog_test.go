@@ -0,0 +1,69 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+// TestFindGaps walks one day with a gap of each kind and checks the attribution.
+func TestFindGaps(t *testing.T) {
+	day := time.Date(2023, 7, 23, 0, 0, 0, 0, time.UTC)
+	at := func(h, m int) time.Time { return day.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute) }
+	proc1, proc2 := at(0, 0), at(9, 0)
+
+	var coverage []time.Time
+	var polls []PollRecord
+	poll := func(ts, proc time.Time, outcome string, covered bool) {
+		polls = append(polls, PollRecord{StartedAt: ts, ProcessStartedAt: proc, Outcome: outcome})
+		if covered {
+			coverage = append(coverage, ts)
+		}
+	}
+	for m := 0; m < 60; m += 3 { // 00:00-01:00 fine
+		poll(at(0, m), proc1, PollOK, true)
+	}
+	for m := 0; m < 30; m += 3 { // 01:00-01:30 feed down
+		poll(at(1, m), proc1, PollFetchError, false)
+	}
+	for m := 30; m < 60; m += 3 { // 01:30-02:00 fine, then a stall until 03:00
+		poll(at(1, m), proc1, PollOK, true)
+	}
+	for m := 0; m < 30; m += 3 { // 03:00-03:30 fine, then Postgres down until 04:00
+		poll(at(3, m), proc1, PollOK, true)
+	}
+	for m := 30; m < 60; m += 3 {
+		poll(at(3, m), proc1, PollDBError, false)
+	}
+	poll(at(4, 0), proc1, PollOK, true) // then the pod is gone until 09:00
+	for m := 0; m < 30; m += 3 {        // a new process; nothing after 09:27
+		poll(at(9, m), proc2, PollOK, true)
+	}
+
+	gaps := findGaps(coverage, polls, at(0, 0), day, day.Add(24*time.Hour), 6*time.Minute)
+	want := []struct {
+		from, to time.Time
+		cause    string
+	}{
+		{at(0, 57), at(1, 30), GapFeed},
+		{at(1, 57), at(3, 0), GapStalled},
+		{at(3, 27), at(4, 0), GapDatabase},
+		{at(4, 0), at(9, 0), GapRestart},
+		{at(9, 27), day.Add(24 * time.Hour), GapDown},
+	}
+	if len(gaps) != len(want) {
+		t.Fatalf("got %d gaps, want %d: %+v", len(gaps), len(want), gaps)
+	}
+	for i, w := range want {
+		g := gaps[i]
+		if !g.From.Equal(w.from) || !g.To.Equal(w.to) || g.Cause != w.cause {
+			t.Errorf("gap %d = %s..%s %s (%s), want %s..%s %s", i, g.From.Format("15:04"), g.To.Format("15:04"),
+				g.Cause, g.Detail, w.from.Format("15:04"), w.to.Format("15:04"), w.cause)
+		}
+	}
+
+	// before poll_log existed, nothing can be attributed
+	old := findGaps(nil, nil, at(0, 0), day.Add(-24*time.Hour), day.Add(-12*time.Hour), 6*time.Minute)
+	if len(old) != 1 || old[0].Cause != GapUnknown {
+		t.Errorf("pre-poll_log gap = %+v, want one unknown", old)
+	}
+}
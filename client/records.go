@@ -0,0 +1,154 @@
+package client
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+)
+
+// ReadSnapshots replays a recording made by `ts` — JSON Lines (the default output) or
+// CSV (--csv) — calling fn once per station row, in file order. The format is sniffed
+// from the first byte, so callers don't need to know which mode produced the file.
+// A path of "-" reads stdin.
+func ReadSnapshots(path string, fn func(types.NormalizedStationDataTS) error) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	br := bufio.NewReaderSize(r, 1<<20)
+	first, err := br.Peek(1)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if first[0] == '{' {
+		return readSnapshotsJSONL(br, fn)
+	}
+	return readSnapshotsCSV(br, fn)
+}
+
+func readSnapshotsJSONL(r io.Reader, fn func(types.NormalizedStationDataTS) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 4<<20)
+	line := 0
+	for sc.Scan() {
+		line++
+		b := sc.Bytes()
+		if len(strings.TrimSpace(string(b))) == 0 {
+			continue
+		}
+		var d types.NormalizedStationDataTS
+		if err := json.Unmarshal(b, &d); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := fn(d); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// readSnapshotsCSV maps columns by header name, so files written with --exclude still
+// load (missing columns stay zero). TimeStamp and ID are required.
+func readSnapshotsCSV(r io.Reader, fn func(types.NormalizedStationDataTS) error) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("read csv header: %w", err)
+	}
+	col := make(map[string]int, len(header))
+	for i, h := range header {
+		col[h] = i
+	}
+	if _, ok := col["ID"]; !ok {
+		return fmt.Errorf("csv: missing ID column")
+	}
+	if _, ok := col["TimeStamp"]; !ok {
+		return fmt.Errorf("csv: missing TimeStamp column")
+	}
+	// PrintStationDataCSV has always written a "Status" header without a matching
+	// value, so rows from ts are one field short; drop it from the mapping when
+	// that's the case.
+	line := 1
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line++
+		if line == 2 {
+			if i, ok := col["Status"]; ok && len(rec) == len(header)-1 {
+				delete(col, "Status")
+				for h, j := range col {
+					if j > i {
+						col[h] = j - 1
+					}
+				}
+			}
+		}
+		d, err := snapshotFromCSV(col, rec)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := fn(d); err != nil {
+			return err
+		}
+	}
+}
+
+func snapshotFromCSV(col map[string]int, rec []string) (types.NormalizedStationDataTS, error) {
+	get := func(name string) string {
+		if i, ok := col[name]; ok && i < len(rec) {
+			return rec[i]
+		}
+		return ""
+	}
+	num := func(name string) int { n, _ := strconv.Atoi(get(name)); return n }
+	flt := func(name string) float64 { f, _ := strconv.ParseFloat(get(name), 64); return f }
+	flag := func(name string) bool { b, _ := strconv.ParseBool(get(name)); return b }
+
+	ts, err := time.Parse(time.RFC3339, get("TimeStamp"))
+	if err != nil {
+		return types.NormalizedStationDataTS{}, fmt.Errorf("bad TimeStamp: %w", err)
+	}
+	return types.NormalizedStationDataTS{
+		Station: types.NormalizedStation{
+			ID:              get("ID"),
+			Name:            get("Name"),
+			Longitude:       flt("Longitude"),
+			Latitude:        flt("Latitude"),
+			Location:        get("Location"),
+			BikesAvailable:  num("BikesAvailable"),
+			EBikesAvailable: num("EBikesAvailable"),
+			BikesDisabled:   num("BikesDisabled"),
+			DocksAvailable:  num("DocksAvailable"),
+			DocksDisabled:   num("DocksDisabled"),
+			IsReturning:     flag("IsReturning"),
+			IsRenting:       flag("IsRenting"),
+			IsInstalled:     flag("IsInstalled"),
+			Neighborhood:    get("Neighborhood"),
+		},
+		TimeStamp: ts,
+		Delta:     get("Delta"),
+		Keyframe:  flag("Keyframe"),
+	}, nil
+}
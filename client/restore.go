@@ -0,0 +1,320 @@
+package client
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+	"github.com/lib/pq"
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+// RestoreOptions configures Restore.
+type RestoreOptions struct {
+	From, To time.Time // rows with From <= ts < To are loaded
+	// Table is the target: dock_status (the default) or a scratch table, created with
+	// dock_status's columns if it doesn't exist.
+	Table string
+	// City is the city the rows belong to in a shared database, where it's required:
+	// station IDs and neighborhoods are namespaced and city_id set as the ingester does.
+	City string
+}
+
+// RestoreStats summarizes a Restore.
+type RestoreStats struct {
+	Files    int
+	Read     int64 // rows read from the files
+	InRange  int64 // of those, rows inside [From, To)
+	Inserted int64
+	Skipped  int64 // in range but already in the table (or repeated in the input)
+}
+
+// restoreBatch bounds the rows held in memory and loaded per transaction, so a large
+// recording or archived day restores in constant memory.
+const restoreBatch = 10000
+
+var tableName = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// archiveTimeLayouts covers ts as written by `archive` (RFC 3339) and by the old
+// psql-based prune job (Postgres' own text form).
+var archiveTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999-07:00",
+}
+
+// Restore bulk-loads dock_status rows from archived days (the gzipped CSVs written by
+// `archive`, or a directory of them) and from `ts` JSONL/CSV recordings into
+// opts.Table. Only rows inside [From, To) are loaded, and rows whose (station_id, ts)
+// is already in the table are skipped, so restoring the same files twice is harmless.
+// Archived files listed in a manifest are verified against it first. Rows are loaded
+// in batches, each its own transaction, so an interrupted restore can simply be rerun.
+// Restoring into dock_status then refreshes the rollups for [From, To).
+func Restore(dsn string, paths []string, opts RestoreOptions) (RestoreStats, error) {
+	var stats RestoreStats
+	if opts.Table == "" {
+		opts.Table = "dock_status"
+	}
+	if !tableName.MatchString(opts.Table) {
+		return stats, fmt.Errorf("invalid table name %q", opts.Table)
+	}
+	if !opts.From.Before(opts.To) {
+		return stats, errors.New("restore range is empty (--from must be before --to)")
+	}
+	files, err := restoreFiles(paths)
+	if err != nil {
+		return stats, err
+	}
+
+	db, err := openPostgres(dsn)
+	if err != nil {
+		return stats, err
+	}
+	defer db.Close()
+	if err := ensureSchemaCurrent(db); err != nil {
+		return stats, err
+	}
+	shared, err := isShared(db)
+	if err != nil {
+		return stats, err
+	}
+	city := ""
+	if shared {
+		if opts.City == "" {
+			return stats, errors.New("this is a shared database: pass the city (CITY_ID or --city)")
+		}
+		if strings.Contains(opts.City, tenantSeparator) {
+			return stats, fmt.Errorf("city %q must not contain %q", opts.City, tenantSeparator)
+		}
+		city = opts.City
+	}
+	if opts.Table == "dock_status" {
+		// rows older than the partition window need their partitions back
+		if err := ensurePartitionsFor(db, opts.From, opts.To); err != nil {
+			return stats, err
+		}
+	} else if _, err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (LIKE dock_status INCLUDING DEFAULTS);
+CREATE INDEX IF NOT EXISTS %[1]s_station_ts_idx ON %[1]s (station_id, ts)`, opts.Table)); err != nil {
+		return stats, fmt.Errorf("create %s: %w", opts.Table, err)
+	}
+
+	for _, path := range files {
+		var inRange, inserted int64
+		read, err := readRestoreFile(path, opts.From, opts.To, city, restoreBatch, func(rows [][]interface{}) error {
+			n, err := loadRestoreRows(db, opts.Table, rows)
+			inRange += int64(len(rows))
+			inserted += n
+			return err
+		})
+		stats.Read += read
+		stats.InRange += inRange
+		stats.Inserted += inserted
+		stats.Skipped += inRange - inserted
+		if err != nil {
+			return stats, fmt.Errorf("%s: %w", path, err)
+		}
+		stats.Files++
+		if inRange > 0 {
+			slog.Info("restore: loaded", "file", filepath.Base(path), "rows", inRange, "inserted", inserted)
+		}
+	}
+	if opts.Table == "dock_status" && stats.Inserted > 0 {
+		// the rows are older than the rollups' own lookback
+		if err := refreshRollupRange(db, opts.From, opts.To, city); err != nil {
+			return stats, fmt.Errorf("rows restored, but refreshing the rollups failed: %w", err)
+		}
+	}
+	return stats, nil
+}
+
+// restoreFiles expands directories into their archived days (sorted, so rows load in
+// day order) and verifies every file a manifest vouches for.
+func restoreFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		days, err := filepath.Glob(filepath.Join(path, "*"+archiveFileExt))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(days)
+		manifest, err := ReadArchiveManifest(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range manifest.Files {
+			if err := VerifyArchiveFile(path, f); err != nil {
+				return nil, err
+			}
+		}
+		files = append(files, days...)
+	}
+	return files, nil
+}
+
+// readRestoreFile reads one input, passing the in-range rows as dock_status column
+// values to load in batches of up to batch rows, and returns how many rows it read in
+// total. With a city (a shared database), rows are namespaced for it; see tenantRow.
+func readRestoreFile(path string, from, to time.Time, city string, batch int, load func([][]interface{}) error) (int64, error) {
+	gz, err := isGzip(path)
+	if err != nil {
+		return 0, err
+	}
+	rows := make([][]interface{}, 0, batch)
+	add := func(row []interface{}) error {
+		if err := tenantRow(row, city); err != nil {
+			return err
+		}
+		rows = append(rows, row)
+		if len(rows) < batch {
+			return nil
+		}
+		err := load(rows)
+		rows = rows[:0]
+		return err
+	}
+	flush := func(read int64, err error) (int64, error) {
+		if err == nil && len(rows) > 0 {
+			err = load(rows)
+		}
+		return read, err
+	}
+	var read int64
+	if !gz {
+		// a `ts` recording (JSONL or CSV)
+		err := ReadSnapshots(path, func(d types.NormalizedStationDataTS) error {
+			read++
+			if !d.TimeStamp.Before(from) && d.TimeStamp.Before(to) {
+				return add(dockStatusRow(d))
+			}
+			return nil
+		})
+		return flush(read, err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return flush(ReadArchiveCSV(f, func(row map[string]string) error {
+		ts, err := parseArchiveTime(row["ts"])
+		if err != nil {
+			return err
+		}
+		if ts.Before(from) || !ts.Before(to) {
+			return nil
+		}
+		values := make([]interface{}, len(dockStatusColumns))
+		for i, col := range dockStatusColumns {
+			if v := row[col]; v != "" {
+				values[i] = v // COPY parses the text form; empty archives NULL
+			}
+		}
+		values[dockStatusTS] = ts
+		return add(values)
+	}))
+}
+
+// tenantRow namespaces a dock_status row's station ID and neighborhood for city and
+// sets its city_id. Rows archived from a shared database carry them already; a row of
+// another city is refused. A no-op without a city.
+func tenantRow(row []interface{}, city string) error {
+	if city == "" {
+		return nil
+	}
+	cityID := len(dockStatusColumns) - 1
+	if owner, ok := row[cityID].(string); ok && owner != city {
+		return fmt.Errorf("row of station %v belongs to city %q, not %q", row[0], owner, city)
+	}
+	for _, i := range []int{0, dockStatusNeighborhood} {
+		if id, ok := row[i].(string); ok && !strings.HasPrefix(id, cityPrefix(city)) {
+			row[i] = namespacedID(city, id)
+		}
+	}
+	row[cityID] = city
+	return nil
+}
+
+func isGzip(path string) (bool, error) {
+	if path == "-" {
+		return false, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic, err := bufio.NewReader(f).Peek(2)
+	if err != nil {
+		return false, nil // too short to be gzip; let the snapshot reader complain
+	}
+	return magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
+
+func parseArchiveTime(s string) (time.Time, error) {
+	for _, layout := range archiveTimeLayouts {
+		if ts, err := time.Parse(layout, s); err == nil {
+			return ts, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized ts %q", s)
+}
+
+// loadRestoreRows copies rows into a temporary staging table and inserts the ones whose
+// (station_id, ts) isn't already in table, all in one transaction.
+func loadRestoreRows(db *sql.DB, table string, rows [][]interface{}) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("CREATE TEMP TABLE restore_staging (LIKE dock_status) ON COMMIT DROP"); err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare(pq.CopyIn("restore_staging", dockStatusColumns...))
+	if err != nil {
+		return 0, err
+	}
+	for _, row := range rows {
+		if _, err := stmt.Exec(row...); err != nil {
+			stmt.Close()
+			return 0, err
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return 0, err
+	}
+	if err := stmt.Close(); err != nil {
+		return 0, err
+	}
+	cols := strings.Join(dockStatusColumns, ", ")
+	res, err := tx.Exec(fmt.Sprintf(`INSERT INTO %[1]s (%[2]s)
+SELECT DISTINCT ON (station_id, ts) %[2]s FROM restore_staging s
+WHERE NOT EXISTS (SELECT 1 FROM %[1]s t WHERE t.station_id = s.station_id AND t.ts = s.ts)
+ORDER BY station_id, ts`, table, cols))
+	if err != nil {
+		return 0, err
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return inserted, tx.Commit()
+}
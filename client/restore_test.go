@@ -0,0 +1,114 @@
+package client
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestReadRestoreFile reads both input kinds restore accepts, an archived day and a
+// `ts` JSONL recording, and keeps only the rows inside the requested range, in batches.
+func TestReadRestoreFile(t *testing.T) {
+	dir := t.TempDir()
+	records := [][]string{
+		// written by `archive`
+		{"s1", "Pioneer St", "-74.01", "40.67", "3", "1", "0", "16", "0", "0", "0", "true", "true", "true", "red-hook", "2023-07-23T07:57:00Z"},
+		// written by the old psql prune job; a narrow row with no name
+		{"s2", "", "", "", "5", "0", "1", "10", "0", "0", "0", "t", "t", "t", "", "2023-07-23 04:00:00-04"},
+	}
+	var buf bytes.Buffer
+	i := 0
+	// archived before dock_status had city_id
+	if _, err := writeArchiveCSV(&buf, dockStatusColumns[:dockStatusTS+1], func() ([]string, error) {
+		if i == len(records) {
+			return nil, nil
+		}
+		i++
+		return records[i-1], nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	archived := filepath.Join(dir, "dock_status_2023-07-23.csv.gz")
+	if err := os.WriteFile(archived, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var rows [][]interface{}
+	var batches int
+	collect := func(batch [][]interface{}) error {
+		batches++
+		rows = append(rows, batch...)
+		return nil
+	}
+	from := time.Date(2023, 7, 23, 8, 0, 0, 0, time.UTC)
+	read, err := readRestoreFile(archived, from, from.Add(time.Hour), "", restoreBatch, collect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != 2 || len(rows) != 1 {
+		t.Fatalf("archive: read %d, kept %d; want 2, 1", read, len(rows))
+	}
+	if rows[0][0] != "s2" || rows[0][1] != nil {
+		t.Errorf("archive row = %v, want s2 with a NULL name", rows[0])
+	}
+
+	recording := filepath.Join(dir, "recording.jsonl")
+	jsonl := `{"station":{"id":"s1","name":"Pioneer St"},"timestamp":"2023-07-23T08:03:00Z"}
+{"station":{"id":"s1","name":"Pioneer St"},"timestamp":"2023-07-23T09:03:00Z"}
+`
+	if err := os.WriteFile(recording, []byte(jsonl), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rows = nil
+	read, err = readRestoreFile(recording, from, from.Add(time.Hour), "", restoreBatch, collect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != 2 || len(rows) != 1 || rows[0][0] != "s1" {
+		t.Errorf("recording: read %d, kept %v", read, rows)
+	}
+
+	// the whole recording, a row per batch
+	rows, batches = nil, 0
+	if _, err := readRestoreFile(recording, from, from.Add(2*time.Hour), "", 1, collect); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || batches != 2 {
+		t.Errorf("batched: %d rows in %d batches, want 2 in 2", len(rows), batches)
+	}
+}
+
+// TestReadRestoreFileShared checks that rows restored into a shared database are
+// namespaced for the city, whether recorded raw or archived from a shared database.
+func TestReadRestoreFileShared(t *testing.T) {
+	recording := filepath.Join(t.TempDir(), "recording.jsonl")
+	jsonl := `{"station":{"id":"s1","name":"Pioneer St","neighborhood":"red-hook"},"timestamp":"2023-07-23T08:03:00Z"}
+`
+	if err := os.WriteFile(recording, []byte(jsonl), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var rows [][]interface{}
+	from := time.Date(2023, 7, 23, 8, 0, 0, 0, time.UTC)
+	if _, err := readRestoreFile(recording, from, from.Add(time.Hour), "nyc", restoreBatch, func(batch [][]interface{}) error {
+		rows = append(rows, batch...)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cityID := len(dockStatusColumns) - 1
+	if len(rows) != 1 || rows[0][0] != "nyc:s1" || rows[0][dockStatusNeighborhood] != "nyc:red-hook" || rows[0][cityID] != "nyc" {
+		t.Fatalf("recorded row = %v, want nyc:s1 in nyc:red-hook for nyc", rows)
+	}
+
+	// already namespaced (archived from a shared database) stays as it is
+	archived := []interface{}{"nyc:s1", nil, nil, nil, "3", "1", "0", "16", "0", "0", "0", "t", "t", "t", "nyc:red-hook", from, "nyc"}
+	if err := tenantRow(archived, "nyc"); err != nil || archived[0] != "nyc:s1" || archived[dockStatusNeighborhood] != "nyc:red-hook" {
+		t.Errorf("archived row = %v, %v", archived, err)
+	}
+	archived[cityID] = "dc"
+	if err := tenantRow(archived, "nyc"); err == nil {
+		t.Error("a row of another city was accepted")
+	}
+}
@@ -0,0 +1,350 @@
+package client
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/logging"
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+const (
+	// rollupLookback is how far back every rollup run (or refresh policy) recomputes,
+	// so rows that arrive a little late (a spool replay) still make it in. A restore
+	// loads older rows, and refreshes the rollups for its range itself.
+	rollupLookback = 3 * time.Hour
+	// rollupBatch caps one plain-Postgres rollup run, so the first run on a large
+	// table backfills a week at a time instead of all history in one transaction.
+	rollupBatch = 7 * 24 * time.Hour
+	// rollupInterval is how often the plain-Postgres rollup job runs once caught up.
+	rollupInterval = 15 * time.Minute
+
+	rollupWatermarkKey = "rollup_watermark"
+)
+
+// Rollup kinds: TimescaleDB continuous aggregates, or tables the ingester maintains.
+const (
+	rollupsContinuous = "continuous"
+	rollupsTables     = "tables"
+)
+
+// rollupMeasures are the per-bucket statistics shared by every rollup. Empty means no
+// bikes of either kind (bikes_available counts e-bikes too), full means no free docks.
+const rollupMeasures = `
+       count(*)                                                  AS samples,
+       avg(bikes_available)                                      AS avg_bikes,
+       min(bikes_available)                                      AS min_bikes,
+       max(bikes_available)                                      AS max_bikes,
+       avg(ebikes_available)                                     AS avg_ebikes,
+       min(ebikes_available)                                     AS min_ebikes,
+       max(ebikes_available)                                     AS max_ebikes,
+       avg(docks_available)                                      AS avg_docks,
+       min(docks_available)                                      AS min_docks,
+       max(docks_available)                                      AS max_docks,
+       100.0 * avg(CASE WHEN bikes_available = 0 THEN 1 ELSE 0 END) AS pct_empty,
+       100.0 * avg(CASE WHEN docks_available = 0 THEN 1 ELSE 0 END) AS pct_full`
+
+const rollupMeasureColumns = `
+    samples    bigint  NOT NULL,
+    avg_bikes  numeric,
+    min_bikes  integer,
+    max_bikes  integer,
+    avg_ebikes numeric,
+    min_ebikes integer,
+    max_ebikes integer,
+    avg_docks  numeric,
+    min_docks  integer,
+    max_docks  integer,
+    pct_empty  numeric,
+    pct_full   numeric`
+
+// stationHourlySelect and neighborhoodHourlySelect take the hour bucket expression,
+// the source relation and a WHERE clause.
+const stationHourlySelect = `SELECT station_id, %[1]s AS hour,` + rollupMeasures + `
+FROM %[2]s %[3]s
+GROUP BY station_id, %[1]s`
+
+const neighborhoodHourlySelect = `SELECT neighborhood, %[1]s AS hour,` + rollupMeasures + `
+FROM %[2]s WHERE neighborhood IS NOT NULL %[3]s
+GROUP BY neighborhood, %[1]s`
+
+// createAreaDaily rolls neighborhood_hourly up to area×day, weighting each hour by its
+// samples. Days follow the reader's TimeZone setting, so a session in the city's zone
+// gets local days.
+const createAreaDaily = `
+CREATE OR REPLACE VIEW area_daily AS
+SELECT a.area,
+       date_trunc('day', h.hour)                     AS day,
+       sum(h.samples)                                AS samples,
+       sum(h.avg_bikes * h.samples) / sum(h.samples)  AS avg_bikes,
+       min(h.min_bikes)                              AS min_bikes,
+       max(h.max_bikes)                              AS max_bikes,
+       sum(h.avg_ebikes * h.samples) / sum(h.samples) AS avg_ebikes,
+       min(h.min_ebikes)                             AS min_ebikes,
+       max(h.max_ebikes)                             AS max_ebikes,
+       sum(h.avg_docks * h.samples) / sum(h.samples)  AS avg_docks,
+       min(h.min_docks)                              AS min_docks,
+       max(h.max_docks)                              AS max_docks,
+       sum(h.pct_empty * h.samples) / sum(h.samples)  AS pct_empty,
+       sum(h.pct_full * h.samples) / sum(h.samples)   AS pct_full
+FROM neighborhood_hourly h
+JOIN neighborhood_areas a USING (neighborhood)
+GROUP BY a.area, date_trunc('day', h.hour);
+`
+
+const createNeighborhoodAreasTable = `
+CREATE TABLE IF NOT EXISTS neighborhood_areas (
+    neighborhood text PRIMARY KEY,
+    area         text NOT NULL
+);
+`
+
+// continuousAggregates creates the rollups as TimescaleDB continuous aggregates with
+// refresh policies. CREATE MATERIALIZED VIEW ... WITH (timescaledb.continuous) can't
+// run inside a transaction, which is why this isn't a migration: the ingester runs it,
+// like the hypertable setup, once dock_status is a hypertable. They read dock_status
+// directly, so the neighborhood rollup needs wide rows; with --narrow-facts,
+// setupRollups keeps rollupTables instead.
+func continuousAggregates() []string {
+	bucket := "time_bucket(INTERVAL '1 hour', ts)"
+	var stmts []string
+	for _, agg := range []struct{ name, query string }{
+		{"station_hourly", fmt.Sprintf(stationHourlySelect, bucket, "dock_status", "")},
+		{"neighborhood_hourly", fmt.Sprintf(neighborhoodHourlySelect, bucket, "dock_status", "")},
+	} {
+		stmts = append(stmts,
+			fmt.Sprintf("CREATE MATERIALIZED VIEW IF NOT EXISTS %s WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS\n%s\nWITH NO DATA",
+				agg.name, agg.query),
+			fmt.Sprintf("SELECT add_continuous_aggregate_policy('%s', start_offset => INTERVAL '%d hours', end_offset => INTERVAL '1 hour', schedule_interval => INTERVAL '30 minutes', if_not_exists => true)",
+				agg.name, int(rollupLookback.Hours())),
+		)
+	}
+	return append(stmts, createAreaDaily)
+}
+
+// rollupTables is the plain-Postgres (or --narrow-facts) equivalent: ordinary tables
+// kept current by refreshRollups.
+var rollupTables = []string{
+	`CREATE TABLE IF NOT EXISTS station_hourly (
+    station_id text        NOT NULL,
+    hour       timestamptz NOT NULL,` + rollupMeasureColumns + `,
+    PRIMARY KEY (station_id, hour)
+)`,
+	`CREATE TABLE IF NOT EXISTS neighborhood_hourly (
+    neighborhood text        NOT NULL,
+    hour         timestamptz NOT NULL,` + rollupMeasureColumns + `,
+    PRIMARY KEY (neighborhood, hour)
+)`,
+	createAreaDaily,
+}
+
+// setupRollups creates the rollups for the storage the ingester ended up with. Like the
+// rest of the storage setup it's non-fatal: without rollups, ingestion still works.
+func (c *Client) setupRollups(db *sql.DB, hypertable bool) {
+	if hypertable && c.narrowFacts {
+		// continuous aggregates read dock_status itself, where narrow rows have no
+		// neighborhood; the tables read dock_status_wide instead
+		switch kind, err := rollupKind(db); {
+		case err != nil:
+			slog.Warn("rollup check failed (non-fatal)", logging.Error(err, "db"))
+		case kind == rollupsContinuous:
+			slog.Warn("neighborhood_hourly is a continuous aggregate, which leaves out narrow rows; " +
+				"drop station_hourly, neighborhood_hourly and area_daily to have rollup tables kept instead")
+		default:
+			hypertable = false
+			slog.Info("rollups: --narrow-facts keeps rollup tables from dock_status_wide instead of continuous aggregates")
+		}
+	}
+	if hypertable {
+		for _, stmt := range continuousAggregates() {
+			if _, err := db.Exec(stmt); err != nil {
+				slog.Warn("continuous aggregate setup failed (non-fatal)", logging.Error(err, "db"))
+				return
+			}
+		}
+		c.rollups = rollupsContinuous
+		slog.Info("timescaledb: station_hourly and neighborhood_hourly are continuous aggregates")
+	} else {
+		for _, stmt := range rollupTables {
+			if _, err := db.Exec(stmt); err != nil {
+				slog.Warn("rollup table setup failed (non-fatal)", logging.Error(err, "db"))
+				return
+			}
+		}
+		c.rollups = rollupsTables
+	}
+	if err := c.syncNeighborhoodAreas(db); err != nil {
+		slog.Warn("neighborhood_areas sync failed (non-fatal)", logging.Error(err, "db"))
+	}
+}
+
+// syncNeighborhoodAreas records which area each loaded neighborhood belongs to, for
+// area_daily.
+func (c *Client) syncNeighborhoodAreas(db *sql.DB) error {
+	if len(c.filter.neighborhoods) == 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, n := range c.filter.neighborhoods {
+		if _, err := tx.Exec(`INSERT INTO neighborhood_areas (neighborhood, area) VALUES ($1, $2)
+ON CONFLICT (neighborhood) DO UPDATE SET area = EXCLUDED.area`, namespacedID(c.tenant, n.Slug), n.Area); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// refreshRollups recomputes the plain-Postgres rollup tables from the watermark (less
+// rollupLookback) up to the last complete hour, at most rollupBatch at a time, and
+// reports whether it caught up. In a shared database each city's ingester refreshes
+// only its own city's rows, with its own watermark.
+func refreshRollups(db *sql.DB, now time.Time, city string) (caughtUp bool, err error) {
+	key, firstQuery := rollupWatermarkKey, "SELECT min(ts) FROM dock_status"
+	var args []interface{}
+	if city != "" {
+		key += tenantSeparator + city
+		firstQuery += " WHERE city_id = $1"
+		args = append(args, city)
+	}
+
+	var watermark time.Time
+	var raw string
+	switch err := db.QueryRow("SELECT value FROM app_metadata WHERE key = $1", key).Scan(&raw); err {
+	case nil:
+		if watermark, err = time.Parse(time.RFC3339, raw); err != nil {
+			return false, fmt.Errorf("bad %s %q: %w", key, raw, err)
+		}
+	case sql.ErrNoRows:
+		var first sql.NullTime
+		if err := db.QueryRow(firstQuery, args...).Scan(&first); err != nil {
+			return false, err
+		}
+		if !first.Valid {
+			return true, nil
+		}
+		watermark = first.Time.Truncate(time.Hour)
+	default:
+		return false, err
+	}
+
+	start, end := rollupWindow(watermark, now)
+	if !start.Before(end) {
+		return true, nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if err := recomputeRollupTables(tx, start, end, city); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`INSERT INTO app_metadata (key, value) VALUES ($1, $2)
+ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value`, key, end.UTC().Format(time.RFC3339)); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return !end.Before(now.Truncate(time.Hour)), nil
+}
+
+// recomputeRollupTables replaces the rollup table rows for the hours in [start, end)
+// with ones computed from dock_status_wide; in a shared database, only city's.
+func recomputeRollupTables(tx *sql.Tx, start, end time.Time, city string) error {
+	args := []interface{}{start, end}
+	source := ""                                     // the city's dock_status rows
+	ownedBy := func(col string) string { return "" } // the city's rollup rows, by namespaced col
+	if city != "" {
+		args = append(args, city)
+		source = " AND city_id = $3"
+		ownedBy = func(col string) string {
+			return fmt.Sprintf(" AND left(%s, length($3) + 1) = $3 || '%s'", col, tenantSeparator)
+		}
+	}
+	window := "ts >= $1 AND ts < $2" + source
+	for _, stmt := range []string{
+		"DELETE FROM station_hourly WHERE hour >= $1 AND hour < $2" + ownedBy("station_id"),
+		"INSERT INTO station_hourly " + fmt.Sprintf(stationHourlySelect, "date_trunc('hour', ts)", "dock_status_wide", "WHERE "+window),
+		"DELETE FROM neighborhood_hourly WHERE hour >= $1 AND hour < $2" + ownedBy("neighborhood"),
+		"INSERT INTO neighborhood_hourly " + fmt.Sprintf(neighborhoodHourlySelect, "date_trunc('hour', ts)", "dock_status_wide", "AND "+window),
+	} {
+		if _, err := tx.Exec(stmt, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshRollupRange brings the rollups up to date for [from, to) after rows landed
+// there outside rollupLookback, as a restore does. It's a no-op when the database has
+// no rollups yet.
+func refreshRollupRange(db *sql.DB, from, to time.Time, city string) error {
+	kind, err := rollupKind(db)
+	if err != nil || kind == "" {
+		return err
+	}
+	from = from.Truncate(time.Hour)
+	if kind == rollupsContinuous {
+		// CALL can't run inside a transaction or take its window as parameters
+		for _, agg := range []string{"station_hourly", "neighborhood_hourly"} {
+			if _, err := db.Exec(fmt.Sprintf("CALL refresh_continuous_aggregate('%s', '%s'::timestamptz, '%s'::timestamptz)",
+				agg, from.Format(time.RFC3339), to.Format(time.RFC3339))); err != nil {
+				return fmt.Errorf("refresh %s: %w", agg, err)
+			}
+		}
+		return nil
+	}
+	for start := from; start.Before(to); start = start.Add(rollupBatch) {
+		end := start.Add(rollupBatch)
+		if end.After(to) {
+			end = to
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := recomputeRollupTables(tx, start, end, city); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollupKind reports how the database keeps its rollups: rollupsContinuous,
+// rollupsTables, or "" when station_hourly doesn't exist (no ingester has led yet).
+func rollupKind(db *sql.DB) (string, error) {
+	var kind sql.NullString
+	if err := db.QueryRow("SELECT relkind::text FROM pg_class WHERE oid = to_regclass('station_hourly')").Scan(&kind); err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	switch kind.String {
+	case "":
+		return "", nil
+	case "r":
+		return rollupsTables, nil
+	}
+	return rollupsContinuous, nil // a continuous aggregate is a view over its hypertable
+}
+
+// rollupWindow is the [start, end) range of hours one rollup run recomputes.
+func rollupWindow(watermark, now time.Time) (start, end time.Time) {
+	end = now.Truncate(time.Hour)
+	start = watermark
+	if lookback := end.Add(-rollupLookback); lookback.Before(start) {
+		start = lookback
+	}
+	if end.Sub(start) > rollupBatch {
+		end = start.Add(rollupBatch)
+	}
+	return start, end
+}
@@ -0,0 +1,30 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRollupWindow covers which hours one plain-Postgres rollup run recomputes.
+func TestRollupWindow(t *testing.T) {
+	hour := func(d, h int) time.Time { return time.Date(2023, 7, d, h, 0, 0, 0, time.UTC) }
+	now := hour(22, 14).Add(20 * time.Minute)
+
+	for _, tc := range []struct {
+		name       string
+		watermark  time.Time
+		start, end time.Time
+	}{
+		// caught up: only the lookback is recomputed, up to the last complete hour
+		{"caught up", hour(22, 14), hour(22, 11), hour(22, 14)},
+		// a short outage reaches back past the lookback to the watermark
+		{"behind", hour(22, 6), hour(22, 6), hour(22, 14)},
+		// a first run over old rows is capped at one batch
+		{"backfill", hour(1, 0), hour(1, 0), hour(8, 0)},
+	} {
+		start, end := rollupWindow(tc.watermark, now)
+		if !start.Equal(tc.start) || !end.Equal(tc.end) {
+			t.Errorf("%s: window [%s, %s), want [%s, %s)", tc.name, start, end, tc.start, tc.end)
+		}
+	}
+}
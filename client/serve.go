@@ -0,0 +1,558 @@
+package client
+
+import (
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/logging"
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+	"github.com/lib/pq"
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+//go:embed openapi.json
+var openAPIJSON []byte
+
+const (
+	DefaultServeAddr   = ":8080"
+	DefaultServeMaxAge = 30 * time.Second
+
+	apiPageSize    = 500
+	apiMaxPageSize = 5000
+	// apiMaxPoints bounds a history or hourly response; pick a coarser step (or a
+	// shorter range) for more.
+	apiMaxPoints = 5000
+	// apiAutoPoints is what history aims for when no step is given.
+	apiAutoPoints = 500
+	// apiSettled is how old data must be before a response is cached as immutable.
+	apiSettled = time.Hour
+)
+
+// ServeOptions configures Serve.
+type ServeOptions struct {
+	Addr   string
+	MaxAge time.Duration // Cache-Control max-age for responses that include current data
+	// City restricts a shared database to one city's stations; ignored elsewhere.
+	City string
+}
+
+// Serve runs the read-only JSON API over the ingested data (see newAPI and
+// openapi.json) until the listener fails.
+func Serve(dsn string, opts ServeOptions) error {
+	if opts.Addr == "" {
+		opts.Addr = DefaultServeAddr
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = DefaultServeMaxAge
+	}
+	db, err := openPostgres(dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := ensureSchemaCurrent(db); err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(8)
+	if shared, err := isShared(db); err != nil {
+		return err
+	} else if !shared {
+		opts.City = ""
+	}
+
+	srv := &http.Server{Addr: opts.Addr, Handler: newAPI(db, opts), ReadHeaderTimeout: 10 * time.Second}
+	slog.Info("serving the read API", "addr", opts.Addr)
+	return srv.ListenAndServe()
+}
+
+type api struct {
+	db   *sql.DB
+	opts ServeOptions
+}
+
+// newAPI routes the read API. Every query reads the current stations dimension and
+// each station's latest dock_status row through dock_status_station_ts_desc_idx, or a
+// rollup by its primary key, so none of them scans dock_status.
+func newAPI(db *sql.DB, opts ServeOptions) http.Handler {
+	a := &api{db: db, opts: opts}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/v1/openapi.json", a.get(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		_, err := w.Write(openAPIJSON)
+		return err
+	}))
+	mux.HandleFunc("/v1/stations", a.get(a.stations))
+	mux.HandleFunc("/v1/stations/", a.get(a.stationHistory))
+	mux.HandleFunc("/v1/neighborhoods", a.get(a.neighborhoods))
+	mux.HandleFunc("/v1/neighborhoods/", a.get(a.neighborhoodHourly))
+	return mux
+}
+
+// apiError is an error with the status to answer it with; anything else is a 500.
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (e apiError) Error() string { return e.msg }
+
+func badRequest(format string, args ...interface{}) error {
+	return apiError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+// get adapts a handler to GET/HEAD only and renders its error as JSON.
+func (a *api) get(h func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeAPIError(w, apiError{http.StatusMethodNotAllowed, "method not allowed"})
+			return
+		}
+		if err := h(w, r); err != nil {
+			var ae apiError
+			if !errors.As(err, &ae) {
+				slog.Error("api: request failed", "path", r.URL.Path, logging.Error(err, "db"))
+				ae = apiError{http.StatusInternalServerError, "internal error"}
+			}
+			writeAPIError(w, ae)
+		}
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, e apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(e.status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": e.msg})
+}
+
+// writeCachedJSON writes v with Cache-Control max-age and a weak ETag of the body,
+// answering a matching If-None-Match with 304.
+func writeCachedJSON(w http.ResponseWriter, r *http.Request, v interface{}, maxAge time.Duration) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(body)
+	etag := fmt.Sprintf(`W/"%x"`, h.Sum64())
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	if match := r.Header.Get("If-None-Match"); match != "" && (match == etag || match == "*") {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err = w.Write(append(body, '\n'))
+	return err
+}
+
+// APIStation is a station's latest status as the API returns it.
+type APIStation struct {
+	types.NormalizedStation
+	Capacity  int       `json:"capacity,omitempty"`
+	Area      string    `json:"area,omitempty"`
+	TimeStamp time.Time `json:"timestamp"`
+}
+
+type stationsPage struct {
+	Stations   []APIStation `json:"stations"`
+	NextCursor string       `json:"nextCursor,omitempty"`
+}
+
+// sqlFilter accumulates WHERE conditions and their numbered arguments.
+type sqlFilter struct {
+	conds []string
+	args  []interface{}
+}
+
+// arg adds a bind argument and returns its placeholder.
+func (f *sqlFilter) arg(v interface{}) string {
+	f.args = append(f.args, v)
+	return "$" + strconv.Itoa(len(f.args))
+}
+
+func (f *sqlFilter) add(cond string) { f.conds = append(f.conds, cond) }
+
+func (f *sqlFilter) where() string {
+	if len(f.conds) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(f.conds, " AND ")
+}
+
+// stationFilters turns the neighborhood, area and bbox query parameters into
+// conditions on the current stations dimension (s) and neighborhood_areas (a).
+// neighborhood may repeat or be comma-separated.
+func (a *api) stationFilters(q url.Values) (*sqlFilter, error) {
+	f := &sqlFilter{}
+	f.add("s.valid_to IS NULL")
+	if a.opts.City != "" {
+		p := f.arg(cityPrefix(a.opts.City))
+		f.add(fmt.Sprintf("left(s.station_id, length(%s)) = %s", p, p))
+	}
+	var hoods []string
+	for _, v := range q["neighborhood"] {
+		for _, n := range strings.Split(v, ",") {
+			if n = strings.TrimSpace(n); n != "" {
+				hoods = append(hoods, n)
+			}
+		}
+	}
+	if len(hoods) > 0 {
+		f.add("s.neighborhood = ANY(" + f.arg(pq.Array(hoods)) + ")")
+	}
+	if area := q.Get("area"); area != "" {
+		f.add("a.area = " + f.arg(area))
+	}
+	if v := q.Get("bbox"); v != "" {
+		b, err := ParseBBox(v)
+		if err != nil {
+			return nil, badRequest("%v", err)
+		}
+		f.add(fmt.Sprintf("s.latitude BETWEEN %s AND %s AND s.longitude BETWEEN %s AND %s",
+			f.arg(b.MinLat), f.arg(b.MaxLat), f.arg(b.MinLon), f.arg(b.MaxLon)))
+	}
+	return f, nil
+}
+
+// latestStatus is each current station's newest dock_status row.
+const latestStatus = `
+FROM stations s
+LEFT JOIN neighborhood_areas a ON a.neighborhood = s.neighborhood
+CROSS JOIN LATERAL (
+    SELECT * FROM dock_status x WHERE x.station_id = s.station_id ORDER BY x.ts DESC LIMIT 1
+) d
+`
+
+// stations serves GET /v1/stations: the latest status of every current station,
+// ordered by station ID and paginated by cursor (the last ID of the previous page).
+func (a *api) stations(w http.ResponseWriter, r *http.Request) error {
+	if r.URL.Path != "/v1/stations" {
+		return apiError{http.StatusNotFound, "not found"}
+	}
+	q := r.URL.Query()
+	limit, err := pageLimit(q.Get("limit"))
+	if err != nil {
+		return err
+	}
+	f, err := a.stationFilters(q)
+	if err != nil {
+		return err
+	}
+	if cursor := q.Get("cursor"); cursor != "" {
+		f.add("s.station_id > " + f.arg(cursor))
+	}
+	query := `SELECT s.station_id, s.name, coalesce(s.longitude, 0), coalesce(s.latitude, 0), coalesce(s.capacity, 0),
+       coalesce(s.neighborhood, ''), coalesce(a.area, ''),
+       coalesce(d.bikes_available, 0), coalesce(d.ebikes_available, 0), coalesce(d.bikes_disabled, 0),
+       coalesce(d.docks_available, 0), coalesce(d.docks_disabled, 0),
+       coalesce(d.scooters_available, 0), coalesce(d.scooters_unavailable, 0),
+       coalesce(d.is_returning, false), coalesce(d.is_renting, false), coalesce(d.is_installed, false), d.ts` +
+		latestStatus + f.where() + "\nORDER BY s.station_id LIMIT " + f.arg(limit+1)
+	rows, err := a.db.QueryContext(r.Context(), query, f.args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	page := stationsPage{Stations: []APIStation{}}
+	for rows.Next() {
+		var st APIStation
+		s := &st.NormalizedStation
+		if err := rows.Scan(&s.ID, &s.Name, &s.Longitude, &s.Latitude, &st.Capacity, &s.Neighborhood, &st.Area,
+			&s.BikesAvailable, &s.EBikesAvailable, &s.BikesDisabled, &s.DocksAvailable, &s.DocksDisabled,
+			&s.ScootersAvailable, &s.ScootersUnavailable, &s.IsReturning, &s.IsRenting, &s.IsInstalled,
+			&st.TimeStamp); err != nil {
+			return err
+		}
+		s.Location = fmt.Sprintf(GoogleMapsQuery, s.Latitude, s.Longitude)
+		page.Stations = append(page.Stations, st)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(page.Stations) > limit {
+		page.Stations = page.Stations[:limit]
+		page.NextCursor = page.Stations[limit-1].ID
+	}
+	return writeCachedJSON(w, r, page, a.opts.MaxAge)
+}
+
+func pageLimit(v string) (int, error) {
+	if v == "" {
+		return apiPageSize, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 || n > apiMaxPageSize {
+		return 0, badRequest("limit must be between 1 and %d", apiMaxPageSize)
+	}
+	return n, nil
+}
+
+// Stats summarizes a count over a bucket.
+type Stats struct {
+	Avg float64 `json:"avg"`
+	Min int     `json:"min"`
+	Max int     `json:"max"`
+}
+
+// HistoryPoint is one downsampled bucket of a station's history.
+type HistoryPoint struct {
+	Time    time.Time `json:"time"`
+	Samples int       `json:"samples"`
+	Bikes   Stats     `json:"bikes"`
+	EBikes  Stats     `json:"eBikes"`
+	Docks   Stats     `json:"docks"`
+}
+
+type stationHistory struct {
+	StationID string         `json:"stationId"`
+	From      time.Time      `json:"from"`
+	To        time.Time      `json:"to"`
+	Step      string         `json:"step"`
+	Points    []HistoryPoint `json:"points"`
+}
+
+// parseTimeRange parses the from/to query parameters (RFC 3339). to defaults to now and
+// from to a day before to.
+func parseTimeRange(q url.Values, now time.Time) (from, to time.Time, err error) {
+	to = now
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, badRequest("to: %v", err)
+		}
+	}
+	from = to.Add(-24 * time.Hour)
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, badRequest("from: %v", err)
+		}
+	}
+	if !from.Before(to) {
+		return from, to, badRequest("from must be before to")
+	}
+	return from, to, nil
+}
+
+// historyStep parses the step query parameter (a Go duration, at least a minute), or
+// picks a whole number of minutes giving about apiAutoPoints buckets.
+func historyStep(v string, span time.Duration) (time.Duration, error) {
+	if v == "" {
+		step := time.Duration(math.Ceil(float64(span)/apiAutoPoints/float64(time.Minute))) * time.Minute
+		if step < time.Minute {
+			step = time.Minute
+		}
+		return step, nil
+	}
+	step, err := time.ParseDuration(v)
+	if err != nil || step < time.Minute {
+		return 0, badRequest("step must be a duration of at least 1m")
+	}
+	if span/step > apiMaxPoints {
+		return 0, badRequest("%s over %s is more than %d points; use a larger step", step, span, apiMaxPoints)
+	}
+	return step, nil
+}
+
+// cacheAge is how long a response for data up to `to` may be cached: current data
+// for MaxAge, settled history for a day.
+func (a *api) cacheAge(to time.Time) time.Duration {
+	if time.Since(to) > apiSettled {
+		return 24 * time.Hour
+	}
+	return a.opts.MaxAge
+}
+
+// stationHistory serves GET /v1/stations/{id}/history: the station's counts between
+// from and to, averaged (with min and max) over step-sized buckets.
+func (a *api) stationHistory(w http.ResponseWriter, r *http.Request) error {
+	id, ok := pathParam(r.URL.EscapedPath(), "/v1/stations/", "/history")
+	if !ok || !a.ownID(id) {
+		return apiError{http.StatusNotFound, "not found"}
+	}
+	q := r.URL.Query()
+	from, to, err := parseTimeRange(q, time.Now())
+	if err != nil {
+		return err
+	}
+	step, err := historyStep(q.Get("step"), to.Sub(from))
+	if err != nil {
+		return err
+	}
+	rows, err := a.db.QueryContext(r.Context(), `
+SELECT to_timestamp(floor(extract(epoch FROM ts) / $4) * $4) AS bucket, count(*),
+       coalesce(avg(bikes_available), 0), coalesce(min(bikes_available), 0), coalesce(max(bikes_available), 0),
+       coalesce(avg(ebikes_available), 0), coalesce(min(ebikes_available), 0), coalesce(max(ebikes_available), 0),
+       coalesce(avg(docks_available), 0), coalesce(min(docks_available), 0), coalesce(max(docks_available), 0)
+FROM dock_status
+WHERE station_id = $1 AND ts >= $2 AND ts < $3
+GROUP BY bucket ORDER BY bucket`, id, from, to, step.Seconds())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	out := stationHistory{StationID: id, From: from, To: to, Step: step.String(), Points: []HistoryPoint{}}
+	for rows.Next() {
+		var p HistoryPoint
+		if err := rows.Scan(&p.Time, &p.Samples, &p.Bikes.Avg, &p.Bikes.Min, &p.Bikes.Max,
+			&p.EBikes.Avg, &p.EBikes.Min, &p.EBikes.Max, &p.Docks.Avg, &p.Docks.Min, &p.Docks.Max); err != nil {
+			return err
+		}
+		out.Points = append(out.Points, p)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return writeCachedJSON(w, r, out, a.cacheAge(to))
+}
+
+// pathParam extracts the single escaped segment between prefix and suffix.
+func pathParam(path, prefix, suffix string) (string, bool) {
+	if !strings.HasPrefix(path, prefix) || !strings.HasSuffix(path, suffix) {
+		return "", false
+	}
+	seg := strings.TrimSuffix(strings.TrimPrefix(path, prefix), suffix)
+	if seg == "" || strings.Contains(seg, "/") {
+		return "", false
+	}
+	v, err := url.PathUnescape(seg)
+	return v, err == nil
+}
+
+// ownID reports whether a (namespaced) station ID or neighborhood slug belongs to the
+// served city; always true outside a shared database.
+func (a *api) ownID(id string) bool {
+	return strings.HasPrefix(id, cityPrefix(a.opts.City))
+}
+
+// NeighborhoodStatus aggregates the latest status of a neighborhood's stations.
+type NeighborhoodStatus struct {
+	Neighborhood  string    `json:"neighborhood"`
+	Area          string    `json:"area,omitempty"`
+	Stations      int       `json:"stations"`
+	Bikes         int       `json:"bikes"`
+	EBikes        int       `json:"eBikes"`
+	Docks         int       `json:"docks"`
+	EmptyStations int       `json:"emptyStations"`
+	FullStations  int       `json:"fullStations"`
+	TimeStamp     time.Time `json:"timestamp"` // the newest status included
+}
+
+// neighborhoods serves GET /v1/neighborhoods: per-neighborhood totals over the latest
+// status of their stations, filtered like /v1/stations.
+func (a *api) neighborhoods(w http.ResponseWriter, r *http.Request) error {
+	if r.URL.Path != "/v1/neighborhoods" {
+		return apiError{http.StatusNotFound, "not found"}
+	}
+	f, err := a.stationFilters(r.URL.Query())
+	if err != nil {
+		return err
+	}
+	f.add("s.neighborhood IS NOT NULL")
+	rows, err := a.db.QueryContext(r.Context(), `SELECT s.neighborhood, coalesce(a.area, ''), count(*),
+       coalesce(sum(d.bikes_available), 0), coalesce(sum(d.ebikes_available), 0), coalesce(sum(d.docks_available), 0),
+       count(*) FILTER (WHERE d.bikes_available = 0), count(*) FILTER (WHERE d.docks_available = 0), max(d.ts)`+
+		latestStatus+f.where()+"\nGROUP BY s.neighborhood, a.area ORDER BY s.neighborhood", f.args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	out := struct {
+		Neighborhoods []NeighborhoodStatus `json:"neighborhoods"`
+	}{Neighborhoods: []NeighborhoodStatus{}}
+	for rows.Next() {
+		var n NeighborhoodStatus
+		if err := rows.Scan(&n.Neighborhood, &n.Area, &n.Stations, &n.Bikes, &n.EBikes, &n.Docks,
+			&n.EmptyStations, &n.FullStations, &n.TimeStamp); err != nil {
+			return err
+		}
+		out.Neighborhoods = append(out.Neighborhoods, n)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return writeCachedJSON(w, r, out, a.opts.MaxAge)
+}
+
+// HourlyPoint is one hour of a neighborhood rollup.
+type HourlyPoint struct {
+	Hour     time.Time `json:"hour"`
+	Samples  int64     `json:"samples"`
+	Bikes    Stats     `json:"bikes"`
+	EBikes   Stats     `json:"eBikes"`
+	Docks    Stats     `json:"docks"`
+	PctEmpty float64   `json:"pctEmpty"`
+	PctFull  float64   `json:"pctFull"`
+}
+
+// neighborhoodHourly serves GET /v1/neighborhoods/{slug}/hourly from the
+// neighborhood_hourly rollup.
+func (a *api) neighborhoodHourly(w http.ResponseWriter, r *http.Request) error {
+	slug, ok := pathParam(r.URL.EscapedPath(), "/v1/neighborhoods/", "/hourly")
+	if !ok || !a.ownID(slug) {
+		return apiError{http.StatusNotFound, "not found"}
+	}
+	from, to, err := parseTimeRange(r.URL.Query(), time.Now())
+	if err != nil {
+		return err
+	}
+	if to.Sub(from)/time.Hour > apiMaxPoints {
+		return badRequest("range is more than %d hours", apiMaxPoints)
+	}
+	var exists bool
+	if err := a.db.QueryRowContext(r.Context(), "SELECT to_regclass('neighborhood_hourly') IS NOT NULL").Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return apiError{http.StatusServiceUnavailable, "neighborhood_hourly doesn't exist yet (the ingester creates it)"}
+	}
+	rows, err := a.db.QueryContext(r.Context(), `
+SELECT hour, samples,
+       coalesce(avg_bikes, 0), coalesce(min_bikes, 0), coalesce(max_bikes, 0),
+       coalesce(avg_ebikes, 0), coalesce(min_ebikes, 0), coalesce(max_ebikes, 0),
+       coalesce(avg_docks, 0), coalesce(min_docks, 0), coalesce(max_docks, 0),
+       coalesce(pct_empty, 0), coalesce(pct_full, 0)
+FROM neighborhood_hourly
+WHERE neighborhood = $1 AND hour >= $2 AND hour < $3
+ORDER BY hour`, slug, from, to)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	out := struct {
+		Neighborhood string        `json:"neighborhood"`
+		Points       []HourlyPoint `json:"points"`
+	}{Neighborhood: slug, Points: []HourlyPoint{}}
+	for rows.Next() {
+		var p HourlyPoint
+		if err := rows.Scan(&p.Hour, &p.Samples, &p.Bikes.Avg, &p.Bikes.Min, &p.Bikes.Max,
+			&p.EBikes.Avg, &p.EBikes.Min, &p.EBikes.Max, &p.Docks.Avg, &p.Docks.Min, &p.Docks.Max,
+			&p.PctEmpty, &p.PctFull); err != nil {
+			return err
+		}
+		out.Points = append(out.Points, p)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return writeCachedJSON(w, r, out, a.cacheAge(to))
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// TestHistoryStep covers the default and explicit history bucket sizes.
+func TestHistoryStep(t *testing.T) {
+	for _, tc := range []struct {
+		step string
+		span time.Duration
+		want time.Duration
+		err  bool
+	}{
+		{"", 24 * time.Hour, 3 * time.Minute, false}, // 1440 minutes / 500, rounded up
+		{"", time.Hour, time.Minute, false},
+		{"15m", 7 * 24 * time.Hour, 15 * time.Minute, false},
+		{"30s", time.Hour, 0, true},
+		{"1m", 30 * 24 * time.Hour, 0, true}, // 43,200 points
+		{"soon", time.Hour, 0, true},
+	} {
+		got, err := historyStep(tc.step, tc.span)
+		if (err != nil) != tc.err || got != tc.want {
+			t.Errorf("historyStep(%q, %s) = %s, %v; want %s (error %v)", tc.step, tc.span, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+// TestStationFilters checks the query parameters become numbered conditions.
+func TestStationFilters(t *testing.T) {
+	a := &api{opts: ServeOptions{City: "nyc"}}
+	q := url.Values{"neighborhood": {"red-hook,dumbo", "gowanus"}, "area": {"Brooklyn"}, "bbox": {"40.6,-74.1,40.8,-73.9"}}
+	f, err := a.stationFilters(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "WHERE s.valid_to IS NULL AND left(s.station_id, length($1)) = $1 AND s.neighborhood = ANY($2) AND a.area = $3" +
+		" AND s.latitude BETWEEN $4 AND $5 AND s.longitude BETWEEN $6 AND $7"
+	if got := f.where(); got != want {
+		t.Errorf("where:\n got %s\nwant %s", got, want)
+	}
+	if len(f.args) != 7 || f.args[0] != "nyc:" {
+		t.Errorf("args: %v", f.args)
+	}
+	if _, err := a.stationFilters(url.Values{"bbox": {"1,2,3"}}); err == nil {
+		t.Error("a short bbox was accepted")
+	}
+}
+
+// TestPathParam covers extracting the ID from /v1/stations/{id}/history.
+func TestPathParam(t *testing.T) {
+	for path, want := range map[string]string{
+		"/v1/stations/66db2fd0-0aca-11e7-82f6-3863bb44ef7c/history": "66db2fd0-0aca-11e7-82f6-3863bb44ef7c",
+		"/v1/stations/nyc%3A123/history":                            "nyc:123",
+		"/v1/stations//history":                                     "",
+		"/v1/stations/a/b/history":                                  "",
+		"/v1/stations/123":                                          "",
+	} {
+		got, ok := pathParam(path, "/v1/stations/", "/history")
+		if got != want || ok != (want != "") {
+			t.Errorf("pathParam(%q) = %q, %v; want %q", path, got, ok, want)
+		}
+	}
+}
+
+// TestWriteCachedJSON checks responses carry caching headers and a matching
+// If-None-Match gets a bodiless 304.
+func TestWriteCachedJSON(t *testing.T) {
+	body := map[string]int{"stations": 3}
+	rec := httptest.NewRecorder()
+	if err := writeCachedJSON(rec, httptest.NewRequest("GET", "/v1/stations", nil), body, 30*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "public, max-age=30" {
+		t.Errorf("got %d, Cache-Control %q", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+	var decoded map[string]int
+	if err := json.Unmarshal(rec.Body.Bytes(), &decoded); err != nil || decoded["stations"] != 3 {
+		t.Errorf("body %q: %v", rec.Body.String(), err)
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+
+	req := httptest.NewRequest("GET", "/v1/stations", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	if err := writeCachedJSON(rec, req, body, 30*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("revalidation: got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+}
+
+// TestAPIRejects covers requests answered before any query runs.
+func TestAPIRejects(t *testing.T) {
+	h := newAPI(nil, ServeOptions{City: "nyc", MaxAge: time.Minute})
+	for _, tc := range []struct {
+		method, path string
+		want         int
+	}{
+		{"POST", "/v1/stations", http.StatusMethodNotAllowed},
+		{"GET", "/v1/stations?limit=0", http.StatusBadRequest},
+		{"GET", "/v1/stations?bbox=north", http.StatusBadRequest},
+		{"GET", "/v1/stations/nyc%3A1/history?from=yesterday", http.StatusBadRequest},
+		{"GET", "/v1/stations/nyc%3A1/history?step=1m&from=2023-01-01T00:00:00Z&to=2023-02-01T00:00:00Z", http.StatusBadRequest},
+		{"GET", "/v1/stations/jc%3A1/history", http.StatusNotFound},
+		{"GET", "/v1/stations/nyc%3A1", http.StatusNotFound},
+		{"GET", "/v1/openapi.json", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+		if rec.Code != tc.want {
+			t.Errorf("%s %s: got %d, want %d (%s)", tc.method, tc.path, rec.Code, tc.want, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package client
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/logging"
+	"github.com/kardolus/citi-bike-dock-tracker/metrics"
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+	"github.com/lib/pq"
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+const (
+	// DefaultSpoolMaxBytes bounds the spool when no limit is given.
+	DefaultSpoolMaxBytes = 256 << 20
+	// spoolSegmentBytes is the size at which a new segment file is started. Whole
+	// segments are the unit the size bound drops.
+	spoolSegmentBytes = 8 << 20
+	spoolSegmentExt   = ".spool"
+)
+
+// Spool is a disk-backed write-ahead queue for dock_status batches that couldn't be
+// written. Each batch is one JSON line appended (and fsynced) to the newest segment
+// file; segments are named by the time they were started, so a directory listing is
+// the replay order. When the spool outgrows its bound the oldest segment is dropped.
+// A Spool is not safe for concurrent use; the ingest loop owns it.
+type Spool struct {
+	dir      string
+	maxBytes int64
+	segments []spoolSegment // oldest first
+	seq      int64          // last segment name used; names must stay increasing
+	open     bool           // the newest segment was started by this process
+}
+
+type spoolSegment struct {
+	path   string
+	bytes  int64
+	rows   int
+	oldest time.Time // ts of the first batch in the segment
+}
+
+// OpenSpool opens (creating if needed) the spool in dir and indexes any segments left
+// by a previous run, so they are replayed after a restart.
+func OpenSpool(dir string, maxBytes int64) (*Spool, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultSpoolMaxBytes
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("spool dir: %w", err)
+	}
+	s := &Spool{dir: dir, maxBytes: maxBytes}
+	names, err := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		seg, err := scanSegment(name)
+		if err != nil {
+			return nil, fmt.Errorf("spool segment %s: %w", name, err)
+		}
+		if seg.rows == 0 {
+			os.Remove(name)
+			continue
+		}
+		s.segments = append(s.segments, seg)
+	}
+	if n := len(s.segments); n > 0 {
+		fmt.Sscanf(filepath.Base(s.segments[n-1].path), "%d", &s.seq)
+	}
+	s.publish()
+	return s, nil
+}
+
+// scanSegment counts the rows in a segment and reads its oldest timestamp. A torn
+// final line (a crash mid-append) is ignored here and skipped on replay.
+func scanSegment(path string) (spoolSegment, error) {
+	seg := spoolSegment{path: path}
+	err := readSegment(path, func(batch []types.NormalizedStationDataTS, _ []byte) error {
+		if seg.rows == 0 && len(batch) > 0 {
+			seg.oldest = batch[0].TimeStamp
+		}
+		seg.rows += len(batch)
+		return nil
+	})
+	if info, statErr := os.Stat(path); statErr == nil {
+		seg.bytes = info.Size()
+	}
+	return seg, err
+}
+
+// readSegment calls fn with each complete batch in the segment, in order, along with
+// its raw line.
+func readSegment(path string, fn func(batch []types.NormalizedStationDataTS, line []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			// EOF, or a partial line without its newline: nothing more to replay
+			return nil
+		}
+		var batch []types.NormalizedStationDataTS
+		if err := json.Unmarshal(line, &batch); err != nil {
+			slog.Warn("spool: skipping unreadable batch", "file", path, logging.Error(err, "spool"))
+			continue
+		}
+		if err := fn(batch, line); err != nil {
+			return err
+		}
+	}
+}
+
+// Len returns the number of spooled rows.
+func (s *Spool) Len() int {
+	var n int
+	for _, seg := range s.segments {
+		n += seg.rows
+	}
+	return n
+}
+
+// Append durably adds one batch to the spool, starting a new segment when the newest
+// is full and dropping the oldest segments to stay within maxBytes.
+func (s *Spool) Append(batch []types.NormalizedStationDataTS) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	line, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	// Segments left by a previous run are never appended to: one may end in a torn line.
+	if n := len(s.segments); n == 0 || !s.open || s.segments[n-1].bytes+int64(len(line)) > spoolSegmentBytes {
+		s.open = true
+		s.seq = nextSegmentName(s.seq, time.Now())
+		s.segments = append(s.segments, spoolSegment{
+			path:   filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.seq, spoolSegmentExt)),
+			oldest: batch[0].TimeStamp,
+		})
+	}
+	seg := &s.segments[len(s.segments)-1]
+	f, err := os.OpenFile(seg.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if seg.rows == 0 {
+		seg.oldest = batch[0].TimeStamp
+	}
+	seg.bytes += int64(len(line))
+	seg.rows += len(batch)
+
+	s.enforceBound()
+	s.publish()
+	return nil
+}
+
+// nextSegmentName keeps segment names increasing even if the clock steps backwards.
+func nextSegmentName(last int64, now time.Time) int64 {
+	if n := now.UnixNano(); n > last {
+		return n
+	}
+	return last + 1
+}
+
+func (s *Spool) enforceBound() {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.bytes
+	}
+	// never drop the segment being written to
+	for total > s.maxBytes && len(s.segments) > 1 {
+		oldest := s.segments[0]
+		if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+			slog.Warn("spool: dropping segment failed", "file", oldest.path, logging.Error(err, "spool"))
+		}
+		slog.Warn("spool: over its size bound, dropped the oldest segment", "max_bytes", s.maxBytes,
+			"rows", oldest.rows, "oldest", oldest.oldest.Format(time.RFC3339))
+		metrics.AddSpoolDropped(oldest.rows)
+		total -= oldest.bytes
+		s.segments = s.segments[1:]
+	}
+}
+
+// Replay writes spooled batches, oldest first, through write. It stops at the first
+// failure, keeping that batch and everything after it for the next attempt; a
+// partially replayed segment is rewritten without the batches already written. A
+// batch the database rejects outright (see isRejectedBatch) would block the spool
+// forever, so it is moved to the segment's .rejected file instead and replay goes on.
+func (s *Spool) Replay(write func([]types.NormalizedStationDataTS) error) (int, error) {
+	var replayed int
+	defer s.publish()
+	for len(s.segments) > 0 {
+		seg := &s.segments[0]
+		var remaining [][]byte
+		var failed error
+		err := readSegment(seg.path, func(batch []types.NormalizedStationDataTS, line []byte) error {
+			if failed == nil {
+				err := write(batch)
+				if err == nil {
+					replayed += len(batch)
+					seg.rows -= len(batch)
+					return nil
+				}
+				if !isRejectedBatch(err) {
+					failed = err
+				} else if qerr := rejectLine(seg.path, line); qerr != nil {
+					failed = fmt.Errorf("%v; quarantining the batch failed: %w", err, qerr)
+				} else {
+					slog.Warn("spool: the database rejected a batch; moved it aside", "rows", len(batch),
+						"file", rejectedPath(seg.path), logging.Error(err, "db"))
+					metrics.Errors.Inc("spool")
+					seg.rows -= len(batch)
+					return nil
+				}
+			}
+			remaining = append(remaining, append([]byte(nil), line...))
+			return nil
+		})
+		if err != nil {
+			return replayed, err
+		}
+		if failed == nil {
+			if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+				return replayed, err
+			}
+			s.segments = s.segments[1:]
+			continue
+		}
+		if err := s.rewrite(seg, remaining); err != nil {
+			return replayed, err
+		}
+		return replayed, failed
+	}
+	return replayed, nil
+}
+
+// isRejectedBatch reports whether a write failed on the data itself (SQLSTATE class
+// 22, data exception, or 23, integrity constraint violation), so retrying the same
+// batch can never succeed. Anything else, a lost connection above all, is retried.
+func isRejectedBatch(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	class := pqErr.Code.Class()
+	return class == "22" || class == "23"
+}
+
+// rejectedPath is where the batches rejected from a segment are kept, for an operator
+// to inspect; the spool never reads them back.
+func rejectedPath(segment string) string {
+	return strings.TrimSuffix(segment, spoolSegmentExt) + ".rejected"
+}
+
+// rejectLine durably appends a segment's line to its .rejected file.
+func rejectLine(segment string, line []byte) error {
+	f, err := os.OpenFile(rejectedPath(segment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// SetAside takes every segment out of the replay queue, renaming it to .unreplayed in
+// place, and reports how many rows it held. A replica that stops leading calls it:
+// another replica writes the same polls meanwhile, so replaying these whenever it next
+// leads would write a period twice. The files are kept for an operator to inspect.
+func (s *Spool) SetAside() (int, error) {
+	defer s.publish()
+	var rows int
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		if err := os.Rename(seg.path, strings.TrimSuffix(seg.path, spoolSegmentExt)+".unreplayed"); err != nil && !os.IsNotExist(err) {
+			return rows, err
+		}
+		rows += seg.rows
+		s.segments = s.segments[1:]
+	}
+	s.open = false
+	return rows, nil
+}
+
+// rewrite atomically replaces a segment with the given lines.
+func (s *Spool) rewrite(seg *spoolSegment, lines [][]byte) error {
+	tmp := seg.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if _, err := f.Write(line); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, seg.path); err != nil {
+		return err
+	}
+	updated, err := scanSegment(seg.path)
+	if err != nil {
+		return err
+	}
+	*seg = updated
+	return nil
+}
+
+// publish exports the spool's size to the metrics endpoint.
+func (s *Spool) publish() {
+	var oldest time.Time
+	if len(s.segments) > 0 {
+		oldest = s.segments[0].oldest
+	}
+	metrics.SetSpool(s.Len(), oldest)
+}
+
+// String describes the spool for log lines.
+func (s *Spool) String() string {
+	return fmt.Sprintf("%d rows in %d segments under %s", s.Len(), len(s.segments), s.dir)
+}
+
+// writeBatch writes one poll to dock_status, going through the spool when one is
+// configured: spooled batches are replayed first so rows land in order, and a batch
+// that can't be written (or is queued behind ones that couldn't) is spooled instead of
+// lost. It reports how many rows reached the database.
+func (c *Client) writeBatch(db *sql.DB, data []types.NormalizedStationDataTS) (int, error) {
+	if c.spool == nil {
+		if err := c.insertBatch(db, data); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+
+	var written int
+	if c.spool.Len() > 0 {
+		n, err := c.spool.Replay(func(batch []types.NormalizedStationDataTS) error {
+			return c.insertBatch(db, batch)
+		})
+		written += n
+		if n > 0 {
+			slog.Info("spool: replayed", "rows", n)
+		}
+		if err != nil {
+			if spoolErr := c.spoolAppend(data); spoolErr != nil {
+				return written, fmt.Errorf("%v; spooling failed too: %w", err, spoolErr)
+			}
+			return written, fmt.Errorf("spool replay: %w (spooled %d rows)", err, len(data))
+		}
+	}
+
+	if err := c.insertBatch(db, data); err != nil {
+		if spoolErr := c.spoolAppend(data); spoolErr != nil {
+			return written, fmt.Errorf("%v; spooling failed too: %w", err, spoolErr)
+		}
+		return written, fmt.Errorf("%w (spooled %d rows; %s)", err, len(data), c.spool)
+	}
+	return written + len(data), nil
+}
+
+// spoolAppend spools a batch, counting it against the spool sink.
+func (c *Client) spoolAppend(data []types.NormalizedStationDataTS) error {
+	if err := c.spool.Append(data); err != nil {
+		metrics.SinkErrors.Inc(sinkSpool)
+		metrics.Errors.Inc("spool")
+		return err
+	}
+	metrics.SinkRows.Add(sinkSpool, float64(len(data)))
+	return nil
+}
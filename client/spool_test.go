@@ -0,0 +1,153 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+	"github.com/lib/pq"
+)
+
+func spoolBatch(ts time.Time, ids ...string) []types.NormalizedStationDataTS {
+	var batch []types.NormalizedStationDataTS
+	for _, id := range ids {
+		batch = append(batch, types.NormalizedStationDataTS{
+			Station:   types.NormalizedStation{ID: id, BikesAvailable: 3},
+			TimeStamp: ts,
+		})
+	}
+	return batch
+}
+
+// TestSpoolReplayInOrder covers an outage: batches spool while the database is down,
+// survive a restart, replay oldest first, and a failure mid-replay keeps the rest.
+func TestSpoolReplayInOrder(t *testing.T) {
+	dir := t.TempDir()
+	t0 := time.Date(2023, 7, 23, 8, 0, 0, 0, time.UTC)
+
+	s, err := OpenSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.Append(spoolBatch(t0.Add(time.Duration(i)*time.Minute), "a", "b")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a restart re-indexes what's on disk
+	s, err = OpenSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 6 {
+		t.Fatalf("Len after reopen = %d, want 6", s.Len())
+	}
+
+	var seen []time.Time
+	down := errors.New("connection refused")
+	n, err := s.Replay(func(batch []types.NormalizedStationDataTS) error {
+		if len(seen) == 1 {
+			return down
+		}
+		seen = append(seen, batch[0].TimeStamp)
+		return nil
+	})
+	if !errors.Is(err, down) || n != 2 || s.Len() != 4 {
+		t.Fatalf("partial replay: n=%d err=%v Len=%d, want 2, %v, 4", n, err, s.Len(), down)
+	}
+
+	n, err = s.Replay(func(batch []types.NormalizedStationDataTS) error {
+		seen = append(seen, batch[0].TimeStamp)
+		return nil
+	})
+	if err != nil || n != 4 || s.Len() != 0 {
+		t.Fatalf("full replay: n=%d err=%v Len=%d", n, err, s.Len())
+	}
+	for i, ts := range seen {
+		if want := t0.Add(time.Duration(i) * time.Minute); !ts.Equal(want) {
+			t.Errorf("batch %d replayed with ts %v, want %v", i, ts, want)
+		}
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "*")); len(left) != 0 {
+		t.Errorf("replayed spool left files behind: %v", left)
+	}
+}
+
+// TestSpoolRejectsPoisonBatch checks that a batch the database refuses is moved to the
+// .rejected file and the batches behind it still replay.
+func TestSpoolRejectsPoisonBatch(t *testing.T) {
+	dir := t.TempDir()
+	t0 := time.Date(2023, 7, 23, 8, 0, 0, 0, time.UTC)
+	s, err := OpenSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "poison", "b"} {
+		if err := s.Append(spoolBatch(t0, id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var written []string
+	n, err := s.Replay(func(batch []types.NormalizedStationDataTS) error {
+		if batch[0].Station.ID == "poison" {
+			return fmt.Errorf("insert: %w", &pq.Error{Code: "22P02", Message: "invalid input syntax"})
+		}
+		written = append(written, batch[0].Station.ID)
+		return nil
+	})
+	if err != nil || n != 2 || s.Len() != 0 || strings.Join(written, ",") != "a,b" {
+		t.Fatalf("replay: n=%d err=%v Len=%d written=%v", n, err, s.Len(), written)
+	}
+	rejected, _ := filepath.Glob(filepath.Join(dir, "*.rejected"))
+	if len(rejected) != 1 {
+		t.Fatalf("rejected files: %v", rejected)
+	}
+	if b, _ := os.ReadFile(rejected[0]); !strings.Contains(string(b), `"poison"`) || strings.Count(string(b), "\n") != 1 {
+		t.Errorf("rejected file holds %q", b)
+	}
+}
+
+// TestSpoolTornSegment checks that a half-written final line from a crash is skipped
+// and never glued onto by later appends.
+func TestSpoolTornSegment(t *testing.T) {
+	dir := t.TempDir()
+	t0 := time.Date(2023, 7, 23, 8, 0, 0, 0, time.UTC)
+	s, err := OpenSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append(spoolBatch(t0, "a")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(s.segments[0].path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`[{"station":{"id":"torn"`)
+	f.Close()
+
+	s, err = OpenSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append(spoolBatch(t0.Add(time.Minute), "b")); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	if _, err := s.Replay(func(batch []types.NormalizedStationDataTS) error {
+		ids = append(ids, batch[0].Station.ID)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] != "a" || ids[1] != "b" {
+		t.Errorf("replayed %v, want [a b]", ids)
+	}
+}
@@ -0,0 +1,235 @@
+package client
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+	"github.com/lib/pq"
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+// stationSyncInterval is how often the ingester re-reads station_information to pick
+// up renamed, moved, resized, added and removed stations.
+const stationSyncInterval = time.Hour
+
+// createStationsTable is a type-2 slowly changing dimension: one row per station per
+// version of its descriptive attributes, valid over [valid_from, valid_to). The open
+// row (valid_to IS NULL) is the station as the feed currently describes it.
+const createStationsTable = `
+CREATE TABLE IF NOT EXISTS stations (
+    station_id   text        NOT NULL,
+    name         text        NOT NULL,
+    longitude    double precision,
+    latitude     double precision,
+    capacity     integer,
+    neighborhood text,
+    short_name   text,
+    region_id    text,
+    valid_from   timestamptz NOT NULL,
+    valid_to     timestamptz,
+    PRIMARY KEY (station_id, valid_from)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS stations_current_idx ON stations (station_id) WHERE valid_to IS NULL;
+CREATE INDEX IF NOT EXISTS stations_current_neighborhood_idx ON stations (neighborhood) WHERE valid_to IS NULL;
+`
+
+// createDockStatusWideView keeps the original wide dock_status shape for readers (the
+// web app) while the ingester moves to narrow fact rows. Rows written before the move
+// still carry their own name/position/neighborhood; narrow rows (name IS NULL) take
+// them from the station version that was valid at ts.
+const createDockStatusWideView = `
+CREATE OR REPLACE VIEW dock_status_wide AS
+SELECT d.station_id,
+       COALESCE(d.name, s.name)                 AS name,
+       COALESCE(d.longitude, s.longitude)       AS longitude,
+       COALESCE(d.latitude, s.latitude)         AS latitude,
+       d.bikes_available,
+       d.ebikes_available,
+       d.bikes_disabled,
+       d.docks_available,
+       d.docks_disabled,
+       d.scooters_available,
+       d.scooters_unavailable,
+       d.is_returning,
+       d.is_renting,
+       d.is_installed,
+       COALESCE(d.neighborhood, s.neighborhood) AS neighborhood,
+       d.ts
+FROM dock_status d
+LEFT JOIN stations s
+       ON d.name IS NULL
+      AND s.station_id = d.station_id
+      AND d.ts >= s.valid_from
+      AND (s.valid_to IS NULL OR d.ts < s.valid_to);
+`
+
+// dropStationsDimension backfills narrow rows from the dimension before dropping it, so
+// rolling back never loses names. dock_status.name stays nullable.
+const dropStationsDimension = `
+UPDATE dock_status d
+   SET name = s.name, longitude = s.longitude, latitude = s.latitude, neighborhood = s.neighborhood
+  FROM stations s
+ WHERE d.name IS NULL
+   AND s.station_id = d.station_id
+   AND d.ts >= s.valid_from
+   AND (s.valid_to IS NULL OR d.ts < s.valid_to);
+DROP VIEW IF EXISTS dock_status_wide;
+DROP TABLE IF EXISTS stations;
+`
+
+// stationRecord is the set of station attributes the dimension tracks history for.
+type stationRecord struct {
+	ID           string
+	Name         string
+	Longitude    float64
+	Latitude     float64
+	Capacity     int
+	Neighborhood string
+	ShortName    string
+	RegionID     string
+}
+
+func newStationRecord(s types.StationEntity, neighborhood string) stationRecord {
+	return stationRecord{
+		ID:           s.StationID,
+		Name:         s.Name.String(),
+		Longitude:    s.Lon,
+		Latitude:     s.Lat,
+		Capacity:     s.Capacity,
+		Neighborhood: neighborhood,
+		ShortName:    s.ShortName.String(),
+		RegionID:     s.RegionID,
+	}
+}
+
+// diffStations compares the open dimension rows with the feed. closed lists the
+// stations whose open row must be ended (changed or gone from the feed) and opened the
+// new versions to insert (changed or new stations).
+func diffStations(current, feed map[string]stationRecord) (closed []string, opened []stationRecord) {
+	for id, rec := range feed {
+		prev, ok := current[id]
+		switch {
+		case !ok:
+			opened = append(opened, rec)
+		case prev != rec:
+			closed = append(closed, id)
+			opened = append(opened, rec)
+		}
+	}
+	for id := range current {
+		if _, ok := feed[id]; !ok {
+			closed = append(closed, id)
+		}
+	}
+	return closed, opened
+}
+
+// trackedStationRecords is the dimension's view of the stations this client tracks,
+// namespaced in a shared database.
+func (c *Client) trackedStationRecords() map[string]stationRecord {
+	out := make(map[string]stationRecord, len(c.stationMap))
+	for id, s := range c.stationMap {
+		rec := newStationRecord(s, namespacedID(c.tenant, c.neighborhood[id]))
+		rec.ID = namespacedID(c.tenant, rec.ID)
+		out[rec.ID] = rec
+	}
+	return out
+}
+
+// syncStations brings the stations dimension in line with the tracked stations as of
+// now: changed stations get their open row closed and a new version opened, and
+// stations that left the feed (or the filter) are closed. Only stations whose ID starts
+// with prefix (the city's, in a shared database) are considered.
+func syncStations(db *sql.DB, feed map[string]stationRecord, prefix string, now time.Time) (changed int, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT station_id, name, longitude, latitude, capacity, neighborhood, short_name, region_id
+FROM stations WHERE valid_to IS NULL AND left(station_id, length($1)) = $1`, prefix)
+	if err != nil {
+		return 0, err
+	}
+	current := make(map[string]stationRecord)
+	for rows.Next() {
+		var r stationRecord
+		var lon, lat sql.NullFloat64
+		var capacity sql.NullInt64
+		var neighborhood, shortName, regionID sql.NullString
+		if err := rows.Scan(&r.ID, &r.Name, &lon, &lat, &capacity, &neighborhood, &shortName, &regionID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		r.Longitude, r.Latitude, r.Capacity = lon.Float64, lat.Float64, int(capacity.Int64)
+		r.Neighborhood, r.ShortName, r.RegionID = neighborhood.String, shortName.String, regionID.String
+		current[r.ID] = r
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	closed, opened := diffStations(current, feed)
+	if len(closed) > 0 {
+		if _, err := tx.Exec("UPDATE stations SET valid_to = $1 WHERE valid_to IS NULL AND station_id = ANY($2)",
+			now, pq.Array(closed)); err != nil {
+			return 0, fmt.Errorf("close station versions: %w", err)
+		}
+	}
+	for _, r := range opened {
+		if _, err := tx.Exec(`INSERT INTO stations
+(station_id, name, longitude, latitude, capacity, neighborhood, short_name, region_id, valid_from)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			r.ID, r.Name, r.Longitude, r.Latitude, r.Capacity, nullable(r.Neighborhood),
+			nullable(r.ShortName), nullable(r.RegionID), now); err != nil {
+			return 0, fmt.Errorf("open station version %s: %w", r.ID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(closed) + len(opened), nil
+}
+
+// refreshStations re-reads station_information, re-applies the station filter so new
+// stations start being tracked, and records any attribute changes in the dimension.
+// A standby passes a nil db: it keeps its station set current but doesn't write.
+func (c *Client) refreshStations(db *sql.DB) error {
+	info, err := fetchStationInformation(c.caller, c.infoURL, c.serviceURL, c.feedFormat)
+	if err != nil {
+		return err
+	}
+	if c.exporter != nil && len(info.Data.Stations) > 0 {
+		c.exporter.setStations(info.Data.Stations)
+	}
+	tracked, neighborhood := c.filter.apply(info.Data.Stations)
+	if len(tracked) == 0 {
+		// an empty (or wholly filtered) feed is far more likely an operator glitch than
+		// every station closing; keep tracking what we had
+		return fmt.Errorf("station_information returned no tracked stations; keeping %d", len(c.stationMap))
+	}
+	c.stationMap, c.neighborhood = tracked, neighborhood
+	c.reportConfig()
+	if db == nil {
+		c.lastInfoSync = c.timeProvider.Now()
+		return nil
+	}
+	return c.syncStationDimension(db)
+}
+
+func (c *Client) syncStationDimension(db *sql.DB) error {
+	now := c.timeProvider.Now()
+	changed, err := syncStations(db, c.trackedStationRecords(), cityPrefix(c.tenant), now)
+	if err != nil {
+		return fmt.Errorf("sync stations: %w", err)
+	}
+	c.lastInfoSync = now
+	if changed > 0 {
+		slog.Info("stations: station versions opened or closed", "changed", changed)
+	}
+	return nil
+}
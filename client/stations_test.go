@@ -0,0 +1,66 @@
+package client
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+)
+
+// TestDiffStations covers the dimension's change detection: unchanged stations are
+// left alone, changed ones are closed and reopened, new ones opened, and stations
+// missing from the feed closed.
+func TestDiffStations(t *testing.T) {
+	current := map[string]stationRecord{
+		"same":    {ID: "same", Name: "Pioneer St", Capacity: 19},
+		"renamed": {ID: "renamed", Name: "Old Name", Capacity: 23},
+		"resized": {ID: "resized", Name: "Van Brunt St", Capacity: 15},
+		"gone":    {ID: "gone", Name: "Removed"},
+	}
+	feed := map[string]stationRecord{
+		"same":    {ID: "same", Name: "Pioneer St", Capacity: 19},
+		"renamed": {ID: "renamed", Name: "New Name", Capacity: 23},
+		"resized": {ID: "resized", Name: "Van Brunt St", Capacity: 27},
+		"new":     {ID: "new", Name: "Brand New"},
+	}
+
+	closed, opened := diffStations(current, feed)
+	sort.Strings(closed)
+	var openedIDs []string
+	for _, r := range opened {
+		openedIDs = append(openedIDs, r.ID)
+	}
+	sort.Strings(openedIDs)
+
+	if got, want := closed, []string{"gone", "renamed", "resized"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("closed = %v, want %v", got, want)
+	}
+	if got, want := openedIDs, []string{"new", "renamed", "resized"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("opened = %v, want %v", got, want)
+	}
+
+	if closed, opened := diffStations(feed, feed); len(closed) != 0 || len(opened) != 0 {
+		t.Errorf("unchanged feed: closed %v, opened %v", closed, opened)
+	}
+}
+
+// TestStationFilterApply checks the filter the ingester re-applies on every
+// station_information refresh.
+func TestStationFilterApply(t *testing.T) {
+	stations := []types.StationEntity{
+		{StationID: "in", Lat: 40.675, Lon: -74.01},
+		{StationID: "out", Lat: 40.75, Lon: -73.98},
+	}
+	box := BBox{MinLat: 40.67, MinLon: -74.018, MaxLat: 40.687, MaxLon: -74.0}
+
+	tracked, _ := stationFilter{bbox: &box}.apply(stations)
+	if _, ok := tracked["in"]; !ok || len(tracked) != 1 {
+		t.Errorf("bbox filter tracked %d stations, want only \"in\"", len(tracked))
+	}
+
+	tracked, _ = stationFilter{ids: map[string]bool{"out": true}}.apply(stations)
+	if _, ok := tracked["out"]; !ok || len(tracked) != 1 {
+		t.Errorf("id filter tracked %d stations, want only \"out\"", len(tracked))
+	}
+}
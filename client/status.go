@@ -0,0 +1,126 @@
+package client
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/metrics"
+)
+
+// Output modes, as reported in /status.
+const (
+	modeJSONL    = "jsonl"
+	modeCSV      = "csv"
+	modePostgres = "postgres"
+	modeGBFS     = "gbfs"
+)
+
+// statusConfig is the "config" section of /status: what this ingester was started to
+// do, minus credentials.
+type statusConfig struct {
+	City                  string   `json:"city,omitempty"`
+	Output                string   `json:"output"`
+	OutputDirectory       string   `json:"outputDirectory,omitempty"`
+	Database              string   `json:"database,omitempty"`
+	FeedFormat            string   `json:"feedFormat"`
+	StationInformationURL string   `json:"stationInformationUrl"`
+	StationStatusURL      string   `json:"stationStatusUrl"`
+	VehicleTypesURL       string   `json:"vehicleTypesUrl,omitempty"`
+	IntervalSeconds       int      `json:"intervalSeconds"`
+	StationsTracked       int      `json:"stationsTracked"`
+	IDs                   []string `json:"ids,omitempty"`
+	BBox                  *BBox    `json:"bbox,omitempty"`
+	Neighborhoods         int      `json:"neighborhoods"`
+	ChangesOnly           bool     `json:"changesOnly,omitempty"`
+	Flows                 bool     `json:"flows,omitempty"`
+	NarrowFacts           bool     `json:"narrowFacts,omitempty"`
+	Spool                 string   `json:"spool,omitempty"`
+	Stream                bool     `json:"stream,omitempty"`
+	StationMetrics        bool     `json:"stationMetrics,omitempty"`
+}
+
+// statusStorage is the "storage" section of /status: how the leader set dock_status
+// up.
+type statusStorage struct {
+	TimescaleDB   bool   `json:"timescaledb"`
+	Hypertable    bool   `json:"hypertable"`
+	Partitioned   bool   `json:"partitioned"`
+	Retention     string `json:"retention"` // "policy", "partitions" or "none"
+	RetentionDays int    `json:"retentionDays,omitempty"`
+	Rollups       string `json:"rollups,omitempty"`
+	UniqueKey     bool   `json:"uniqueKey"`
+	Shared        bool   `json:"shared,omitempty"`
+	PreparedAt    string `json:"preparedAt"`
+}
+
+// reportConfig publishes the configuration to /status. The poll loops call it on
+// start, and refreshStations whenever the tracked set may have changed.
+func (c *Client) reportConfig() {
+	if c.mode == "" {
+		return
+	}
+	infoURL, statusURL := c.infoURL, c.statusURL
+	if infoURL == "" {
+		infoURL = c.serviceURL + StationInformationPath
+	}
+	if statusURL == "" {
+		statusURL = c.serviceURL + StationStatusPath
+	}
+	format := c.feedFormat
+	if format == "" {
+		format = "gbfs"
+	}
+	cfg := statusConfig{
+		City:                  os.Getenv("CITY_ID"),
+		Output:                c.mode,
+		OutputDirectory:       c.outputDirectory,
+		FeedFormat:            format,
+		StationInformationURL: metrics.RedactURL(infoURL),
+		StationStatusURL:      metrics.RedactURL(statusURL),
+		VehicleTypesURL:       metrics.RedactURL(c.vehicleTypesURL),
+		IntervalSeconds:       c.interval,
+		StationsTracked:       len(c.stationMap),
+		BBox:                  c.filter.bbox,
+		Neighborhoods:         len(c.filter.neighborhoods),
+		ChangesOnly:           c.changes != nil,
+		Flows:                 c.flows != nil,
+		NarrowFacts:           c.narrowFacts,
+		Stream:                c.stream != nil,
+		StationMetrics:        c.exporter != nil,
+	}
+	if c.mode == modePostgres {
+		cfg.Database = metrics.RedactDSN(os.Getenv("DATABASE_URL"))
+	}
+	for id := range c.filter.ids {
+		cfg.IDs = append(cfg.IDs, id)
+	}
+	sort.Strings(cfg.IDs)
+	if c.spool != nil {
+		cfg.Spool = c.spool.dir
+	}
+	metrics.SetStatus("config", cfg)
+}
+
+// reportStorage publishes the leader's storage setup to /status.
+func (c *Client) reportStorage(timescale, hypertable bool) {
+	s := statusStorage{
+		TimescaleDB: timescale,
+		Hypertable:  hypertable,
+		Partitioned: c.partitioned,
+		Retention:   "none",
+		Rollups:     c.rollups,
+		UniqueKey:   c.uniqueKey,
+		Shared:      c.tenant != "",
+		PreparedAt:  c.timeProvider.Now().UTC().Format(time.RFC3339),
+	}
+	if n, ok := retentionDays(); ok {
+		switch {
+		case hypertable:
+			s.Retention, s.RetentionDays = "policy", n
+		case c.partitioned:
+			s.Retention, s.RetentionDays = "partitions", n
+		}
+	}
+	metrics.SetStatus("storage", s)
+}
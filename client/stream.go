@@ -0,0 +1,302 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/metrics"
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+)
+
+const (
+	// DefaultStreamBuffer is how many polls the event stream keeps for Last-Event-ID
+	// resume: about a quarter of an hour at the default interval.
+	DefaultStreamBuffer = 16
+
+	// streamClientQueue is how many events a client may fall behind before it's
+	// disconnected; it reconnects with Last-Event-ID and resumes from the ring.
+	streamClientQueue = 4
+	// streamWriteTimeout bounds one event write, so a stalled connection can't pin
+	// its handler.
+	streamWriteTimeout = 10 * time.Second
+	// streamHeartbeat keeps idle connections open through proxies.
+	streamHeartbeat = 20 * time.Second
+)
+
+// EventStream publishes every poll as server-sent events (see ServeHTTP). It keeps the
+// last few polls in a ring buffer so a client that reconnects with Last-Event-ID
+// resumes where it left off instead of starting over.
+type EventStream struct {
+	mu       sync.Mutex
+	ring     []*streamEvent // oldest first
+	size     int
+	previous map[string]types.NormalizedStation
+	clients  map[*streamClient]struct{}
+}
+
+// streamEvent is one poll: every station, and the stations that changed since the
+// previous poll (annotated like --changes-only output).
+type streamEvent struct {
+	id       uint64 // the poll's Unix milliseconds, so IDs stay ordered across restarts
+	all      []types.NormalizedStationDataTS
+	changed  []types.NormalizedStationDataTS
+	keyframe bool // the first poll: changed is everything
+}
+
+type streamClient struct {
+	events chan *streamEvent
+	done   chan struct{} // closed when the client is dropped for falling behind
+}
+
+// NewEventStream returns a stream that keeps the last size polls (zero =
+// DefaultStreamBuffer).
+func NewEventStream(size int) *EventStream {
+	if size <= 0 {
+		size = DefaultStreamBuffer
+	}
+	return &EventStream{
+		size:     size,
+		previous: make(map[string]types.NormalizedStation),
+		clients:  make(map[*streamClient]struct{}),
+	}
+}
+
+// Publish adds one poll to the stream and fans it out. A client whose queue is full is
+// dropped rather than waited for.
+func (s *EventStream) Publish(data []types.NormalizedStationDataTS) {
+	if len(data) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ev := &streamEvent{id: uint64(data[0].TimeStamp.UnixMilli()), all: data, keyframe: len(s.ring) == 0}
+	if n := len(s.ring); n > 0 && ev.id <= s.ring[n-1].id {
+		ev.id = s.ring[n-1].id + 1
+	}
+	for _, d := range data {
+		prev, seen := s.previous[d.Station.ID]
+		s.previous[d.Station.ID] = d.Station
+		if !seen {
+			d.Keyframe = ev.keyframe
+			ev.changed = append(ev.changed, d)
+			continue
+		}
+		if d.Delta = stationDelta(prev, d.Station); d.Delta != "" {
+			p := prev
+			d.Previous = &p
+			ev.changed = append(ev.changed, d)
+		}
+	}
+
+	s.ring = append(s.ring, ev)
+	if len(s.ring) > s.size {
+		s.ring = s.ring[len(s.ring)-s.size:]
+	}
+	for c := range s.clients {
+		select {
+		case c.events <- ev:
+		default:
+			delete(s.clients, c)
+			close(c.done)
+			metrics.IncStreamDropped()
+		}
+	}
+}
+
+// subscribe registers a client and returns what it missed. A snapshot client only
+// needs the newest poll. A changes client resumes from the ring when lastID is still
+// in it, and otherwise gets the newest poll whole as a keyframe (nil).
+func (s *EventStream) subscribe(lastID uint64, resume, changes bool) (*streamClient, []*streamEvent, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := &streamClient{events: make(chan *streamEvent, streamClientQueue), done: make(chan struct{})}
+	s.clients[c] = struct{}{}
+	if len(s.ring) == 0 {
+		return c, nil, false
+	}
+	newest := s.ring[len(s.ring)-1]
+	if resume && newest.id <= lastID {
+		return c, nil, false // up to date
+	}
+	if !changes {
+		return c, []*streamEvent{newest}, false
+	}
+	if resume {
+		for i, ev := range s.ring {
+			if ev.id == lastID {
+				return c, append([]*streamEvent(nil), s.ring[i+1:]...), false
+			}
+		}
+	}
+	return c, []*streamEvent{newest}, true
+}
+
+func (s *EventStream) unsubscribe(c *streamClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, c)
+}
+
+// streamFilter restricts a client's events to some stations; the zero value lets
+// everything through.
+type streamFilter struct {
+	ids           map[string]bool
+	neighborhoods map[string]bool
+	bbox          *BBox
+}
+
+// parseStreamFilter reads the id, neighborhood (each repeatable or comma-separated)
+// and bbox query parameters. A station must match every one that's given.
+func parseStreamFilter(q map[string][]string) (streamFilter, error) {
+	var f streamFilter
+	set := func(key string) map[string]bool {
+		var m map[string]bool
+		for _, v := range q[key] {
+			for _, s := range strings.Split(v, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					if m == nil {
+						m = make(map[string]bool)
+					}
+					m[s] = true
+				}
+			}
+		}
+		return m
+	}
+	f.ids, f.neighborhoods = set("id"), set("neighborhood")
+	if v := q["bbox"]; len(v) > 0 && v[0] != "" {
+		b, err := ParseBBox(v[0])
+		if err != nil {
+			return f, err
+		}
+		f.bbox = &b
+	}
+	return f, nil
+}
+
+func (f streamFilter) match(s types.NormalizedStation) bool {
+	return (f.ids == nil || f.ids[s.ID]) &&
+		(f.neighborhoods == nil || f.neighborhoods[s.Neighborhood]) &&
+		(f.bbox == nil || f.bbox.contains(s.Latitude, s.Longitude))
+}
+
+func (f streamFilter) apply(data []types.NormalizedStationDataTS) []types.NormalizedStationDataTS {
+	if f.ids == nil && f.neighborhoods == nil && f.bbox == nil {
+		return data
+	}
+	out := make([]types.NormalizedStationDataTS, 0, len(data))
+	for _, d := range data {
+		if f.match(d.Station) {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// streamPayload is the data of one event.
+type streamPayload struct {
+	Time     time.Time                       `json:"timestamp"`
+	Keyframe bool                            `json:"keyframe,omitempty"`
+	Stations []types.NormalizedStationDataTS `json:"stations"`
+}
+
+// ServeHTTP streams polls as server-sent events. By default each event is a
+// "snapshot" of every matching station; with changes=true it's a "changes" event of
+// only the stations that moved, after a first keyframe. Events are skipped when no
+// station matches, except keyframes.
+func (s *EventStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	filter, err := parseStreamFilter(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	changes, _ := strconv.ParseBool(q.Get("changes"))
+	// EventSource sends Last-Event-ID itself on reconnect; lastEventId is for clients
+	// that can't set headers on the first connect
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = q.Get("lastEventId")
+	}
+	lastID, err := strconv.ParseUint(last, 10, 64)
+	resume := last != "" && err == nil
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx: don't buffer the stream
+	w.WriteHeader(http.StatusOK)
+
+	c, backlog, keyframe := s.subscribe(lastID, resume, changes)
+	defer s.unsubscribe(c)
+	metrics.AddStreamClients(1)
+	defer metrics.AddStreamClients(-1)
+
+	send := func(ev *streamEvent, keyframe bool) error {
+		_ = rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		kind, stations := "snapshot", ev.all
+		if changes && !keyframe && !ev.keyframe {
+			kind, stations = "changes", ev.changed
+		}
+		stations = filter.apply(stations)
+		if len(stations) == 0 && kind == "changes" {
+			return nil
+		}
+		body, err := json.Marshal(streamPayload{Time: ev.all[0].TimeStamp, Keyframe: kind == "snapshot", Stations: stations})
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.id, kind, body); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if _, err := fmt.Fprint(w, "retry: 5000\n\n"); err != nil || rc.Flush() != nil {
+		return
+	}
+	for _, ev := range backlog {
+		if send(ev, keyframe) != nil {
+			return
+		}
+		keyframe = false
+	}
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case ev := <-c.events:
+			if send(ev, false) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			_ = rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		case <-c.done:
+			return // fell behind; the client reconnects and resumes
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// publish hands one poll to the event stream, when there is one. Every output loop
+// calls it with the whole poll, before --changes-only filtering.
+func (c *Client) publish(data []types.NormalizedStationDataTS) {
+	if c.stream != nil {
+		c.stream.Publish(data)
+	}
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+)
+
+func streamPoll(at time.Time, bikes ...int) []types.NormalizedStationDataTS {
+	var out []types.NormalizedStationDataTS
+	for i, b := range bikes {
+		out = append(out, types.NormalizedStationDataTS{
+			Station:   types.NormalizedStation{ID: string(rune('a' + i)), BikesAvailable: b, Neighborhood: "red-hook"},
+			TimeStamp: at,
+		})
+	}
+	return out
+}
+
+// TestEventStreamResume covers what a (re)connecting client is sent first.
+func TestEventStreamResume(t *testing.T) {
+	s := NewEventStream(2)
+	t0 := time.Unix(1700000000, 0)
+	s.Publish(streamPoll(t0, 1, 2))
+	s.Publish(streamPoll(t0.Add(time.Minute), 1, 3))
+	s.Publish(streamPoll(t0.Add(2*time.Minute), 0, 3))
+	if len(s.ring) != 2 {
+		t.Fatalf("ring holds %d polls, want 2", len(s.ring))
+	}
+	first, second := s.ring[0], s.ring[1]
+	if len(first.changed) != 1 || first.changed[0].Delta != "bikes +1" || len(second.changed) != 1 {
+		t.Errorf("changes: %+v / %+v", first.changed, second.changed)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		lastID   uint64
+		resume   bool
+		changes  bool
+		want     []uint64
+		keyframe bool
+	}{
+		{"new snapshot client", 0, false, false, []uint64{second.id}, false},
+		{"new changes client", 0, false, true, []uint64{second.id}, true},
+		{"resume in the ring", first.id, true, true, []uint64{second.id}, false},
+		{"resume when current", second.id, true, true, nil, false},
+		{"resume past the ring", uint64(t0.UnixMilli()), true, true, []uint64{second.id}, true},
+	} {
+		c, backlog, keyframe := s.subscribe(tc.lastID, tc.resume, tc.changes)
+		s.unsubscribe(c)
+		var ids []uint64
+		for _, ev := range backlog {
+			ids = append(ids, ev.id)
+		}
+		if len(ids) != len(tc.want) || (len(ids) > 0 && ids[0] != tc.want[0]) || keyframe != tc.keyframe {
+			t.Errorf("%s: got %v keyframe %v, want %v keyframe %v", tc.name, ids, keyframe, tc.want, tc.keyframe)
+		}
+	}
+}
+
+// TestEventStreamDropsSlowClients checks a client that stops reading is cut loose
+// instead of holding up Publish.
+func TestEventStreamDropsSlowClients(t *testing.T) {
+	s := NewEventStream(0)
+	c, _, _ := s.subscribe(0, false, false)
+	t0 := time.Unix(1700000000, 0)
+	for i := 0; i <= streamClientQueue; i++ {
+		s.Publish(streamPoll(t0.Add(time.Duration(i)*time.Minute), i))
+	}
+	select {
+	case <-c.done:
+	default:
+		t.Fatal("slow client was not dropped")
+	}
+	if len(s.clients) != 0 {
+		t.Errorf("%d clients still subscribed", len(s.clients))
+	}
+}
+
+// TestEventStreamHTTP reads filtered change events off a live connection.
+func TestEventStreamHTTP(t *testing.T) {
+	s := NewEventStream(0)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	t0 := time.Unix(1700000000, 0)
+	s.Publish(streamPoll(t0, 1, 2))
+
+	resp, err := http.Get(srv.URL + "?changes=true&id=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	lines := make(chan string)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		sc.Buffer(nil, 1<<20)
+		for sc.Scan() {
+			if l := sc.Text(); strings.HasPrefix(l, "event:") || strings.HasPrefix(l, "data:") {
+				lines <- l
+			}
+		}
+		close(lines)
+	}()
+	next := func() string {
+		select {
+		case l := <-lines:
+			return l
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event")
+			return ""
+		}
+	}
+
+	if l := next(); l != "event: snapshot" {
+		t.Fatalf("first event %q, want the keyframe", l)
+	}
+	if l := next(); !strings.Contains(l, `"id":"b"`) || strings.Contains(l, `"id":"a"`) {
+		t.Errorf("keyframe not filtered to b: %s", l)
+	}
+	// the client subscribed before its keyframe was sent; a's change is filtered out,
+	// so the next event is b's
+	s.Publish(streamPoll(t0.Add(time.Minute), 0, 2))
+	s.Publish(streamPoll(t0.Add(2*time.Minute), 0, 5))
+	if l := next(); l != "event: changes" {
+		t.Fatalf("got %q, want a changes event", l)
+	}
+	if l := next(); !strings.Contains(l, `"delta":"bikes +3"`) {
+		t.Errorf("changes event: %s", l)
+	}
+}
@@ -0,0 +1,345 @@
+package client
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+	"github.com/lib/pq"
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+// A shared database holds several cities side by side. It's opt-in: app_metadata
+// tenancy = 'shared' (set by ShareDatabase) instead of the single city_id that
+// ensureCityID stamps. In a shared database every dock_status row carries its city in
+// city_id, and station IDs and neighborhood slugs are namespaced as "<city>:<id>", so
+// the tables keyed by them (stations, station_flows, the rollups) need no city column.
+const (
+	tenancyKey      = "tenancy"
+	tenancyShared   = "shared"
+	tenantSeparator = ":"
+)
+
+// createDockStatusCityIndex serves per-city scans of a shared dock_status; in a
+// single-city database city_id is NULL throughout and the partial index stays empty.
+const createDockStatusCityIndex = "CREATE INDEX IF NOT EXISTS dock_status_city_ts_idx ON dock_status (city_id, ts) WHERE city_id IS NOT NULL"
+
+// dockStatusWideView is createDockStatusWideView plus city_id, which
+// CREATE OR REPLACE VIEW can only add at the end.
+const dockStatusWideView = `
+CREATE OR REPLACE VIEW dock_status_wide AS
+SELECT d.station_id,
+       COALESCE(d.name, s.name)                 AS name,
+       COALESCE(d.longitude, s.longitude)       AS longitude,
+       COALESCE(d.latitude, s.latitude)         AS latitude,
+       d.bikes_available,
+       d.ebikes_available,
+       d.bikes_disabled,
+       d.docks_available,
+       d.docks_disabled,
+       d.scooters_available,
+       d.scooters_unavailable,
+       d.is_returning,
+       d.is_renting,
+       d.is_installed,
+       COALESCE(d.neighborhood, s.neighborhood) AS neighborhood,
+       d.ts,
+       d.city_id
+FROM dock_status d
+LEFT JOIN stations s
+       ON d.name IS NULL
+      AND s.station_id = d.station_id
+      AND d.ts >= s.valid_from
+      AND (s.valid_to IS NULL OR d.ts < s.valid_to);
+`
+
+const addCityColumns = `
+ALTER TABLE dock_status ADD COLUMN IF NOT EXISTS city_id text;
+` + createDockStatusCityIndex + `;
+ALTER TABLE poll_log ADD COLUMN IF NOT EXISTS city_id text;
+` + dockStatusWideView
+
+const dropCityColumns = `
+DROP VIEW IF EXISTS dock_status_wide;
+DROP INDEX IF EXISTS dock_status_city_ts_idx;
+ALTER TABLE dock_status DROP COLUMN IF EXISTS city_id;
+ALTER TABLE poll_log DROP COLUMN IF EXISTS city_id;
+` + createDockStatusWideView
+
+// namespacedID is how a city's station ID or neighborhood slug is stored in a shared
+// database.
+func namespacedID(city, id string) string {
+	if city == "" || id == "" {
+		return id
+	}
+	return city + tenantSeparator + id
+}
+
+// cityPrefix matches the namespaced IDs of one city; empty (match everything) outside
+// a shared database.
+func cityPrefix(city string) string {
+	if city == "" {
+		return ""
+	}
+	return city + tenantSeparator
+}
+
+// namespace rewrites one poll's station IDs and neighborhoods for a shared database.
+// It's a no-op for a single-city one.
+func (c *Client) namespace(data []types.NormalizedStationDataTS) []types.NormalizedStationDataTS {
+	if c.tenant == "" {
+		return data
+	}
+	out := make([]types.NormalizedStationDataTS, len(data))
+	for i, d := range data {
+		d.Station.ID = namespacedID(c.tenant, d.Station.ID)
+		d.Station.Neighborhood = namespacedID(c.tenant, d.Station.Neighborhood)
+		out[i] = d
+	}
+	return out
+}
+
+// isShared reports whether db is a shared multi-city database.
+func isShared(db *sql.DB) (bool, error) {
+	var tenancy string
+	switch err := db.QueryRow("SELECT value FROM app_metadata WHERE key = $1", tenancyKey).Scan(&tenancy); err {
+	case nil:
+		return tenancy == tenancyShared, nil
+	case sql.ErrNoRows:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// ShareDatabase turns a migrated database into a shared multi-city one. It refuses
+// when dock_status already holds rows without a city: load those with ImportCity from
+// their own database instead.
+func ShareDatabase(dsn string) error {
+	db, err := openPostgres(dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := ensureSchemaCurrent(db); err != nil {
+		return err
+	}
+	var unowned bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM dock_status WHERE city_id IS NULL)").Scan(&unowned); err != nil {
+		return err
+	}
+	if unowned {
+		return errors.New("dock_status has rows without a city_id; share a new database and import this one into it")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM app_metadata WHERE key = 'city_id'"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO app_metadata (key, value) VALUES ($1, $2)
+ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value`, tenancyKey, tenancyShared); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ImportStats summarizes an ImportCity.
+type ImportStats struct {
+	City          string
+	Days          int
+	Rows          int64
+	Stations      int64 // station versions
+	Neighborhoods int64
+	// NotCopied is the row count of each source table ImportCity leaves behind (see
+	// importSkippedTables).
+	NotCopied map[string]int64
+}
+
+// importSkippedTables are the source tables ImportCity doesn't carry over: trips,
+// flows and outages are derived data that can be re-imported or re-inferred in the
+// shared database, and poll_log only describes the source ingester's own polls.
+var importSkippedTables = []string{"trips", "station_flows", "station_outages", "poll_log"}
+
+// ImportCity copies a single-city database into a shared one: the stations dimension,
+// neighborhood_areas and dock_status, with IDs namespaced and city_id set. The city is
+// the source's app_metadata city_id unless city overrides it. dock_status is copied a
+// UTC day per transaction, replacing whatever the target already has for that city and
+// day, so an interrupted import can simply be run again. The tables in
+// importSkippedTables are not copied; their source row counts are reported instead.
+func ImportCity(sourceDSN, targetDSN, city string) (ImportStats, error) {
+	var stats ImportStats
+	src, err := openPostgres(sourceDSN)
+	if err != nil {
+		return stats, fmt.Errorf("source: %w", err)
+	}
+	defer src.Close()
+	dst, err := openPostgres(targetDSN)
+	if err != nil {
+		return stats, fmt.Errorf("target: %w", err)
+	}
+	defer dst.Close()
+	for name, db := range map[string]*sql.DB{"source": src, "target": dst} {
+		if err := ensureSchemaCurrent(db); err != nil {
+			return stats, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if shared, err := isShared(dst); err != nil {
+		return stats, err
+	} else if !shared {
+		return stats, errors.New("target is not a shared database (run `dockscan db share` on it first)")
+	}
+	if shared, err := isShared(src); err != nil {
+		return stats, err
+	} else if shared {
+		return stats, errors.New("source is already a shared database")
+	}
+	if city == "" {
+		if err := src.QueryRow("SELECT value FROM app_metadata WHERE key = 'city_id'").Scan(&city); err != nil {
+			return stats, fmt.Errorf("source has no city_id (pass --city): %w", err)
+		}
+	}
+	if strings.Contains(city, tenantSeparator) {
+		return stats, fmt.Errorf("city %q must not contain %q", city, tenantSeparator)
+	}
+	stats.City = city
+	stats.NotCopied = make(map[string]int64, len(importSkippedTables))
+	for _, table := range importSkippedTables {
+		var n int64
+		if err := src.QueryRow("SELECT count(*) FROM " + table).Scan(&n); err != nil {
+			return stats, fmt.Errorf("source %s: %w", table, err)
+		}
+		stats.NotCopied[table] = n
+	}
+
+	if stats.Stations, err = importTable(src, dst, city, "stations",
+		[]string{"station_id", "name", "longitude", "latitude", "capacity", "neighborhood", "short_name", "region_id", "valid_from", "valid_to"},
+		"", nil, []int{0, 5}); err != nil {
+		return stats, err
+	}
+	if stats.Neighborhoods, err = importTable(src, dst, city, "neighborhood_areas",
+		[]string{"neighborhood", "area"}, "", nil, []int{0}); err != nil {
+		return stats, err
+	}
+
+	var first, last sql.NullTime
+	if err := src.QueryRow("SELECT min(ts), max(ts) FROM dock_status").Scan(&first, &last); err != nil {
+		return stats, err
+	}
+	if !first.Valid {
+		return stats, nil
+	}
+	if err := ensurePartitionsFor(dst, first.Time, last.Time.Add(time.Nanosecond)); err != nil {
+		return stats, err
+	}
+	// everything but city_id, which is set from city
+	cols := dockStatusColumns[:len(dockStatusColumns)-1]
+	for day := utcDay(first.Time); !day.After(last.Time); day = day.AddDate(0, 0, 1) {
+		n, err := importTable(src, dst, city, "dock_status", cols,
+			"ts >= $1 AND ts < $2", []interface{}{day, day.AddDate(0, 0, 1)}, []int{0, 14})
+		if err != nil {
+			return stats, fmt.Errorf("dock_status %s: %w", day.Format("2006-01-02"), err)
+		}
+		stats.Days++
+		stats.Rows += n
+		slog.Info("import: loaded day", "tenant", city, "day", day.Format("2006-01-02"), "rows", n)
+	}
+	return stats, nil
+}
+
+// importTable copies the rows of table matching where (all rows when empty) from src
+// to dst in one target transaction, namespacing the columns at the namespaced indexes.
+// The city's existing rows in that range are deleted first. dock_status rows get
+// city_id.
+func importTable(src, dst *sql.DB, city, table string, cols []string, where string, args []interface{}, namespaced []int) (int64, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(cols, ", "), table)
+	if where != "" {
+		query += " WHERE " + where
+	}
+	rows, err := src.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	tx, err := dst.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	// The city's rows are recognizable by the prefix on their first (namespaced) column.
+	del := fmt.Sprintf("DELETE FROM %s WHERE left(%s, %d) = $%d", table, cols[0], len(cityPrefix(city)), len(args)+1)
+	if where != "" {
+		del += " AND " + where
+	}
+	if _, err := tx.Exec(del, append(args, cityPrefix(city))...); err != nil {
+		return 0, err
+	}
+	copyCols := cols
+	if table == "dock_status" {
+		copyCols = append(append([]string(nil), cols...), "city_id")
+	}
+	stmt, err := tx.Prepare(pq.CopyIn(table, copyCols...))
+	if err != nil {
+		return 0, err
+	}
+	values := make([]interface{}, len(cols))
+	scanArgs := make([]interface{}, len(cols))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+	var n int64
+	for rows.Next() {
+		if err := rows.Scan(scanArgs...); err != nil {
+			_ = stmt.Close()
+			return 0, err
+		}
+		row := append([]interface{}(nil), values...)
+		for _, i := range namespaced {
+			switch v := row[i].(type) {
+			case string:
+				row[i] = namespacedID(city, v)
+			case []byte:
+				row[i] = namespacedID(city, string(v))
+			}
+		}
+		if table == "dock_status" {
+			row = append(row, city)
+		}
+		if _, err := stmt.Exec(row...); err != nil {
+			_ = stmt.Close()
+			return 0, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		_ = stmt.Close()
+		return 0, err
+	}
+	if _, err := stmt.Exec(); err != nil {
+		_ = stmt.Close()
+		return 0, err
+	}
+	if err := stmt.Close(); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// tenantFromEnv is the city an ingester writes as in a shared database.
+func tenantFromEnv() (string, error) {
+	city := os.Getenv("CITY_ID")
+	if city == "" {
+		return "", errors.New("this is a shared database: set CITY_ID to the city this ingester writes")
+	}
+	if strings.Contains(city, tenantSeparator) {
+		return "", fmt.Errorf("CITY_ID %q must not contain %q", city, tenantSeparator)
+	}
+	return city, nil
+}
@@ -0,0 +1,43 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+)
+
+// TestNamespace covers how a shared database keeps cities apart: station IDs and
+// neighborhoods written by an ingester (and its stations dimension) carry its city.
+func TestNamespace(t *testing.T) {
+	data := []types.NormalizedStationDataTS{
+		{Station: types.NormalizedStation{ID: "72", Neighborhood: "red-hook"}},
+		{Station: types.NormalizedStation{ID: "79"}},
+	}
+
+	single := &Client{}
+	if got := single.namespace(data); !reflect.DeepEqual(got, data) {
+		t.Errorf("single-city namespace changed the poll: %+v", got)
+	}
+
+	shared := &Client{
+		tenant:       "nyc",
+		stationMap:   map[string]types.StationEntity{"72": {StationID: "72"}},
+		neighborhood: map[string]string{"72": "red-hook"},
+	}
+	got := shared.namespace(data)
+	if got[0].Station.ID != "nyc:72" || got[0].Station.Neighborhood != "nyc:red-hook" {
+		t.Errorf("namespaced station = %+v", got[0].Station)
+	}
+	if got[1].Station.ID != "nyc:79" || got[1].Station.Neighborhood != "" {
+		t.Errorf("a station outside any neighborhood = %+v", got[1].Station)
+	}
+	if data[0].Station.ID != "72" {
+		t.Errorf("namespace modified its input")
+	}
+
+	recs := shared.trackedStationRecords()
+	if rec, ok := recs["nyc:72"]; !ok || rec.ID != "nyc:72" || rec.Neighborhood != "nyc:red-hook" {
+		t.Errorf("dimension records = %+v", recs)
+	}
+}
@@ -0,0 +1,346 @@
+package client
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+	"github.com/lib/pq"
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+const createTripsTable = `
+CREATE TABLE IF NOT EXISTS trips (
+    ride_id             text,
+    rideable_type       text,
+    started_at          timestamptz NOT NULL,
+    ended_at            timestamptz NOT NULL,
+    start_station_ref   text,
+    start_station_id    text,
+    start_station_name  text,
+    start_lat           double precision,
+    start_lon           double precision,
+    start_neighborhood  text,
+    end_station_ref     text,
+    end_station_id      text,
+    end_station_name    text,
+    end_lat             double precision,
+    end_lon             double precision,
+    end_neighborhood    text,
+    member_type         text,
+    source              text        NOT NULL
+);
+CREATE INDEX IF NOT EXISTS trips_started_at_idx ON trips (started_at);
+CREATE INDEX IF NOT EXISTS trips_start_station_idx ON trips (start_station_id, started_at);
+CREATE INDEX IF NOT EXISTS trips_source_idx ON trips (source);
+`
+
+var tripColumns = []string{
+	"ride_id", "rideable_type", "started_at", "ended_at",
+	"start_station_ref", "start_station_id", "start_station_name", "start_lat", "start_lon", "start_neighborhood",
+	"end_station_ref", "end_station_id", "end_station_name", "end_lat", "end_lon", "end_neighborhood",
+	"member_type", "source",
+}
+
+// TripImportStats summarizes one `trips import` run.
+type TripImportStats struct {
+	Files     int
+	Loaded    int
+	Skipped   int // rows with unparseable times
+	Unmatched int // trip ends whose station couldn't be mapped to a GBFS station_id
+}
+
+// ImportTrips streams Lyft monthly tripdata — a .zip of CSVs or a bare .csv — into the
+// trips table via COPY. Each CSV is loaded in its own transaction tagged with its file
+// name as `source`, and replaces any rows a previous import of the same file left, so
+// re-running an import is safe. Times in the files are local wall-clock times in loc.
+// Trip ends are matched against every station c tracks and tagged with their
+// neighborhood in ns.
+func (c *Client) ImportTrips(dsn, path string, loc *time.Location, ns []Neighborhood) (TripImportStats, error) {
+	var stats TripImportStats
+	db, err := openPostgres(dsn)
+	if err != nil {
+		return stats, err
+	}
+	defer db.Close()
+	if err := ensureSchemaCurrent(db); err != nil {
+		return stats, err
+	}
+
+	load := func(name string, r io.Reader) error {
+		stats.Files++
+		n, err := c.copyTrips(db, name, r, loc, ns, &stats)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		slog.Info("trips: loaded", "file", name, "rows", n)
+		return nil
+	}
+
+	if !strings.EqualFold(filepath.Ext(path), ".zip") {
+		f, err := os.Open(path)
+		if err != nil {
+			return stats, err
+		}
+		defer f.Close()
+		return stats, load(filepath.Base(path), f)
+	}
+
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return stats, err
+	}
+	defer zr.Close()
+	for _, zf := range zr.File {
+		// skip directories, macOS resource forks and anything that isn't a CSV
+		if zf.FileInfo().IsDir() || strings.HasPrefix(zf.Name, "__MACOSX/") ||
+			!strings.EqualFold(filepath.Ext(zf.Name), ".csv") {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return stats, err
+		}
+		err = load(filepath.Base(zf.Name), rc)
+		rc.Close()
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+func (c *Client) copyTrips(db *sql.DB, source string, r io.Reader, loc *time.Location, ns []Neighborhood, stats *TripImportStats) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM trips WHERE source = $1", source); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	stmt, err := tx.Prepare(pq.CopyIn("trips", tripColumns...))
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	n := 0
+	err = readTrips(r, loc, func(t types.Trip) error {
+		c.resolveTripEnds(&t, ns, stats)
+		if _, err := stmt.Exec(t.RideID, nullable(t.RideableType), t.StartedAt, t.EndedAt,
+			nullable(t.StartStationRef), nullable(t.StartStationID), nullable(t.StartStationName),
+			nullableCoord(t.StartLat), nullableCoord(t.StartLon), nullable(t.StartNeighborhood),
+			nullable(t.EndStationRef), nullable(t.EndStationID), nullable(t.EndStationName),
+			nullableCoord(t.EndLat), nullableCoord(t.EndLon), nullable(t.EndNeighborhood),
+			nullable(t.MemberType), source); err != nil {
+			return err
+		}
+		n++
+		return nil
+	}, &stats.Skipped)
+	if err == nil {
+		_, err = stmt.Exec() // flush the COPY buffer
+	}
+	if err != nil {
+		_ = stmt.Close()
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if err := stmt.Close(); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	stats.Loaded += n
+	return n, nil
+}
+
+// resolveTripEnds maps each end's raw station id to the GBFS station_id and tags it
+// with a neighborhood in ns. Modern files carry the station's short_name ("5905.14"),
+// pre-2021 files the numeric legacy_id; either is tried, then the station_id itself.
+// The neighborhood comes from the matched station, or from the trip's own coordinates
+// when the station has since been removed from the feed.
+func (c *Client) resolveTripEnds(t *types.Trip, ns []Neighborhood, stats *TripImportStats) {
+	resolve := func(ref string, lat, lon float64) (id, nbhd string) {
+		if ref != "" {
+			id = c.stationRefs()[ref]
+		}
+		if id != "" {
+			if nbhd = c.neighborhood[id]; nbhd == "" && len(ns) > 0 {
+				st := c.stationMap[id]
+				nbhd = assignNeighborhood(ns, st.Lat, st.Lon)
+				c.neighborhood[id] = nbhd
+			}
+			return id, nbhd
+		}
+		stats.Unmatched++
+		if len(ns) > 0 && (lat != 0 || lon != 0) {
+			nbhd = assignNeighborhood(ns, lat, lon)
+		}
+		return "", nbhd
+	}
+	t.StartStationID, t.StartNeighborhood = resolve(t.StartStationRef, t.StartLat, t.StartLon)
+	t.EndStationID, t.EndNeighborhood = resolve(t.EndStationRef, t.EndLat, t.EndLon)
+}
+
+// stationRefs lazily indexes the tracked stations by every id a trip file may use.
+func (c *Client) stationRefs() map[string]string {
+	if c.refs != nil {
+		return c.refs
+	}
+	c.refs = make(map[string]string, 3*len(c.stationMap))
+	for id, st := range c.stationMap {
+		c.refs[id] = id
+		if st.LegacyID != "" {
+			c.refs[st.LegacyID] = id
+		}
+		if sn := st.ShortName.String(); sn != "" {
+			c.refs[sn] = id
+		}
+	}
+	return c.refs
+}
+
+func nullableCoord(f float64) interface{} {
+	if f == 0 {
+		return nil
+	}
+	return f
+}
+
+// tripHeaderAliases maps every historical tripdata header (lower-cased, with spaces and
+// underscores removed) to a canonical field. Layouts seen so far:
+//   - 2013–2016: tripduration,starttime,stoptime,start station id,… usertype,birth year,gender
+//   - 2016–2017: the same in Title Case ("Start Station ID")
+//   - 2021-02+:  ride_id,rideable_type,started_at,ended_at,start_station_name,start_station_id,…,member_casual
+var tripHeaderAliases = map[string]string{
+	"rideid":                "ride_id",
+	"rideabletype":          "rideable_type",
+	"startedat":             "started_at",
+	"starttime":             "started_at",
+	"endedat":               "ended_at",
+	"stoptime":              "ended_at",
+	"startstationid":        "start_id",
+	"startstationname":      "start_name",
+	"startstationlatitude":  "start_lat",
+	"startlat":              "start_lat",
+	"startstationlongitude": "start_lon",
+	"startlng":              "start_lon",
+	"endstationid":          "end_id",
+	"endstationname":        "end_name",
+	"endstationlatitude":    "end_lat",
+	"endlat":                "end_lat",
+	"endstationlongitude":   "end_lon",
+	"endlng":                "end_lon",
+	"membercasual":          "member",
+	"usertype":              "member",
+}
+
+var tripTimeLayouts = []string{
+	"2006-01-02 15:04:05", // also matches fractional seconds, e.g. 2019-01-01 00:01:47.4010
+	"1/2/2006 15:04:05",
+	"1/2/2006 15:04",
+	"2006-01-02 15:04",
+}
+
+func parseTripTime(s string, loc *time.Location) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range tripTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// readTrips decodes one tripdata CSV, detecting its layout from the header. Rows whose
+// start/end times don't parse are counted in skipped and dropped.
+func readTrips(r io.Reader, loc *time.Location, fn func(types.Trip) error, skipped *int) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("read header: %w", err)
+	}
+	col := make(map[string]int)
+	for i, h := range header {
+		key := strings.NewReplacer(" ", "", "_", "", "\ufeff", "", `"`, "").Replace(strings.ToLower(h))
+		if canon, ok := tripHeaderAliases[key]; ok {
+			col[canon] = i
+		}
+	}
+	if _, ok := col["started_at"]; !ok {
+		return fmt.Errorf("unrecognized tripdata layout: %v", header)
+	}
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		get := func(k string) string {
+			if i, ok := col[k]; ok && i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+		flt := func(k string) float64 { f, _ := strconv.ParseFloat(get(k), 64); return f }
+
+		start, err1 := parseTripTime(get("started_at"), loc)
+		end, err2 := parseTripTime(get("ended_at"), loc)
+		if err1 != nil || err2 != nil {
+			*skipped++
+			continue
+		}
+		t := types.Trip{
+			RideID:           get("ride_id"),
+			RideableType:     get("rideable_type"),
+			StartedAt:        start,
+			EndedAt:          end,
+			StartStationRef:  normalizeStationRef(get("start_id")),
+			StartStationName: get("start_name"),
+			StartLat:         flt("start_lat"),
+			StartLon:         flt("start_lon"),
+			EndStationRef:    normalizeStationRef(get("end_id")),
+			EndStationName:   get("end_name"),
+			EndLat:           flt("end_lat"),
+			EndLon:           flt("end_lon"),
+			MemberType:       normalizeMemberType(get("member")),
+		}
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+}
+
+// normalizeStationRef drops the "NULL" placeholder and the trailing ".0" some legacy
+// exports put on integer ids.
+func normalizeStationRef(s string) string {
+	if strings.EqualFold(s, "null") {
+		return ""
+	}
+	return strings.TrimSuffix(s, ".0")
+}
+
+func normalizeMemberType(s string) string {
+	switch strings.ToLower(s) {
+	case "subscriber", "member":
+		return "member"
+	case "customer", "casual":
+		return "casual"
+	}
+	return strings.ToLower(s)
+}
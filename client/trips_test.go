@@ -0,0 +1,63 @@
+package client
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+)
+
+// TestReadTripsLayouts checks that the legacy (2013–2020) and current (2021+) tripdata
+// layouts both decode, and that station refs are mapped to GBFS ids via short_name and
+// legacy_id.
+func TestReadTripsLayouts(t *testing.T) {
+	loc, _ := time.LoadLocation("America/New_York")
+	legacy := `"tripduration","starttime","stoptime","start station id","start station name","start station latitude","start station longitude","end station id","end station name","end station latitude","end station longitude","bikeid","usertype","birth year","gender"
+"320","2019-01-01 00:01:47.4010","2019-01-01 00:07:07.5810","3160","Central Park West & W 76 St","40.78","-73.97","3283","W 89 St & Columbus Ave","40.78","-73.97","15839","Subscriber","1971","1"
+`
+	modern := `ride_id,rideable_type,started_at,ended_at,start_station_name,start_station_id,end_station_name,end_station_id,start_lat,start_lng,end_lat,end_lng,member_casual
+A1,electric_bike,2023-07-01 08:00:01,2023-07-01 08:12:40,Van Brunt St,4846.01,Gone St,9999.99,40.67,-74.01,40.68,-74.0,casual
+B2,classic_bike,not-a-time,2023-07-01 08:12:40,Van Brunt St,4846.01,Gone St,9999.99,40.67,-74.01,40.68,-74.0,member
+`
+	c := &Client{stationMap: map[string]types.StationEntity{
+		"uuid-a": {StationID: "uuid-a", ShortName: "4846.01"},
+		"uuid-b": {StationID: "uuid-b", LegacyID: "3160"},
+	}, neighborhood: map[string]string{"uuid-a": "red-hook"}}
+
+	var trips []types.Trip
+	skipped := 0
+	collect := func(tr types.Trip) error { trips = append(trips, tr); return nil }
+	if err := readTrips(strings.NewReader(legacy), loc, collect, &skipped); err != nil {
+		t.Fatalf("legacy layout: %v", err)
+	}
+	if err := readTrips(strings.NewReader(modern), loc, collect, &skipped); err != nil {
+		t.Fatalf("modern layout: %v", err)
+	}
+	if len(trips) != 2 || skipped != 1 {
+		t.Fatalf("want 2 trips and 1 skipped row, got %d and %d", len(trips), skipped)
+	}
+
+	var stats TripImportStats
+	old, cur := trips[0], trips[1]
+	c.resolveTripEnds(&old, nil, &stats)
+	c.resolveTripEnds(&cur, nil, &stats)
+
+	if old.StartStationID != "uuid-b" || old.MemberType != "member" ||
+		!old.StartedAt.Equal(time.Date(2019, 1, 1, 5, 1, 47, 401000000, time.UTC)) {
+		t.Errorf("legacy trip: %+v", old)
+	}
+	if cur.StartStationID != "uuid-a" || cur.StartNeighborhood != "red-hook" || cur.EndStationID != "" ||
+		cur.RideableType != "electric_bike" || cur.MemberType != "casual" {
+		t.Errorf("modern trip: %+v", cur)
+	}
+	if stats.Unmatched != 2 { // legacy end 3283 and modern end 9999.99
+		t.Errorf("unmatched: want 2, got %d", stats.Unmatched)
+	}
+
+	// a station outside the memo is tagged from the set it's given
+	c.resolveTripEnds(&old, []Neighborhood{{Slug: "uws", Centroid: [2]float64{40.78, -73.97}}}, &stats)
+	if old.StartNeighborhood != "uws" || c.neighborhood["uuid-b"] != "uws" {
+		t.Errorf("legacy trip neighborhood = %q, want uws", old.StartNeighborhood)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/client"
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+	"github.com/spf13/cobra"
+)
+
+func newAlertsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "alerts",
+		Short: "Work with alert rules (see 'ts --alerts').",
+	}
+	cmd.AddCommand(newAlertsTestCmd())
+	return cmd
+}
+
+func newAlertsTestCmd() *cobra.Command {
+	var (
+		rules  string
+		format string
+		maxGap time.Duration
+		send   bool
+	)
+	cmd := &cobra.Command{
+		Use:   "test [file...]",
+		Short: "Dry-run alert rules against recorded snapshots.",
+		Long: "The 'alerts test' command validates an alert rules file, replays JSONL or CSV recorded by 'ts' " +
+			"(stdin when no file is given) through it poll by poll, and prints the alerts it would have " +
+			"raised. Nothing is delivered unless --send is given.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if format != "text" && format != "jsonl" {
+				return fmt.Errorf("--format must be text or jsonl")
+			}
+			cfg, err := client.LoadAlertConfig(rules)
+			if err != nil {
+				return err
+			}
+			var ns []client.Neighborhood
+			if cfg.NeedsNeighborhoods() {
+				if ns, err = loadNeighborhoodSet(); err != nil {
+					return err
+				}
+			}
+			engine, err := client.NewAlertEngine(cfg, ns, maxGap)
+			if err != nil {
+				return err
+			}
+			notifier := client.NewAlertNotifier(cfg)
+			enc := json.NewEncoder(os.Stdout)
+			emit := func(poll []types.NormalizedStationDataTS) error {
+				for _, a := range engine.Evaluate(poll) {
+					if format == "jsonl" {
+						if err := enc.Encode(a); err != nil {
+							return err
+						}
+					} else {
+						fmt.Printf("%s\t%s\t%s\n", a.At.Format(time.RFC3339), a.Status, a.Message)
+					}
+					if send {
+						if err := notifier.Send(a); err != nil {
+							fmt.Fprintf(os.Stderr, "delivery failed: %v\n", err)
+						}
+					}
+				}
+				return nil
+			}
+
+			if len(args) == 0 {
+				args = []string{"-"}
+			}
+			// rows of one poll share its timestamp
+			var poll []types.NormalizedStationDataTS
+			for _, path := range args {
+				if err := client.ReadSnapshots(path, func(d types.NormalizedStationDataTS) error {
+					if len(poll) > 0 && !d.TimeStamp.Equal(poll[0].TimeStamp) {
+						if err := emit(poll); err != nil {
+							return err
+						}
+						poll = poll[:0]
+					}
+					poll = append(poll, d)
+					return nil
+				}); err != nil {
+					return fmt.Errorf("%s: %w", path, err)
+				}
+			}
+			return emit(poll)
+		},
+	}
+	cmd.Flags().StringVar(&rules, "rules", "", "Alert rules file (YAML)")
+	cmd.Flags().StringVar(&format, "format", "text", "Output format: text or jsonl")
+	cmd.Flags().DurationVar(&maxGap, "max-gap", client.DefaultAlertMaxGap, "Restart a rule's minimum duration across polls further apart than this")
+	cmd.Flags().BoolVar(&send, "send", false, "Also deliver the alerts to the rules' destinations")
+	_ = cmd.MarkFlagRequired("rules")
+	return cmd
+}
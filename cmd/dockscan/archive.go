@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/client"
+	"github.com/spf13/cobra"
+)
+
+func newArchiveCmd() *cobra.Command {
+	var (
+		olderThan string
+		dest      string
+		dryRun    bool
+	)
+	cmd := &cobra.Command{
+		Use:   "archive",
+		Short: "Archive old dock_status rows to gzipped CSV, then drop them.",
+		Long: "The 'archive' command streams dock_status rows older than --older-than, in ts order, " +
+			"to one gzipped CSV per UTC day in --dest, records each file's row count and SHA-256 in " +
+			"manifest.json, re-reads every file to verify it, and only then drops the archived " +
+			"TimescaleDB chunks or partitions (or deletes the rows on a plain table).",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			age, err := parseAge(olderThan)
+			if err != nil {
+				return fmt.Errorf("--older-than: %w", err)
+			}
+			plan, err := client.Archive(os.Getenv("DATABASE_URL"), client.ArchiveOptions{
+				Dest:      dest,
+				OlderThan: age,
+				DryRun:    dryRun,
+			})
+			if err != nil {
+				return err
+			}
+			if plan.Cutoff.IsZero() {
+				fmt.Println("nothing old enough to drop whole")
+				return nil
+			}
+			var rows int64
+			for _, d := range plan.Days {
+				rows += d.Rows
+				if dryRun {
+					fmt.Printf("%s\t%d rows\n", d.Day.Format("2006-01-02"), d.Rows)
+				}
+			}
+			verb := "archived and dropped"
+			if dryRun {
+				verb = "would archive and drop"
+			}
+			fmt.Printf("%s %d rows in %d days before %s (%s storage, %d chunks/partitions)\n",
+				verb, rows, len(plan.Days), plan.Cutoff.Format(time.RFC3339), plan.Storage, len(plan.Drop))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&olderThan, "older-than", "90d", "Archive rows older than this age (e.g. 90d or 2160h)")
+	cmd.Flags().StringVar(&dest, "dest", "", "Directory for the archived days and manifest.json")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Show what would be archived and dropped without changing anything")
+	_ = cmd.MarkFlagRequired("dest")
+	return cmd
+}
+
+// parseAge parses a Go duration, plus a whole-day form like "90d".
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
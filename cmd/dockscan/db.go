@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/client"
+	"github.com/spf13/cobra"
+)
+
+func newDBCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "db",
+		Short: "Manage the Postgres schema (DSN from DATABASE_URL).",
+	}
+
+	var target int
+	cmdMigrate := &cobra.Command{
+		Use:   "migrate",
+		Short: "Apply pending schema migrations.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			done, err := client.Migrate(os.Getenv("DATABASE_URL"), target)
+			if err != nil {
+				return err
+			}
+			if len(done) == 0 {
+				fmt.Println("schema is up to date")
+				return nil
+			}
+			fmt.Printf("applied migrations %v\n", done)
+			return nil
+		},
+	}
+	cmdMigrate.Flags().IntVar(&target, "to", 0, "Stop after this version (default: latest)")
+	cmd.AddCommand(cmdMigrate)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "status",
+		Short: "List schema migrations and whether each is applied.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			states, err := client.SchemaStatus(os.Getenv("DATABASE_URL"))
+			if err != nil {
+				return err
+			}
+			fmt.Printf("binary schema version: %d\n", client.LatestSchemaVersion())
+			for _, st := range states {
+				state := "pending"
+				switch {
+				case st.Unknown:
+					state = "applied (unknown to this binary)"
+				case st.Modified:
+					state = "applied (CHECKSUM MISMATCH)"
+				case st.Applied:
+					state = "applied " + st.AppliedAt.Format(time.RFC3339)
+				}
+				fmt.Printf("%4d  %-45s %s\n", st.Version, st.Name, state)
+			}
+			return nil
+		},
+	})
+
+	var steps int
+	cmdRollback := &cobra.Command{
+		Use:   "rollback",
+		Short: "Revert the most recently applied migrations.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			undone, err := client.Rollback(os.Getenv("DATABASE_URL"), steps)
+			if len(undone) > 0 {
+				fmt.Printf("rolled back migrations %v\n", undone)
+			}
+			return err
+		},
+	}
+	cmdRollback.Flags().IntVar(&steps, "steps", 1, "Number of migrations to revert")
+	cmd.AddCommand(cmdRollback)
+
+	var opts client.DedupeOptions
+	cmdDedupe := &cobra.Command{
+		Use:   "dedupe",
+		Short: "Remove duplicate (station_id, ts) rows from dock_status, a window at a time.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stats, err := client.Dedupe(os.Getenv("DATABASE_URL"), opts)
+			if err != nil {
+				return err
+			}
+			verb := "removed"
+			if opts.DryRun {
+				verb = "found"
+			}
+			fmt.Printf("%s %d duplicate rows in %d windows\n", verb, stats.Duplicates, stats.Windows)
+			return nil
+		},
+	}
+	cmdDedupe.Flags().DurationVar(&opts.Window, "window", client.DefaultDedupeWindow, "Span of ts cleaned per transaction")
+	cmdDedupe.Flags().BoolVar(&opts.DryRun, "dry-run", false, "Count duplicates without deleting them")
+	cmdDedupe.Flags().BoolVar(&opts.UniqueKey, "unique-key", false, "Then add a unique key on (station_id, ts) so the ingester skips rows already written")
+	cmd.AddCommand(cmdDedupe)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "partition",
+		Short: "Partition dock_status by day on plain Postgres, so RETENTION_DAYS can drop old days.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stats, err := client.PartitionDockStatus(os.Getenv("DATABASE_URL"), time.Now())
+			switch {
+			case err != nil:
+				return err
+			case stats.Already:
+				fmt.Println("dock_status is already partitioned")
+			case stats.Legacy != "":
+				fmt.Printf("dock_status is partitioned by day; existing rows are in %s\n", stats.Legacy)
+			default:
+				fmt.Println("dock_status is partitioned by day")
+			}
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "share",
+		Short: "Make this database a shared multi-city database.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := client.ShareDatabase(os.Getenv("DATABASE_URL")); err != nil {
+				return err
+			}
+			fmt.Println("database is shared; each ingester writes as its CITY_ID")
+			return nil
+		},
+	})
+
+	var source, city string
+	cmdImport := &cobra.Command{
+		Use:   "import",
+		Short: "Copy a single-city database into this shared database.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stats, err := client.ImportCity(source, os.Getenv("DATABASE_URL"), city)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("imported %s: %d dock_status rows over %d days, %d station versions, %d neighborhoods\n",
+				stats.City, stats.Rows, stats.Days, stats.Stations, stats.Neighborhoods)
+			var left []string
+			for table, n := range stats.NotCopied {
+				if n > 0 {
+					left = append(left, fmt.Sprintf("%s (%d rows)", table, n))
+				}
+			}
+			if len(left) > 0 {
+				sort.Strings(left)
+				fmt.Printf("not carried over: %s\n", strings.Join(left, ", "))
+			}
+			return nil
+		},
+	}
+	cmdImport.Flags().StringVar(&source, "source", "", "DSN of the single-city database to copy")
+	cmdImport.Flags().StringVar(&city, "city", "", "City to import as (default: the source's city_id)")
+	_ = cmdImport.MarkFlagRequired("source")
+	cmd.AddCommand(cmdImport)
+
+	return cmd
+}
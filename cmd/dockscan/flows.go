@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/client"
+	"github.com/kardolus/citi-bike-dock-tracker/types"
+	"github.com/spf13/cobra"
+)
+
+func newFlowsCmd() *cobra.Command {
+	var (
+		threshold int
+		maxGap    time.Duration
+		format    string
+		toDB      bool
+	)
+	cmd := &cobra.Command{
+		Use:   "flows [file...]",
+		Short: "Infer hourly rentals and returns per station from recorded snapshots.",
+		Long: "The 'flows' command replays JSONL or CSV recorded by 'ts' (stdin when no file is given), " +
+			"infers per-station, per-hour rentals and returns by bike type from consecutive snapshots, " +
+			"reports likely rebalancing separately, and prints the result (optionally upserting it into " +
+			"the station_flows table).",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if format != "csv" && format != "jsonl" {
+				return fmt.Errorf("--format must be csv or jsonl")
+			}
+			if len(args) == 0 {
+				args = []string{"-"}
+			}
+			inf := client.NewFlowInferrer(threshold, maxGap)
+			for _, path := range args {
+				if err := client.ReadSnapshots(path, func(d types.NormalizedStationDataTS) error {
+					inf.Observe(d)
+					return nil
+				}); err != nil {
+					return fmt.Errorf("%s: %w", path, err)
+				}
+			}
+			flows := inf.FlushAll()
+			if toDB {
+				if err := client.WriteFlowsPostgres(os.Getenv("DATABASE_URL"), flows); err != nil {
+					return err
+				}
+			}
+			return client.PrintFlows(os.Stdout, flows, format)
+		},
+	}
+	cmd.Flags().IntVar(&threshold, "rebalance-threshold", client.DefaultRebalanceThreshold, "Single-interval change (bikes) treated as rebalancing rather than riders")
+	cmd.Flags().DurationVar(&maxGap, "max-gap", client.DefaultFlowMaxGap, "Skip snapshot pairs further apart than this")
+	cmd.Flags().StringVar(&format, "format", "csv", "Report format: csv or jsonl")
+	cmd.Flags().BoolVar(&toDB, "postgres", false, "Also upsert the result into station_flows (DSN from DATABASE_URL)")
+	return cmd
+}
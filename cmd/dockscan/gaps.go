@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/client"
+	"github.com/spf13/cobra"
+)
+
+func newGapsCmd() *cobra.Command {
+	var (
+		from, to string
+		tz       string
+		maxGap   time.Duration
+		format   string
+		city     string
+	)
+	cmd := &cobra.Command{
+		Use:   "gaps",
+		Short: "List coverage gaps in dock_status and what caused them.",
+		Long: "The 'gaps' command finds every stretch longer than --max-gap without dock_status rows " +
+			"and uses the poll_log table to attribute it to the feed, the database, or the ingester " +
+			"being down or restarted.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			loc, err := time.LoadLocation(tz)
+			if err != nil {
+				return err
+			}
+			start, err := time.ParseInLocation("2006-01-02", from, loc)
+			if err != nil {
+				return fmt.Errorf("--from: %w", err)
+			}
+			end, err := time.ParseInLocation("2006-01-02", to, loc)
+			if err != nil {
+				return fmt.Errorf("--to: %w", err)
+			}
+			gaps, err := client.FindGaps(os.Getenv("DATABASE_URL"), start, end, maxGap, city)
+			if err != nil {
+				return err
+			}
+			return client.WriteGaps(os.Stdout, gaps, format)
+		},
+	}
+	cmd.Flags().StringVar(&from, "from", "", "First day to check (YYYY-MM-DD)")
+	cmd.Flags().StringVar(&to, "to", "", "Day to stop before (YYYY-MM-DD, exclusive)")
+	cmd.Flags().StringVar(&tz, "tz", "America/New_York", "Time zone for --from and --to")
+	cmd.Flags().DurationVar(&maxGap, "max-gap", 6*time.Minute, "Longest stretch without rows that isn't a gap (about twice the ingest interval)")
+	cmd.Flags().StringVar(&format, "format", "text", "Output format: text or jsonl")
+	cmd.Flags().StringVar(&city, "city", os.Getenv("CITY_ID"), "City to check in a shared database")
+	_ = cmd.MarkFlagRequired("from")
+	_ = cmd.MarkFlagRequired("to")
+	return cmd
+}
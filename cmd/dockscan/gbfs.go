@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/kardolus/citi-bike-dock-tracker/client"
+	"github.com/spf13/cobra"
+)
+
+func newGBFSCmd() *cobra.Command {
+	var (
+		opts     client.GBFSOptions
+		interval int
+		only     []string
+		area     string
+		bbox     string
+	)
+	cmd := &cobra.Command{
+		Use:   "gbfs",
+		Short: "Republish the tracked stations as a GBFS v2.3 and v3.0 feed.",
+		Long: "The 'gbfs' command polls the configured feed (GBFS, PBSC or TfL BikePoint) and serves the " +
+			"normalized stations as standard GBFS at /gbfs/2.3/gbfs.json and /gbfs/3.0/gbfs.json, so " +
+			"GBFS consumers can read feeds that aren't GBFS upstream.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.SystemID == "" {
+				return errors.New("--system-id is required (it defaults to CITY_ID)")
+			}
+			builder := newFeedBuilder().WithInterval(interval)
+			if len(only) > 0 {
+				builder = builder.WithIDFilter(only)
+			}
+			builder, err := withAreaFilter(builder, area, bbox)
+			if err != nil {
+				return err
+			}
+			c, err := builder.Build()
+			if err != nil {
+				return err
+			}
+			return c.ServeGBFS(opts)
+		},
+	}
+	cmd.Flags().StringVar(&opts.Addr, "addr", client.DefaultGBFSAddr, "Address to listen on")
+	cmd.Flags().StringVar(&opts.BaseURL, "base-url", "", "Public URL of /gbfs for the links in gbfs.json (default: from each request's Host)")
+	cmd.Flags().StringVar(&opts.SystemID, "system-id", os.Getenv("CITY_ID"), "system_id for system_information")
+	cmd.Flags().StringVar(&opts.Name, "name", "", "System name for system_information")
+	cmd.Flags().StringVar(&opts.Operator, "operator", "", "Operator name for system_information")
+	cmd.Flags().StringVar(&opts.Timezone, "timezone", "America/New_York", "The system's IANA time zone")
+	cmd.Flags().StringVar(&opts.Language, "language", "en", "Language of the names in the feed")
+	cmd.Flags().StringVar(&opts.ContactEmail, "contact-email", "", "feed_contact_email (required by GBFS v3.0)")
+	cmd.Flags().IntVar(&interval, "interval", 60, "Seconds between polls of the upstream feed (the station_status ttl)")
+	cmd.Flags().StringSliceVar(&only, "id", []string{}, "Only publish these station IDs")
+	cmd.Flags().StringVar(&area, "area", "", "Named area to publish: 'redhook' (bbox) or 'bk-curated' (multi-neighborhood)")
+	cmd.Flags().StringVar(&bbox, "bbox", "", "Only publish stations in this bounding box: minLat,minLon,maxLat,maxLon")
+	_ = cmd.MarkFlagRequired("name")
+	return cmd
+}
@@ -4,12 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/kardolus/citi-bike-dock-tracker/client"
+	"github.com/kardolus/citi-bike-dock-tracker/logging"
 	"github.com/kardolus/citi-bike-dock-tracker/metrics"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"os"
-	"strconv"
 	"strings"
+	"time"
 	_ "time/tzdata" // embed the tz database so LoadLocation works in distroless
 )
 
@@ -26,6 +27,26 @@ var (
 	area        string
 	bbox        string
 	metricsAddr string
+	changesOnly bool
+	keyframe    int
+	flows       bool
+	rebalanceAt int
+	narrowFacts bool
+	spoolDir    string
+	spoolMaxMB  int
+	stream      bool
+	streamBuf   int
+	stationMet  bool
+	trackedMet  bool
+	stationMax  int
+	readyOn     string
+	readyGrace  int
+	outages     bool
+	outagesFile string
+	alertsPath  string
+	logLevel    string
+	logFormat   string
+	logRepeat   int
 )
 
 // curatedArea is the special --area value that enables the curated
@@ -53,6 +74,24 @@ func main() {
 
 	viper.AutomaticEnv()
 
+	// Logs go to stderr as logfmt or JSON; LOG_LEVEL / LOG_FORMAT set the defaults so
+	// every city's pod can be configured from its env.
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", envOr("LOG_LEVEL", "info"), "Log level: debug, info, warn or error")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", envOr("LOG_FORMAT", logging.FormatLogfmt), "Log format: logfmt or json")
+	rootCmd.PersistentFlags().IntVar(&logRepeat, "log-repeat-window", int(logging.DefaultRepeatWindow.Seconds()), "Seconds to hold back repeats of the same warning or error (0 = log every one)")
+	cobra.OnInitialize(func() {
+		err := logging.Setup(os.Stderr, logging.Options{
+			Level:        logLevel,
+			Format:       logFormat,
+			City:         os.Getenv("CITY_ID"),
+			RepeatWindow: time.Duration(logRepeat) * time.Second,
+		})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	})
+
 	var cmdInfo = &cobra.Command{
 		Use:   "info",
 		Short: "Retrieve and display Citibike dock station status.",
@@ -84,6 +123,47 @@ func main() {
 			if cmd.Flags().Changed("output") && !cmd.Flags().Changed("csv") {
 				return fmt.Errorf("--output requires --csv")
 			}
+			if cmd.Flags().Changed("keyframe-interval") && !cmd.Flags().Changed("changes-only") {
+				return fmt.Errorf("--keyframe-interval requires --changes-only")
+			}
+			if cmd.Flags().Changed("flows") && !cmd.Flags().Changed("postgres") {
+				return fmt.Errorf("--flows requires --postgres")
+			}
+			if cmd.Flags().Changed("narrow-facts") && !cmd.Flags().Changed("postgres") {
+				return fmt.Errorf("--narrow-facts requires --postgres")
+			}
+			if cmd.Flags().Changed("spool-dir") && !cmd.Flags().Changed("postgres") {
+				return fmt.Errorf("--spool-dir requires --postgres")
+			}
+			if cmd.Flags().Changed("spool-max-mb") && !cmd.Flags().Changed("spool-dir") {
+				return fmt.Errorf("--spool-max-mb requires --spool-dir")
+			}
+			if cmd.Flags().Changed("stream-buffer") && !cmd.Flags().Changed("stream") {
+				return fmt.Errorf("--stream-buffer requires --stream")
+			}
+			if stream && metricsAddr == "" {
+				return fmt.Errorf("--stream needs the metrics server (--metrics-addr)")
+			}
+			for _, flag := range []string{"station-metrics-tracked", "station-metrics-max"} {
+				if cmd.Flags().Changed(flag) && !cmd.Flags().Changed("station-metrics") {
+					return fmt.Errorf("--%s requires --station-metrics", flag)
+				}
+			}
+			if stationMet && metricsAddr == "" {
+				return fmt.Errorf("--station-metrics needs the metrics server (--metrics-addr)")
+			}
+			if cmd.Flags().Changed("outages-file") && !cmd.Flags().Changed("outages") {
+				return fmt.Errorf("--outages-file requires --outages")
+			}
+			if outages && !postgres && outagesFile == "" {
+				return fmt.Errorf("--outages needs somewhere to write: --postgres (station_outages) or --outages-file")
+			}
+			if readyGrace <= 0 {
+				return fmt.Errorf("--ready-grace must be positive")
+			}
+			if err := metrics.SetReadiness(readyOn, time.Duration(readyGrace)*time.Second); err != nil {
+				return fmt.Errorf("--ready-on: %w", err)
+			}
 			return nil
 		},
 	}
@@ -96,9 +176,36 @@ func main() {
 	cmdTs.Flags().BoolVar(&postgres, "postgres", false, "Write station status to Postgres (DSN from DATABASE_URL)")
 	cmdTs.Flags().StringVar(&area, "area", "", "Named area to track: 'redhook' (bbox) or 'bk-curated' (multi-neighborhood)")
 	cmdTs.Flags().StringVar(&bbox, "bbox", "", "Bounding box filter: minLat,minLon,maxLat,maxLon")
-	cmdTs.Flags().StringVar(&metricsAddr, "metrics-addr", ":2112", "Address for the /metrics + /healthz server (empty to disable)")
+	cmdTs.Flags().StringVar(&metricsAddr, "metrics-addr", ":2112", "Address for the /metrics, /healthz, /ready and /status server (empty to disable)")
+	cmdTs.Flags().BoolVar(&changesOnly, "changes-only", false, "Only emit stations whose counts or flags changed since the previous poll")
+	cmdTs.Flags().IntVar(&keyframe, "keyframe-interval", 3600, "With --changes-only, emit a full snapshot every N seconds (0 = first poll only)")
+	cmdTs.Flags().BoolVar(&flows, "flows", false, "Also infer hourly rentals/returns into the station_flows table")
+	cmdTs.Flags().IntVar(&rebalanceAt, "rebalance-threshold", client.DefaultRebalanceThreshold, "With --flows, single-interval change (bikes) treated as rebalancing")
+	cmdTs.Flags().BoolVar(&narrowFacts, "narrow-facts", false, "Write only station_id, counts and ts to dock_status (names/positions live in the stations table)")
+	cmdTs.Flags().StringVar(&spoolDir, "spool-dir", "", "Spool batches that fail to reach Postgres in this directory and replay them later")
+	cmdTs.Flags().IntVar(&spoolMaxMB, "spool-max-mb", client.DefaultSpoolMaxBytes>>20, "Size bound for --spool-dir; the oldest spooled data is dropped beyond it")
+	cmdTs.Flags().BoolVar(&stream, "stream", false, "Serve each poll as server-sent events at /events on the metrics server")
+	cmdTs.Flags().IntVar(&streamBuf, "stream-buffer", client.DefaultStreamBuffer, "With --stream, polls kept for Last-Event-ID resume")
+	cmdTs.Flags().BoolVar(&stationMet, "station-metrics", false, "Export per-station and per-neighborhood bikes/e-bikes/docks gauges on /metrics")
+	cmdTs.Flags().BoolVar(&trackedMet, "station-metrics-tracked", false, "With --station-metrics, export only the stations --id/--area/--bbox track (default: the whole feed)")
+	cmdTs.Flags().IntVar(&stationMax, "station-metrics-max", 5000, "With --station-metrics, withhold per-station series past this many stations (0 = no limit)")
+	cmdTs.Flags().BoolVar(&outages, "outages", false, "Track empty, full, no-e-bike and not-renting episodes per station (station_outages with --postgres)")
+	cmdTs.Flags().StringVar(&outagesFile, "outages-file", "", "With --outages, append outage events to this file as JSON Lines")
+	cmdTs.Flags().StringVar(&alertsPath, "alerts", "", "Evaluate the alert rules in this YAML file on every poll and deliver what they raise")
+	cmdTs.Flags().StringVar(&readyOn, "ready-on", metrics.ReadyIngest, "What /ready requires recently: 'ingest' (fetch and write), 'fetch' or 'write'")
+	cmdTs.Flags().IntVar(&readyGrace, "ready-grace", 300, "Seconds since the last success before /ready fails")
 
 	rootCmd.AddCommand(cmdTs)
+	rootCmd.AddCommand(newFlowsCmd())
+	rootCmd.AddCommand(newTripsCmd())
+	rootCmd.AddCommand(newODCmd())
+	rootCmd.AddCommand(newDBCmd())
+	rootCmd.AddCommand(newGapsCmd())
+	rootCmd.AddCommand(newArchiveCmd())
+	rootCmd.AddCommand(newRestoreCmd())
+	rootCmd.AddCommand(newServeCmd())
+	rootCmd.AddCommand(newGBFSCmd())
+	rootCmd.AddCommand(newAlertsCmd())
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -139,6 +246,94 @@ func runInfo(cmd *cobra.Command, args []string) error {
 }
 
 func runTs(cmd *cobra.Command, args []string) error {
+	builder := newFeedBuilder()
+
+	if len(ids) > 0 {
+		builder = builder.WithIDFilter(ids)
+	}
+
+	if interval > 0 {
+		builder = builder.WithInterval(interval)
+	}
+
+	if output != "" {
+		builder = builder.WithOutputDirectory(output)
+	}
+
+	if changesOnly {
+		builder = builder.WithChangesOnly(time.Duration(keyframe) * time.Second)
+	}
+
+	if flows {
+		builder = builder.WithFlowInference(rebalanceAt)
+	}
+
+	if narrowFacts {
+		builder = builder.WithNarrowFacts()
+	}
+
+	if outages {
+		builder = builder.WithOutageDetection(outagesFile)
+	}
+
+	if alertsPath != "" {
+		cfg, err := client.LoadAlertConfig(alertsPath)
+		if err != nil {
+			return err
+		}
+		var ns []client.Neighborhood
+		if cfg.NeedsNeighborhoods() {
+			if ns, err = loadNeighborhoodSet(); err != nil {
+				return err
+			}
+		}
+		builder = builder.WithAlerts(cfg, ns)
+	}
+
+	if spoolDir != "" {
+		builder = builder.WithSpool(spoolDir, int64(spoolMaxMB)<<20)
+	}
+
+	if stream {
+		events := client.NewEventStream(streamBuf)
+		builder = builder.WithEventStream(events)
+		metrics.Handle("/events", events)
+	}
+
+	if stationMet {
+		metrics.EnableStationGauges(stationMax)
+		builder = builder.WithStationMetrics(trackedMet)
+	}
+
+	builder, err := withAreaFilter(builder, area, bbox)
+	if err != nil {
+		return err
+	}
+
+	c, err := builder.Build()
+	if err != nil {
+		return err
+	}
+
+	if metricsAddr != "" {
+		metrics.Serve(metricsAddr)
+	}
+
+	if postgres {
+		return c.IngestPostgres(os.Getenv("DATABASE_URL"))
+	}
+
+	if csv {
+		c.PrintStationDataCSV(exclude)
+	} else {
+		c.PrintStationDataJSONL()
+	}
+
+	return nil
+}
+
+// newFeedBuilder returns a ClientBuilder pointed at this deployment's feed.
+func newFeedBuilder() *client.ClientBuilder {
 	builder := client.NewClientBuilder()
 
 	// Per-city config via env (one image serves every city). GBFS_URL overrides the
@@ -166,19 +361,11 @@ func runTs(cmd *cobra.Command, args []string) error {
 	if v := os.Getenv("GBFS_VEHICLE_TYPES_URL"); v != "" {
 		builder = builder.WithVehicleTypesURL(v)
 	}
+	return builder
+}
 
-	if len(ids) > 0 {
-		builder = builder.WithIDFilter(ids)
-	}
-
-	if interval > 0 {
-		builder = builder.WithInterval(interval)
-	}
-
-	if output != "" {
-		builder = builder.WithOutputDirectory(output)
-	}
-
+// withAreaFilter applies the neighborhood set or bbox that selects tracked stations.
+func withAreaFilter(builder *client.ClientBuilder, area, bbox string) (*client.ClientBuilder, error) {
 	// Neighborhood assignment source, in precedence order:
 	//   1. NEIGHBORHOODS_PATH env  → load that file (the per-city ConfigMap mount).
 	//   2. --area bk-curated       → the embedded NYC default (legacy / fallback).
@@ -186,45 +373,25 @@ func runTs(cmd *cobra.Command, args []string) error {
 	if path := os.Getenv("NEIGHBORHOODS_PATH"); path != "" {
 		ns, err := client.LoadNeighborhoodsFromFile(path)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		builder = builder.WithNeighborhoods(ns)
 	} else if strings.ToLower(area) == curatedArea {
 		ns, err := client.LoadNeighborhoods()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		builder = builder.WithNeighborhoods(ns)
 	} else {
 		box, err := resolveBBox(area, bbox)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if box != nil {
 			builder = builder.WithBBox(*box)
 		}
 	}
-
-	c, err := builder.Build()
-	if err != nil {
-		return err
-	}
-
-	if metricsAddr != "" {
-		metrics.Serve(metricsAddr)
-	}
-
-	if postgres {
-		return c.IngestPostgres(os.Getenv("DATABASE_URL"))
-	}
-
-	if csv {
-		c.PrintStationDataCSV(exclude)
-	} else {
-		c.PrintStationDataJSONL()
-	}
-
-	return nil
+	return builder, nil
 }
 
 // resolveBBox turns --area (named preset) or --bbox (raw coords) into a BBox.
@@ -237,19 +404,11 @@ func resolveBBox(area, bbox string) (*client.BBox, error) {
 		return &b, nil
 	}
 	if bbox != "" {
-		parts := strings.Split(bbox, ",")
-		if len(parts) != 4 {
-			return nil, fmt.Errorf("--bbox must be minLat,minLon,maxLat,maxLon")
-		}
-		var f [4]float64
-		for i, p := range parts {
-			v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
-			if err != nil {
-				return nil, fmt.Errorf("--bbox parse error: %w", err)
-			}
-			f[i] = v
+		b, err := client.ParseBBox(bbox)
+		if err != nil {
+			return nil, fmt.Errorf("--%w", err)
 		}
-		return &client.BBox{MinLat: f[0], MinLon: f[1], MaxLat: f[2], MaxLon: f[3]}, nil
+		return &b, nil
 	}
 	return nil, nil
 }
@@ -260,6 +419,14 @@ func runVersion(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// envOr returns the environment variable key, or def when it's unset.
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
 // appendQuery adds a query param to a URL (used for TfL's optional app_key). Empty URLs are
 // left untouched so an unset info/status URL still falls back to the GBFS default path.
 func appendQuery(url, q string) string {
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/client"
+	"github.com/spf13/cobra"
+)
+
+func newODCmd() *cobra.Command {
+	var (
+		from, to string
+		level    string
+		format   string
+		tz       string
+		hour     int
+		filter   client.ODFilter
+	)
+	cmd := &cobra.Command{
+		Use:   "od",
+		Short: "Export neighborhood origin–destination matrices from imported trips.",
+		Long: "The 'od' command aggregates the trips table (see 'trips import') into " +
+			"neighborhood×neighborhood or area×area matrices by hour of week and exports them " +
+			"as CSV, JSON or a GeoJSON flow-line layer drawn between neighborhood centroids.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if level != client.ODLevelNeighborhood && level != client.ODLevelArea {
+				return fmt.Errorf("--level must be %s or %s", client.ODLevelNeighborhood, client.ODLevelArea)
+			}
+			loc, err := time.LoadLocation(tz)
+			if err != nil {
+				return err
+			}
+			start, err := time.ParseInLocation("2006-01-02", from, loc)
+			if err != nil {
+				return fmt.Errorf("--from: %w", err)
+			}
+			end, err := time.ParseInLocation("2006-01-02", to, loc)
+			if err != nil {
+				return fmt.Errorf("--to: %w", err)
+			}
+			ns, err := loadNeighborhoodSet()
+			if err != nil {
+				return err
+			}
+			m, err := client.LoadODMatrix(os.Getenv("DATABASE_URL"), ns, start, end, loc)
+			if err != nil {
+				return err
+			}
+			if level == client.ODLevelArea {
+				m = m.RollupToAreas(ns)
+			}
+			if hour >= 0 {
+				filter.Hour = &hour
+			}
+			return m.Filter(filter).WriteOD(os.Stdout, format)
+		},
+	}
+	cmd.Flags().StringVar(&from, "from", "", "First day to include (YYYY-MM-DD)")
+	cmd.Flags().StringVar(&to, "to", "", "Day to stop before (YYYY-MM-DD, exclusive)")
+	cmd.Flags().StringVar(&level, "level", client.ODLevelNeighborhood, "Matrix level: neighborhood or area")
+	cmd.Flags().StringVar(&format, "format", "csv", "Output format: csv, json or geojson")
+	cmd.Flags().StringVar(&tz, "tz", "America/New_York", "Time zone used for hour of week")
+	cmd.Flags().StringVar(&filter.Origin, "origin", "", "Only trips starting in this neighborhood (or area) slug")
+	cmd.Flags().IntVar(&hour, "hour", -1, "Only trips starting in this hour of day (0-23)")
+	cmd.Flags().IntVar(&filter.MinTrips, "min-trips", 0, "Drop cells with fewer trips")
+	_ = cmd.MarkFlagRequired("from")
+	_ = cmd.MarkFlagRequired("to")
+	return cmd
+}
+
+// loadNeighborhoodSet returns NEIGHBORHOODS_PATH's set, else the embedded NYC default.
+func loadNeighborhoodSet() ([]client.Neighborhood, error) {
+	if path := os.Getenv("NEIGHBORHOODS_PATH"); path != "" {
+		return client.LoadNeighborhoodsFromFile(path)
+	}
+	return client.LoadNeighborhoods()
+}
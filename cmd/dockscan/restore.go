@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/client"
+	"github.com/spf13/cobra"
+)
+
+func newRestoreCmd() *cobra.Command {
+	var (
+		from, to string
+		tz       string
+		table    string
+		city     string
+	)
+	cmd := &cobra.Command{
+		Use:   "restore <archive dir | day.csv.gz | recording.jsonl | recording.csv>...",
+		Short: "Load archived or recorded station status back into Postgres.",
+		Long: "The 'restore' command reads days archived by 'archive' (a directory or single files) " +
+			"and recordings made by 'ts', and bulk-loads the rows between --from and --to into " +
+			"dock_status or a scratch --table, skipping rows that are already there.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			loc, err := time.LoadLocation(tz)
+			if err != nil {
+				return err
+			}
+			start, err := time.ParseInLocation("2006-01-02", from, loc)
+			if err != nil {
+				return fmt.Errorf("--from: %w", err)
+			}
+			end, err := time.ParseInLocation("2006-01-02", to, loc)
+			if err != nil {
+				return fmt.Errorf("--to: %w", err)
+			}
+			stats, err := client.Restore(os.Getenv("DATABASE_URL"), args, client.RestoreOptions{
+				From:  start,
+				To:    end,
+				Table: table,
+				City:  city,
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Printf("restored %d rows into %s from %d files (%d read, %d in range, %d already present)\n",
+				stats.Inserted, table, stats.Files, stats.Read, stats.InRange, stats.Skipped)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&from, "from", "", "First day to load (YYYY-MM-DD)")
+	cmd.Flags().StringVar(&to, "to", "", "Day to stop before (YYYY-MM-DD, exclusive)")
+	cmd.Flags().StringVar(&tz, "tz", "America/New_York", "Time zone for --from and --to")
+	cmd.Flags().StringVar(&city, "city", os.Getenv("CITY_ID"), "City the rows belong to in a shared database")
+	cmd.Flags().StringVar(&table, "table", "dock_status", "Target table; anything but dock_status is created as a scratch copy of its columns")
+	_ = cmd.MarkFlagRequired("from")
+	_ = cmd.MarkFlagRequired("to")
+	return cmd
+}
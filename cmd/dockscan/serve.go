@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+
+	"github.com/kardolus/citi-bike-dock-tracker/client"
+	"github.com/spf13/cobra"
+)
+
+func newServeCmd() *cobra.Command {
+	var opts client.ServeOptions
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve the ingested data as a read-only JSON API.",
+		Long: "The 'serve' command answers JSON requests for the latest status of every station, " +
+			"a station's downsampled history and neighborhood aggregates from the database in " +
+			"DATABASE_URL. GET /v1/openapi.json describes the endpoints.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return client.Serve(os.Getenv("DATABASE_URL"), opts)
+		},
+	}
+	cmd.Flags().StringVar(&opts.Addr, "addr", client.DefaultServeAddr, "Address to listen on")
+	cmd.Flags().DurationVar(&opts.MaxAge, "max-age", client.DefaultServeMaxAge, "Cache-Control max-age for responses with current data (about the ingest interval)")
+	cmd.Flags().StringVar(&opts.City, "city", os.Getenv("CITY_ID"), "City to serve from a shared database")
+	return cmd
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kardolus/citi-bike-dock-tracker/client"
+	"github.com/spf13/cobra"
+)
+
+func newTripsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "trips",
+		Short: "Work with the operator's published trip history.",
+	}
+
+	var tz string
+	cmdImport := &cobra.Command{
+		Use:   "import <zip|csv>...",
+		Short: "Load monthly tripdata (zipped or plain CSV) into the trips table.",
+		Long: "The 'trips import' command streams Citi Bike monthly tripdata files into Postgres " +
+			"(DSN from DATABASE_URL), mapping each trip's start/end station to the current GBFS " +
+			"station_id and tagging both ends with a neighborhood (NEIGHBORHOODS_PATH, else the " +
+			"embedded NYC set). Re-importing a file replaces its rows.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			loc, err := time.LoadLocation(tz)
+			if err != nil {
+				return err
+			}
+			// every station in the feed, so trips from anywhere in the city match
+			c, err := newFeedBuilder().Build()
+			if err != nil {
+				return err
+			}
+			ns, err := loadNeighborhoodSet()
+			if err != nil {
+				return err
+			}
+			var total client.TripImportStats
+			for _, path := range args {
+				st, err := c.ImportTrips(os.Getenv("DATABASE_URL"), path, loc, ns)
+				if err != nil {
+					return err
+				}
+				total.Files += st.Files
+				total.Loaded += st.Loaded
+				total.Skipped += st.Skipped
+				total.Unmatched += st.Unmatched
+			}
+			fmt.Printf("imported %d trips from %d files (%d rows skipped, %d trip ends without a matching station)\n",
+				total.Loaded, total.Files, total.Skipped, total.Unmatched)
+			return nil
+		},
+	}
+	cmdImport.Flags().StringVar(&tz, "tz", "America/New_York", "Time zone of the timestamps in the files")
+	cmd.AddCommand(cmdImport)
+
+	return cmd
+}
@@ -28,6 +28,13 @@ var userAgent = func() string {
 	return defaultUserAgent
 }()
 
+// StatusError is a non-2xx response.
+type StatusError struct {
+	Code int
+}
+
+func (e StatusError) Error() string { return fmt.Sprintf(errHTTP, e.Code) }
+
 type Caller interface {
 	Get(url string) ([]byte, error)
 }
@@ -47,14 +54,23 @@ func New() *RestCaller {
 }
 
 func (r *RestCaller) Get(url string) ([]byte, error) {
-	return r.doRequest(http.MethodGet, url, nil)
+	return r.doRequest(http.MethodGet, url, nil, nil)
 }
 
-func (r *RestCaller) doRequest(method, url string, body []byte) ([]byte, error) {
+// Post sends body to url; headers are set on top of the defaults (a JSON content type).
+// Not part of Caller, which only reads feeds.
+func (r *RestCaller) Post(url string, headers map[string]string, body []byte) ([]byte, error) {
+	return r.doRequest(http.MethodPost, url, body, headers)
+}
+
+func (r *RestCaller) doRequest(method, url string, body []byte, headers map[string]string) ([]byte, error) {
 	req, err := r.newRequest(method, url, body)
 	if err != nil {
 		return nil, fmt.Errorf(errFailedToCreateRequest, err)
 	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
 
 	response, err := r.client.Do(req)
 	if err != nil {
@@ -63,7 +79,7 @@ func (r *RestCaller) doRequest(method, url string, body []byte) ([]byte, error)
 	defer response.Body.Close()
 
 	if response.StatusCode < 200 || response.StatusCode >= 300 {
-		return nil, fmt.Errorf(errHTTP, response.StatusCode)
+		return nil, StatusError{Code: response.StatusCode}
 	}
 
 	result, err := io.ReadAll(response.Body)
@@ -0,0 +1,198 @@
+// Package logging sets up dockscan's structured logs: slog at a chosen level, as JSON
+// or logfmt, with the city on every line and repeats of the same error held back so a
+// dead feed doesn't flood the logs. Goes through slog-shim, which is log/slog on Go
+// 1.21+ and golang.org/x/exp/slog before that.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+// Output formats.
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+)
+
+// Field keys used across the code base, so lines aggregate across cities.
+const (
+	KeyCity      = "city"
+	KeyFeed      = "feed"
+	KeyStations  = "station_count"
+	KeyDuration  = "duration" // seconds
+	KeyError     = "error"
+	KeyErrorKind = "error_kind"
+	KeyRepeated  = "repeated" // repeats held back since the last line like this one
+)
+
+// DefaultRepeatWindow is how long repeats of a warning or error are held back.
+const DefaultRepeatWindow = 5 * time.Minute
+
+// Options configures Setup.
+type Options struct {
+	Level        string        // debug, info, warn or error; empty = info
+	Format       string        // FormatLogfmt (default) or FormatJSON
+	City         string        // added to every line when set
+	RepeatWindow time.Duration // zero = no rate limiting
+}
+
+// Setup installs the default slog logger, which the log package writes through too.
+func Setup(w io.Writer, opts Options) error {
+	var level slog.Level
+	if opts.Level != "" {
+		if err := level.UnmarshalText([]byte(opts.Level)); err != nil {
+			return fmt.Errorf("unknown log level %q (want debug, info, warn or error)", opts.Level)
+		}
+	}
+	ho := &slog.HandlerOptions{Level: level, ReplaceAttr: replaceAttr}
+	var h slog.Handler
+	switch strings.ToLower(opts.Format) {
+	case "", FormatLogfmt:
+		h = slog.NewTextHandler(w, ho)
+	case FormatJSON:
+		h = slog.NewJSONHandler(w, ho)
+	default:
+		return fmt.Errorf("unknown log format %q (want %s or %s)", opts.Format, FormatLogfmt, FormatJSON)
+	}
+	if opts.RepeatWindow > 0 {
+		h = NewRateLimiter(h, opts.RepeatWindow)
+	}
+	if opts.City != "" {
+		h = h.WithAttrs([]slog.Attr{slog.String(KeyCity, opts.City)})
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// replaceAttr writes durations as seconds, which JSON would otherwise render in
+// nanoseconds and logfmt as "1.5s".
+func replaceAttr(_ []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindDuration {
+		return slog.Float64(a.Key, a.Value.Duration().Seconds())
+	}
+	return a
+}
+
+// Error is the attrs for a failed operation: the error and its kind, e.g. "timeout" or
+// "db".
+func Error(err error, kind string) slog.Attr {
+	return slog.Group("", slog.String(KeyError, err.Error()), slog.String(KeyErrorKind, kind))
+}
+
+// RateLimiter is a Handler that passes the first of a run of identical warnings or
+// errors and drops repeats for a window; the next line after the window carries how
+// many it dropped. Lines are identical when they share the message, feed and error
+// kind; the error text is left out, as it often carries addresses or timings.
+type RateLimiter struct {
+	next  slog.Handler
+	attrs []slog.Attr // from WithAttrs, part of the key
+	state *repeats
+}
+
+type repeats struct {
+	window time.Duration
+	mu     sync.Mutex
+	seen   map[string]*repeat
+}
+
+type repeat struct {
+	since   time.Time // when the last line was passed
+	dropped int
+}
+
+// NewRateLimiter wraps next, holding back repeats for window.
+func NewRateLimiter(next slog.Handler, window time.Duration) *RateLimiter {
+	return &RateLimiter{next: next, state: &repeats{window: window, seen: make(map[string]*repeat)}}
+}
+
+// Enabled implements slog.Handler.
+func (h *RateLimiter) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+// Handle implements slog.Handler.
+func (h *RateLimiter) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		return h.next.Handle(ctx, r)
+	}
+	dropped, pass := h.state.allow(h.key(r), r.Time)
+	if !pass {
+		return nil
+	}
+	if dropped > 0 {
+		r = r.Clone()
+		r.AddAttrs(slog.Int(KeyRepeated, dropped))
+	}
+	return h.next.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler.
+func (h *RateLimiter) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &RateLimiter{
+		next:  h.next.WithAttrs(attrs),
+		attrs: append(append([]slog.Attr(nil), h.attrs...), attrs...),
+		state: h.state,
+	}
+}
+
+// WithGroup implements slog.Handler.
+func (h *RateLimiter) WithGroup(name string) slog.Handler {
+	return &RateLimiter{next: h.next.WithGroup(name), attrs: h.attrs, state: h.state}
+}
+
+func (h *RateLimiter) key(r slog.Record) string {
+	var feed, kind string
+	var visit func(a slog.Attr)
+	visit = func(a slog.Attr) {
+		switch {
+		case a.Value.Kind() == slog.KindGroup:
+			for _, g := range a.Value.Group() {
+				visit(g)
+			}
+		case a.Key == KeyFeed:
+			feed = a.Value.String()
+		case a.Key == KeyErrorKind:
+			kind = a.Value.String()
+		}
+	}
+	for _, a := range h.attrs {
+		visit(a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		visit(a)
+		return true
+	})
+	return r.Message + "\x00" + feed + "\x00" + kind
+}
+
+// allow reports whether a line keyed key at t passes, and how many were dropped
+// before it.
+func (s *repeats) allow(key string, t time.Time) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.seen[key]; ok && t.Sub(r.since) < s.window {
+		r.dropped++
+		return 0, false
+	}
+	var dropped int
+	if r, ok := s.seen[key]; ok {
+		dropped = r.dropped
+	}
+	s.seen[key] = &repeat{since: t}
+	// lines don't repeat past their window; don't keep them forever
+	if len(s.seen) > 1000 {
+		for k, r := range s.seen {
+			if t.Sub(r.since) >= s.window {
+				delete(s.seen, k)
+			}
+		}
+	}
+	return dropped, true
+}
@@ -0,0 +1,80 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	slog "github.com/sagikazarmark/slog-shim"
+)
+
+// TestSetup covers the formats, levels, city field and durations in seconds.
+func TestSetup(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	var buf bytes.Buffer
+	if err := Setup(&buf, Options{Level: "warn", Format: FormatJSON, City: "nyc"}); err != nil {
+		t.Fatal(err)
+	}
+	slog.Info("dropped below the level")
+	slog.Warn("fetch failed", Error(errors.New("i/o timeout"), "timeout"), KeyDuration, 1500*time.Millisecond)
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("%v:\n%s", err, buf.String())
+	}
+	if line["msg"] != "fetch failed" || line[KeyCity] != "nyc" || line[KeyError] != "i/o timeout" ||
+		line[KeyErrorKind] != "timeout" || line[KeyDuration] != 1.5 {
+		t.Errorf("unexpected line: %s", buf.String())
+	}
+
+	buf.Reset()
+	if err := Setup(&buf, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	slog.Debug("dropped below the level")
+	slog.Info("polled", KeyStations, 19)
+	if got := buf.String(); !strings.Contains(got, `level=INFO msg=polled station_count=19`) {
+		t.Errorf("unexpected logfmt line: %q", got)
+	}
+
+	if err := Setup(&buf, Options{Format: "xml"}); err == nil {
+		t.Error("Setup accepted an unknown format")
+	}
+	if err := Setup(&buf, Options{Level: "loud"}); err == nil {
+		t.Error("Setup accepted an unknown level")
+	}
+}
+
+// TestRateLimiter covers holding back repeats of a warning and counting them.
+func TestRateLimiter(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(NewRateLimiter(slog.NewTextHandler(&buf, nil), time.Minute))
+	start := time.Now()
+	at := func(offset time.Duration, msg string, args ...any) {
+		r := slog.NewRecord(start.Add(offset), slog.LevelError, msg, 0)
+		r.Add(args...)
+		_ = log.Handler().Handle(context.Background(), r)
+	}
+
+	feed := log.With(KeyFeed, "station_status")
+	for i := 0; i < 3; i++ {
+		at(time.Duration(i)*time.Second, "fetch failed", Error(errors.New("dial tcp: refused"), "network"))
+	}
+	at(5*time.Second, "fetch failed", Error(errors.New("i/o timeout"), "timeout")) // another kind
+	_ = feed.Handler().Handle(context.Background(), slog.NewRecord(start, slog.LevelError, "fetch failed", 0))
+	log.Info("info is never held back")
+	log.Info("info is never held back")
+	at(90*time.Second, "fetch failed", Error(errors.New("dial tcp: refused"), "network"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("got %d lines, want 6:\n%s", len(lines), buf.String())
+	}
+	if strings.Contains(lines[0], KeyRepeated) || !strings.HasSuffix(lines[5], KeyRepeated+"=2") {
+		t.Errorf("repeats not counted:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Histogram is a fixed-bucket Prometheus histogram rendered in the same hand-rolled
+// text format as the counters above. Safe for concurrent use.
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64 // upper bounds, ascending; +Inf is implicit
+	labels  string    // rendered labels of a HistogramVec child, e.g. feed="station_status"
+
+	mu     sync.Mutex
+	counts []uint64 // per bucket, non-cumulative
+	sum    float64
+	count  uint64
+}
+
+var (
+	histMu     sync.Mutex
+	histograms []*Histogram
+)
+
+// NewHistogram creates a histogram and registers it for /metrics.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	histMu.Lock()
+	histograms = append(histograms, h)
+	histMu.Unlock()
+	return h
+}
+
+// Observe records one value.
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, ub := range h.buckets {
+		if v <= ub {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// ObserveDuration records d in seconds.
+func (h *Histogram) ObserveDuration(d time.Duration) { h.Observe(d.Seconds()) }
+
+func (h *Histogram) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.writeSamples(w)
+}
+
+func (h *Histogram) writeSamples(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	labels, bucketLabels := "", ""
+	if h.labels != "" {
+		labels, bucketLabels = "{"+h.labels+"}", h.labels+","
+	}
+	var cum uint64
+	for i, ub := range h.buckets {
+		cum += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, bucketLabels, formatBound(ub), cum)
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, bucketLabels, h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, h.count)
+}
+
+func formatBound(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func writeHistograms(w io.Writer) {
+	histMu.Lock()
+	hs := append([]*Histogram(nil), histograms...)
+	histMu.Unlock()
+	for _, h := range hs {
+		h.write(w)
+	}
+}
+
+// LatencyBuckets spans 5ms–30s, suitable for network and database calls.
+var LatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// DecodeBuckets spans 0.5ms–1s, for parsing a feed already in memory.
+var DecodeBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// SizeBuckets spans 1KiB–16MiB, for feed payloads.
+var SizeBuckets = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+
+// DBWriteSeconds is the wall time of each dock_status batch write (COPY or INSERT).
+var DBWriteSeconds = NewHistogram("citibike_db_write_seconds",
+	"Time to write one poll's rows to Postgres.", LatencyBuckets)
+
+// Per-feed instrumentation; feed is station_status, station_information or
+// vehicle_types.
+var (
+	FetchSeconds = NewHistogramVec("citibike_fetch_seconds",
+		"Time to download one feed.", "feed", LatencyBuckets)
+	FetchBytes = NewHistogramVec("citibike_fetch_bytes",
+		"Size of one feed download.", "feed", SizeBuckets)
+	DecodeSeconds = NewHistogramVec("citibike_decode_seconds",
+		"Time to parse one feed.", "feed", DecodeBuckets)
+	FeedAge = NewGaugeVec("citibike_feed_age_seconds",
+		"How stale the feed's last_updated was at the last fetch (absent when the feed has none).", "feed")
+	FeedStations = NewGaugeVec("citibike_feed_stations",
+		"Stations in the last fetch of the feed.", "feed")
+)
+
+// Outputs (sinks: postgres, spool, csv, jsonl) and error classes.
+var (
+	SinkRows = NewCounterVec("citibike_sink_rows_total",
+		"Rows written, per output.", "sink")
+	SinkErrors = NewCounterVec("citibike_sink_errors_total",
+		"Failed writes, per output.", "sink")
+	Errors = NewCounterVec("citibike_errors_total",
+		"Errors by class: timeout, network, http_status, empty_response, decode, db, spool, output, alert.", "class")
+)
+
+// Alerts counts the notifications alert rules raise, firing and resolved.
+var Alerts = NewCounterVec("citibike_alerts_total",
+	"Alerts raised, per rule.", "rule")
@@ -19,18 +19,73 @@ var (
 	stations    int64
 	lastSuccess int64 // unix seconds of the last successful fetch+write
 
-	// readiness grace: not ready until a recent successful ingest
+	spoolRows    int64
+	spoolOldest  int64 // unix seconds of the oldest spooled row; 0 when the spool is empty
+	spoolDropped uint64
+
+	role int32 // roleNone until the Postgres ingester joins leader election
+
+	streamClients int64
+	streamDropped uint64
+
+	// extra handlers (e.g. the ts event stream) mounted next to /metrics; see Handle
+	extra = map[string]http.Handler{}
+
+	// readiness grace: not ready until a recent success (see SetReadiness)
 	readyGrace = 300 * time.Second
 )
 
-func IncPolls()             { atomic.AddUint64(&polls, 1) }
-func AddRows(n int)         { atomic.AddUint64(&rowsWritten, uint64(n)) }
-func IncFetchError()        { atomic.AddUint64(&fetchErrors, 1) }
-func IncDBError()           { atomic.AddUint64(&dbErrors, 1) }
-func SetStations(n int)     { atomic.StoreInt64(&stations, int64(n)) }
+func IncPolls()               { atomic.AddUint64(&polls, 1) }
+func AddRows(n int)           { atomic.AddUint64(&rowsWritten, uint64(n)) }
+func IncFetchError()          { atomic.AddUint64(&fetchErrors, 1) }
+func IncDBError()             { atomic.AddUint64(&dbErrors, 1) }
+func SetStations(n int)       { atomic.StoreInt64(&stations, int64(n)) }
 func MarkSuccess(t time.Time) { atomic.StoreInt64(&lastSuccess, t.Unix()) }
+func AddSpoolDropped(n int)   { atomic.AddUint64(&spoolDropped, uint64(n)) }
+func AddStreamClients(n int)  { atomic.AddInt64(&streamClients, int64(n)) }
+func IncStreamDropped()       { atomic.AddUint64(&streamDropped, 1) }
+
+// Handle mounts h at pattern on the metrics server. Call it before Serve.
+func Handle(pattern string, h http.Handler) { extra[pattern] = h }
+
+const (
+	roleNone int32 = iota
+	roleLeader
+	roleStandby
+)
+
+// SetLeader records whether this ingester holds the leader lock. A standby's
+// MarkSuccess means a successful fetch, since it doesn't write.
+func SetLeader(leader bool) {
+	r := roleStandby
+	if leader {
+		r = roleLeader
+	}
+	atomic.StoreInt32(&role, r)
+}
 
-// Handler returns the mux serving /metrics, /healthz (liveness) and /ready.
+func roleName() string {
+	switch atomic.LoadInt32(&role) {
+	case roleLeader:
+		return "leader"
+	case roleStandby:
+		return "standby"
+	}
+	return ""
+}
+
+// SetSpool records the local spool's backlog; a zero oldest means it is empty.
+func SetSpool(rows int, oldest time.Time) {
+	atomic.StoreInt64(&spoolRows, int64(rows))
+	var ts int64
+	if rows > 0 && !oldest.IsZero() {
+		ts = oldest.Unix()
+	}
+	atomic.StoreInt64(&spoolOldest, ts)
+}
+
+// Handler returns the mux serving /metrics, /healthz (liveness), /ready, /status and anything
+// mounted with Handle.
 func Handler() http.Handler {
 	mux := http.NewServeMux()
 
@@ -40,18 +95,27 @@ func Handler() http.Handler {
 		_, _ = w.Write([]byte("ok\n"))
 	})
 
-	// readiness: a successful ingest happened recently
+	// readiness: a recent successful ingest (for a standby, a successful fetch), or
+	// whatever SetReadiness asks for. The role, when there is one, is appended to the body
+	// and sent in X-Ingester-Role.
 	mux.HandleFunc("/ready", func(w http.ResponseWriter, _ *http.Request) {
-		last := atomic.LoadInt64(&lastSuccess)
-		if last > 0 && time.Since(time.Unix(last, 0)) < readyGrace {
-			w.WriteHeader(http.StatusOK)
-			_, _ = w.Write([]byte("ready\n"))
+		suffix := ""
+		if r := roleName(); r != "" {
+			w.Header().Set("X-Ingester-Role", r)
+			suffix = " (" + r + ")"
+		}
+		if ok, why := ready(time.Now()); !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("not ready: " + why + suffix + "\n"))
 			return
 		}
-		w.WriteHeader(http.StatusServiceUnavailable)
-		_, _ = w.Write([]byte("not ready: no recent successful ingest\n"))
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ready" + suffix + "\n"))
 	})
 
+	// status: what the ingester is configured to do and how its last poll went
+	mux.HandleFunc("/status", serveStatus)
+
 	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
 		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
 		fmt.Fprintf(w, "# HELP citibike_poll_success_timestamp_seconds Unix time of the last successful fetch+write.\n")
@@ -67,8 +131,32 @@ func Handler() http.Handler {
 		fmt.Fprintf(w, "citibike_db_errors_total %d\n", atomic.LoadUint64(&dbErrors))
 		fmt.Fprintf(w, "# HELP citibike_stations_ingested Stations written in the last successful poll.\n# TYPE citibike_stations_ingested gauge\n")
 		fmt.Fprintf(w, "citibike_stations_ingested %d\n", atomic.LoadInt64(&stations))
+		fmt.Fprintf(w, "# HELP citibike_spool_rows Rows waiting in the local spool for Postgres.\n# TYPE citibike_spool_rows gauge\n")
+		fmt.Fprintf(w, "citibike_spool_rows %d\n", atomic.LoadInt64(&spoolRows))
+		fmt.Fprintf(w, "# HELP citibike_spool_oldest_timestamp_seconds Unix time of the oldest spooled row (0 when empty).\n# TYPE citibike_spool_oldest_timestamp_seconds gauge\n")
+		fmt.Fprintf(w, "citibike_spool_oldest_timestamp_seconds %d\n", atomic.LoadInt64(&spoolOldest))
+		fmt.Fprintf(w, "# HELP citibike_spool_dropped_rows_total Spooled rows dropped to keep the spool under its size bound.\n# TYPE citibike_spool_dropped_rows_total counter\n")
+		fmt.Fprintf(w, "citibike_spool_dropped_rows_total %d\n", atomic.LoadUint64(&spoolDropped))
+		if r := atomic.LoadInt32(&role); r != roleNone {
+			var leader int
+			if r == roleLeader {
+				leader = 1
+			}
+			fmt.Fprintf(w, "# HELP citibike_leader 1 if this ingester holds the leader lock and writes, 0 if it is a standby.\n# TYPE citibike_leader gauge\n")
+			fmt.Fprintf(w, "citibike_leader %d\n", leader)
+		}
+		fmt.Fprintf(w, "# HELP citibike_stream_clients Clients connected to the event stream.\n# TYPE citibike_stream_clients gauge\n")
+		fmt.Fprintf(w, "citibike_stream_clients %d\n", atomic.LoadInt64(&streamClients))
+		fmt.Fprintf(w, "# HELP citibike_stream_dropped_clients_total Event stream clients disconnected for falling behind.\n# TYPE citibike_stream_dropped_clients_total counter\n")
+		fmt.Fprintf(w, "citibike_stream_dropped_clients_total %d\n", atomic.LoadUint64(&streamDropped))
+		writeStationGauges(w)
+		writeHistograms(w)
+		writeVecs(w)
 	})
 
+	for pattern, h := range extra {
+		mux.Handle(pattern, h)
+	}
 	return mux
 }
 
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// secretParams are query parameters whose values /status hides.
+var secretParams = regexp.MustCompile(`(?i)(key|token|secret|password|passwd|signature|auth)`)
+
+// RedactURL hides a URL's password and any query parameter that looks like a
+// credential (TfL's app_key, say).
+func RedactURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "(unparseable URL)"
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "REDACTED")
+		}
+	}
+	if u.RawQuery != "" {
+		q := u.Query()
+		for k := range q {
+			if secretParams.MatchString(k) {
+				q.Set(k, "REDACTED")
+			}
+		}
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// dsnPassword matches the password of a key=value connection string.
+var dsnPassword = regexp.MustCompile(`(?i)(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// RedactDSN hides the password in a Postgres URL or key=value connection string.
+func RedactDSN(dsn string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return RedactURL(dsn)
+	}
+	return dsnPassword.ReplaceAllString(dsn, "${1}REDACTED")
+}
+
+// urlInText matches the URLs an error message quotes, as net/http's do.
+var urlInText = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"']+`)
+
+// RedactError is err's message with the credentials in any URL or connection string
+// it quotes hidden, for errors that are served rather than only logged.
+func RedactError(err error) string {
+	s := urlInText.ReplaceAllStringFunc(err.Error(), RedactURL)
+	return dsnPassword.ReplaceAllString(s, "${1}REDACTED")
+}
@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// StationGauge is one station's latest counts for the per-station exporter.
+type StationGauge struct {
+	ID           string
+	Name         string
+	Neighborhood string
+	Area         string
+	Bikes        int // classic and e-bikes
+	EBikes       int
+	Docks        int
+}
+
+type neighborhoodGauge struct {
+	neighborhood, area    string
+	stations, empty, full int
+	bikes, ebikes, docks  int
+}
+
+var (
+	stationMu     sync.Mutex
+	stationsOn    bool
+	stationLimit  int // 0: no limit
+	stationGauges []StationGauge
+	neighborhoods []neighborhoodGauge
+	stationsOver  int // stations in the last poll when over stationLimit, else 0
+)
+
+// EnableStationGauges turns on the per-station exporter. Past limit stations (zero =
+// no limit), the per-station series are withheld (the neighborhood aggregates are still
+// exported) so a misconfigured filter can't flood Prometheus with series.
+func EnableStationGauges(limit int) {
+	stationMu.Lock()
+	defer stationMu.Unlock()
+	stationsOn, stationLimit = true, limit
+}
+
+// SetStationGauges replaces the exported stations with one poll's, so stations that
+// leave the feed stop being exported. It reports whether the per-station series were
+// withheld for exceeding the limit.
+func SetStationGauges(gauges []StationGauge) (withheld bool) {
+	sorted := append([]StationGauge(nil), gauges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	byNeighborhood := make(map[string]*neighborhoodGauge)
+	var hoods []neighborhoodGauge
+	for _, g := range sorted {
+		if g.Neighborhood == "" {
+			continue
+		}
+		n, ok := byNeighborhood[g.Neighborhood]
+		if !ok {
+			n = &neighborhoodGauge{neighborhood: g.Neighborhood, area: g.Area}
+			byNeighborhood[g.Neighborhood] = n
+		}
+		n.stations++
+		n.bikes += g.Bikes
+		n.ebikes += g.EBikes
+		n.docks += g.Docks
+		if g.Bikes == 0 {
+			n.empty++
+		}
+		if g.Docks == 0 {
+			n.full++
+		}
+	}
+	for _, n := range byNeighborhood {
+		hoods = append(hoods, *n)
+	}
+	sort.Slice(hoods, func(i, j int) bool { return hoods[i].neighborhood < hoods[j].neighborhood })
+
+	stationMu.Lock()
+	defer stationMu.Unlock()
+	stationsOver = 0
+	if stationLimit > 0 && len(sorted) > stationLimit {
+		stationsOver, sorted = len(sorted), nil
+	}
+	stationGauges, neighborhoods = sorted, hoods
+	return stationsOver > 0
+}
+
+// labelValue escapes a label value for the text exposition format.
+var labelValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeStationGauges(w io.Writer) {
+	stationMu.Lock()
+	defer stationMu.Unlock()
+	if !stationsOn {
+		return
+	}
+
+	station := func(name, help string, value func(StationGauge) int) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, g := range stationGauges {
+			fmt.Fprintf(w, "%s{station_id=\"%s\",name=\"%s\",neighborhood=\"%s\",area=\"%s\"} %d\n", name,
+				labelValue.Replace(g.ID), labelValue.Replace(g.Name), labelValue.Replace(g.Neighborhood),
+				labelValue.Replace(g.Area), value(g))
+		}
+	}
+	station("citibike_station_bikes_available", "Bikes (classic and e-bikes) available at the station.",
+		func(g StationGauge) int { return g.Bikes })
+	station("citibike_station_ebikes_available", "E-bikes available at the station.",
+		func(g StationGauge) int { return g.EBikes })
+	station("citibike_station_docks_available", "Free docks at the station.",
+		func(g StationGauge) int { return g.Docks })
+
+	hood := func(name, help string, value func(neighborhoodGauge) int) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, n := range neighborhoods {
+			fmt.Fprintf(w, "%s{neighborhood=\"%s\",area=\"%s\"} %d\n", name,
+				labelValue.Replace(n.neighborhood), labelValue.Replace(n.area), value(n))
+		}
+	}
+	hood("citibike_neighborhood_stations", "Stations reporting in the neighborhood.",
+		func(n neighborhoodGauge) int { return n.stations })
+	hood("citibike_neighborhood_bikes_available", "Bikes (classic and e-bikes) available in the neighborhood.",
+		func(n neighborhoodGauge) int { return n.bikes })
+	hood("citibike_neighborhood_ebikes_available", "E-bikes available in the neighborhood.",
+		func(n neighborhoodGauge) int { return n.ebikes })
+	hood("citibike_neighborhood_docks_available", "Free docks in the neighborhood.",
+		func(n neighborhoodGauge) int { return n.docks })
+	hood("citibike_neighborhood_empty_stations", "Stations in the neighborhood with no bikes.",
+		func(n neighborhoodGauge) int { return n.empty })
+	hood("citibike_neighborhood_full_stations", "Stations in the neighborhood with no free docks.",
+		func(n neighborhoodGauge) int { return n.full })
+
+	fmt.Fprintf(w, "# HELP citibike_station_gauges_withheld_stations Stations in the last poll when over the per-station limit (their series are withheld), else 0.\n")
+	fmt.Fprintf(w, "# TYPE citibike_station_gauges_withheld_stations gauge\n")
+	fmt.Fprintf(w, "citibike_station_gauges_withheld_stations %d\n", stationsOver)
+}
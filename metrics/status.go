@@ -0,0 +1,164 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Readiness criteria for /ready; see SetReadiness.
+const (
+	ReadyIngest = "ingest" // a recent successful poll: fetch and write (a standby: fetch)
+	ReadyFetch  = "fetch"  // a recent successful fetch, whatever became of the write
+	ReadyWrite  = "write"  // a recent successful write
+)
+
+// Outcome is the latest result of one stage of a poll: fetching the feed or writing it.
+type Outcome struct {
+	At          time.Time  `json:"at"` // the latest attempt
+	OK          bool       `json:"ok"`
+	Sink        string     `json:"sink,omitempty"`
+	Error       string     `json:"error,omitempty"` // the latest error, kept after a later success
+	ErrorAt     *time.Time `json:"errorAt,omitempty"`
+	SucceededAt *time.Time `json:"succeededAt,omitempty"` // the latest success
+}
+
+var (
+	started = time.Now()
+
+	statusMu  sync.Mutex
+	readyOn   = ReadyIngest
+	lastFetch *Outcome
+	lastWrite *Outcome
+	sections  = map[string]any{}
+)
+
+// SetReadiness picks what /ready requires, one of the Ready* criteria, and how recent
+// it must be (zero keeps the default of five minutes).
+func SetReadiness(on string, grace time.Duration) error {
+	switch on {
+	case ReadyIngest, ReadyFetch, ReadyWrite:
+	default:
+		return fmt.Errorf("unknown readiness criterion %q (want %s, %s or %s)", on, ReadyIngest, ReadyFetch, ReadyWrite)
+	}
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	readyOn = on
+	if grace > 0 {
+		readyGrace = grace
+	}
+	return nil
+}
+
+// RecordFetch records the outcome of fetching the feed. Errors are kept with their
+// credentials redacted (see RedactError), as /status and /ready serve them.
+func RecordFetch(at time.Time, err error) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	lastFetch = record(lastFetch, "", at, err)
+}
+
+// RecordWrite records the outcome of writing a poll to sink.
+func RecordWrite(sink string, at time.Time, err error) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	lastWrite = record(lastWrite, sink, at, err)
+}
+
+func record(prev *Outcome, sink string, at time.Time, err error) *Outcome {
+	o := &Outcome{At: at, OK: err == nil, Sink: sink}
+	if prev != nil {
+		o.Error, o.ErrorAt, o.SucceededAt = prev.Error, prev.ErrorAt, prev.SucceededAt
+	}
+	if err != nil {
+		o.Error, o.ErrorAt = RedactError(err), &at
+	} else {
+		o.SucceededAt = &at
+	}
+	return o
+}
+
+// SetStatus publishes v under name in /status, e.g. the ingester's configuration.
+// v is marshalled on every request, so pass a value the caller won't modify.
+func SetStatus(name string, v any) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	sections[name] = v
+}
+
+// ready reports whether the readiness criterion is met, and if not, why.
+func ready(now time.Time) (bool, string) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	recent := func(t *time.Time) bool { return t != nil && now.Sub(*t) < readyGrace }
+	var why string
+	switch readyOn {
+	case ReadyFetch:
+		if lastFetch != nil && recent(lastFetch.SucceededAt) {
+			return true, ""
+		}
+		why = "no recent successful fetch"
+	case ReadyWrite:
+		if lastWrite != nil && recent(lastWrite.SucceededAt) {
+			return true, ""
+		}
+		why = "no recent successful write"
+	default:
+		if last := atomic.LoadInt64(&lastSuccess); last > 0 {
+			if t := time.Unix(last, 0); recent(&t) {
+				return true, ""
+			}
+		}
+		why = "no recent successful ingest"
+	}
+	// say which stage is failing, so the feed and the database can be told apart
+	if lastFetch != nil && !lastFetch.OK {
+		why += "; fetch failing: " + lastFetch.Error
+	} else if lastWrite != nil && !lastWrite.OK {
+		why += "; write failing: " + lastWrite.Error
+	}
+	return false, why
+}
+
+// serveStatus writes /status: uptime, readiness, the latest fetch and write outcomes
+// and every section published with SetStatus.
+func serveStatus(w http.ResponseWriter, _ *http.Request) {
+	now := time.Now()
+	ok, why := ready(now)
+
+	statusMu.Lock()
+	body := map[string]any{
+		"startedAt":         started.UTC(),
+		"uptimeSeconds":     int64(now.Sub(started).Seconds()),
+		"ready":             ok,
+		"readyOn":           readyOn,
+		"readyGraceSeconds": readyGrace.Seconds(),
+		"stations":          atomic.LoadInt64(&stations),
+		"lastFetch":         lastFetch,
+		"lastWrite":         lastWrite,
+	}
+	if !ok {
+		body["notReady"] = why
+	}
+	if r := roleName(); r != "" {
+		body["role"] = r
+	}
+	if n := atomic.LoadInt64(&spoolRows); n > 0 {
+		body["spoolRows"] = n
+	}
+	for name, v := range sections {
+		body[name] = v
+	}
+	out, err := json.MarshalIndent(body, "", "  ")
+	statusMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(append(out, '\n'))
+}
@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Vec is a counter or gauge family with a single label, rendered in the same
+// hand-rolled text format as the counters in metrics.go. Safe for concurrent use.
+type Vec struct {
+	name  string
+	help  string
+	kind  string // "counter" or "gauge"
+	label string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// HistogramVec is a Histogram family with a single label.
+type HistogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+
+	mu       sync.Mutex
+	children map[string]*Histogram
+}
+
+var (
+	vecMu sync.Mutex
+	vecs  []interface{ write(io.Writer) }
+)
+
+func register(v interface{ write(io.Writer) }) {
+	vecMu.Lock()
+	vecs = append(vecs, v)
+	vecMu.Unlock()
+}
+
+// NewCounterVec creates a labelled counter and registers it for /metrics.
+func NewCounterVec(name, help, label string) *Vec {
+	v := &Vec{name: name, help: help, kind: "counter", label: label, values: make(map[string]float64)}
+	register(v)
+	return v
+}
+
+// NewGaugeVec creates a labelled gauge and registers it for /metrics.
+func NewGaugeVec(name, help, label string) *Vec {
+	v := &Vec{name: name, help: help, kind: "gauge", label: label, values: make(map[string]float64)}
+	register(v)
+	return v
+}
+
+// NewHistogramVec creates a labelled histogram and registers it for /metrics.
+func NewHistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	v := &HistogramVec{name: name, help: help, label: label, buckets: buckets, children: make(map[string]*Histogram)}
+	register(v)
+	return v
+}
+
+// Add adds n to the series labelled value.
+func (v *Vec) Add(value string, n float64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[value] += n
+}
+
+// Inc adds one to the series labelled value.
+func (v *Vec) Inc(value string) { v.Add(value, 1) }
+
+// Set sets the series labelled value (gauges).
+func (v *Vec) Set(value string, n float64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[value] = n
+}
+
+// Delete drops the series labelled value, e.g. a gauge that no longer applies.
+func (v *Vec) Delete(value string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.values, value)
+}
+
+func (v *Vec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", v.name, v.label, labelValue.Replace(k),
+			strconv.FormatFloat(v.values[k], 'g', -1, 64))
+	}
+}
+
+// With returns the histogram labelled value, creating it on first use.
+func (v *HistogramVec) With(value string) *Histogram {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.children[value]
+	if !ok {
+		h = &Histogram{name: v.name, buckets: v.buckets, counts: make([]uint64, len(v.buckets)),
+			labels: fmt.Sprintf("%s=\"%s\"", v.label, labelValue.Replace(value))}
+		v.children[value] = h
+	}
+	return h
+}
+
+func (v *HistogramVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", v.name, v.help, v.name)
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v.children[k].writeSamples(w)
+	}
+}
+
+func writeVecs(w io.Writer) {
+	vecMu.Lock()
+	vs := append([]interface{ write(io.Writer) }(nil), vecs...)
+	vecMu.Unlock()
+	for _, v := range vs {
+		v.write(w)
+	}
+}
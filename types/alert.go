@@ -0,0 +1,20 @@
+package types
+
+import "time"
+
+// Alert is one notification from an alert rule: "firing" when the rule's condition has
+// held for its minimum duration, and "resolved" (for rules that ask for it) on the
+// first poll it no longer does. It is the body posted to generic webhooks.
+type Alert struct {
+	Rule       string    `json:"rule"`
+	Status     string    `json:"status"`     // "firing" or "resolved"
+	TargetKind string    `json:"targetKind"` // "station", "neighborhood" or "area"
+	Target     string    `json:"target"`     // station_id, neighborhood slug or area
+	Name       string    `json:"name,omitempty"`
+	Metric     string    `json:"metric"`
+	Value      int       `json:"value"` // flags are 1 (true) or 0 (false)
+	Condition  string    `json:"condition"`
+	Since      time.Time `json:"since"` // first poll of the run that matched
+	At         time.Time `json:"at"`
+	Message    string    `json:"message"`
+}
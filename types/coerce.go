@@ -3,7 +3,9 @@ package types
 import (
 	"bytes"
 	"encoding/json"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // LocalizedText is a name that arrives as a plain string (GBFS v2 — Lyft/Smovengo/PBSC v2)
@@ -106,3 +108,21 @@ func (s *Station) UnmarshalJSON(b []byte) error {
 	s.StationID = coerceID(aux.StationID)
 	return nil
 }
+
+// FeedTime interprets a GBFS last_updated: POSIX seconds in v2 (a JSON number, or a
+// numeric string from a few operators) or an RFC 3339 timestamp in v3. Anything else
+// (including a missing field, e.g. TfL) is the zero time.
+func FeedTime(v any) time.Time {
+	switch t := v.(type) {
+	case float64:
+		return time.Unix(int64(t), 0)
+	case string:
+		if ts, err := time.Parse(time.RFC3339, t); err == nil {
+			return ts
+		}
+		if secs, err := strconv.ParseInt(t, 10, 64); err == nil {
+			return time.Unix(secs, 0)
+		}
+	}
+	return time.Time{}
+}
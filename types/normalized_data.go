@@ -10,6 +10,12 @@ type NormalizedStationData struct {
 type NormalizedStationDataTS struct {
 	Station   NormalizedStation `json:"station"`
 	TimeStamp time.Time         `json:"timestamp"`
+	// Set only in --changes-only mode: the station's previous values, a delta such as
+	// "bikes -2, ebikes +1", and whether this row is part of a full resync keyframe.
+	// All omitempty, so the default output is unchanged.
+	Previous *NormalizedStation `json:"previous,omitempty"`
+	Delta    string             `json:"delta,omitempty"`
+	Keyframe bool               `json:"keyframe,omitempty"`
 }
 
 type NormalizedStation struct {
@@ -0,0 +1,23 @@
+package types
+
+import "time"
+
+// StationFlow is one station-hour of inferred demand. GBFS only publishes counts, so
+// rentals and returns are estimated from the change between consecutive snapshots:
+// a drop in available bikes is counted as rentals, a rise as returns, split by bike
+// type (classic = bikes - e-bikes). Changes at or above the rebalancing threshold in a
+// single interval are assumed to be an operator truck and kept out of the demand
+// columns. Net counting can't see a rental and a return that cancel out within one
+// interval, so the demand columns are lower bounds.
+type StationFlow struct {
+	StationID      string    `json:"stationId"`
+	Neighborhood   string    `json:"neighborhood,omitempty"`
+	Hour           time.Time `json:"hour"`
+	ClassicRentals int       `json:"classicRentals"`
+	ClassicReturns int       `json:"classicReturns"`
+	EBikeRentals   int       `json:"eBikeRentals"`
+	EBikeReturns   int       `json:"eBikeReturns"`
+	RebalanceOut   int       `json:"rebalanceOut"`
+	RebalanceIn    int       `json:"rebalanceIn"`
+	Intervals      int       `json:"intervals"` // snapshot pairs that contributed
+}
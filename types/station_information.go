@@ -10,6 +10,7 @@ type StationInformation struct {
 
 type StationEntity struct {
 	ExternalID string  `json:"external_id"`
+	LegacyID   string  `json:"legacy_id,omitempty"` // Lyft: the pre-2021 numeric id used in old trip data
 	Lat        float64 `json:"lat"`
 	StationID  string  `json:"station_id"`
 	RentalUris struct {
@@ -0,0 +1,27 @@
+package types
+
+import "time"
+
+// StationOutage is an event in one episode of a station being out of service for riders:
+// empty (no bikes to rent), full (no docks to return to), out of e-bikes, or not
+// renting at all. An episode is "opened" on the first poll that sees the condition and
+// "closed" on the first poll that no longer does, so Start and End are the polls that
+// bracket it and the duration is accurate to one polling interval.
+//
+// Gaps in polling (a feed outage, a restart, a station missing from the feed) are
+// handled conservatively: an episode open across a gap is closed at the last poll
+// before it with CensoredEnd set, and one already under way when a station is first
+// seen, or first seen again after a gap, starts at that poll with CensoredStart set.
+// Censored durations are therefore lower bounds.
+type StationOutage struct {
+	Event           string     `json:"event"` // "opened" or "closed"
+	StationID       string     `json:"stationId"`
+	Name            string     `json:"name,omitempty"`
+	Neighborhood    string     `json:"neighborhood,omitempty"`
+	Kind            string     `json:"kind"` // "empty", "full", "no_ebikes" or "not_renting"
+	Start           time.Time  `json:"start"`
+	End             *time.Time `json:"end,omitempty"`
+	DurationSeconds float64    `json:"durationSeconds,omitempty"`
+	CensoredStart   bool       `json:"censoredStart,omitempty"`
+	CensoredEnd     bool       `json:"censoredEnd,omitempty"`
+}
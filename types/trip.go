@@ -0,0 +1,25 @@
+package types
+
+import "time"
+
+// Trip is one row of an operator's published trip history (Citi Bike's monthly
+// tripdata CSVs), normalized across the historical column layouts. StartStationID /
+// EndStationID are the current GBFS station_id when the trip's station could be
+// matched, and empty otherwise; the raw id from the file is kept in *StationRef.
+type Trip struct {
+	RideID             string
+	RideableType       string // "classic_bike", "electric_bike", … (empty before 2021)
+	StartedAt          time.Time
+	EndedAt            time.Time
+	StartStationRef    string
+	StartStationID     string
+	StartStationName   string
+	StartLat, StartLon float64
+	StartNeighborhood  string
+	EndStationRef      string
+	EndStationID       string
+	EndStationName     string
+	EndLat, EndLon     float64
+	EndNeighborhood    string
+	MemberType         string // "member" or "casual" (legacy Subscriber/Customer are mapped)
+}
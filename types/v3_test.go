@@ -3,6 +3,7 @@ package types
 import (
 	"encoding/json"
 	"testing"
+	"time"
 )
 
 // TestGBFSv3Parsing covers the PBSC GBFS v3 shape (e.g. BA Ecobici): a localized `name`
@@ -45,3 +46,21 @@ func TestGBFSv3Parsing(t *testing.T) {
 		t.Errorf("v2 status regressed")
 	}
 }
+
+// TestFeedTime covers last_updated in both GBFS versions: v2 POSIX seconds and v3
+// RFC 3339 strings.
+func TestFeedTime(t *testing.T) {
+	want := time.Date(2026, 6, 28, 0, 0, 0, 0, time.UTC)
+	for _, raw := range []string{`{"last_updated":1782604800}`, `{"last_updated":"2026-06-28T00:00:00Z"}`, `{"last_updated":"1782604800"}`} {
+		var ss StationStatus
+		if err := json.Unmarshal([]byte(raw), &ss); err != nil {
+			t.Fatal(err)
+		}
+		if got := FeedTime(ss.LastUpdated); !got.Equal(want) {
+			t.Errorf("%s: got %v, want %v", raw, got, want)
+		}
+	}
+	if got := FeedTime(nil); !got.IsZero() {
+		t.Errorf("missing last_updated: got %v, want zero", got)
+	}
+}